@@ -1,39 +1,131 @@
 package api
 
 import (
+	"context"
 	"database/sql"
 	"encoding/json"
 	"fmt"
-	"log"
+	"log/slog"
 	"net/http"
+	"strconv"
 	"strings"
+	"time"
 
+	"github.com/coffeendude/ipfs-cids-go-scraper/assets"
+	"github.com/coffeendude/ipfs-cids-go-scraper/export"
+	"github.com/coffeendude/ipfs-cids-go-scraper/logging"
 	"github.com/coffeendude/ipfs-cids-go-scraper/metadata"
+	"github.com/coffeendude/ipfs-cids-go-scraper/metrics"
+	"github.com/coffeendude/ipfs-cids-go-scraper/search"
+	"github.com/coffeendude/ipfs-cids-go-scraper/tracing"
 	_ "github.com/lib/pq"
+	semconv "go.opentelemetry.io/otel/semconv/v1.21.0"
 )
 
-func StartServer(db *sql.DB) {
+// StartServer serves the API on :8080. blobs is the asset archive images
+// are served from, or nil if assets aren't archived.
+func StartServer(db *sql.DB, blobs *assets.Blobs) error {
 	router := http.NewServeMux()
+	searcher, err := search.New(context.Background(), db)
+	if err != nil {
+		return err
+	}
+	rarity := newRarityCache(db, rarityTTL)
 
-	router.HandleFunc("/tokens", func(w http.ResponseWriter, r *http.Request) {
+	router.Handle("/tokens", instrument("/tokens", func(w http.ResponseWriter, r *http.Request) {
 		handleAllTokensRequest(db, w, r)
-	})
-	router.HandleFunc("/tokens/", func(w http.ResponseWriter, r *http.Request) {
+	}))
+	router.Handle("/tokens/export", instrument("/tokens/export", func(w http.ResponseWriter, r *http.Request) {
+		handleExportRequest(db, w, r)
+	}))
+	router.Handle("/tokens/search", instrument("/tokens/search", func(w http.ResponseWriter, r *http.Request) {
+		handleSearchRequest(searcher, w, r)
+	}))
+	router.Handle("/tokens/", tokenRoutes(db, blobs))
+	router.Handle("/traits", instrument("/traits", func(w http.ResponseWriter, r *http.Request) {
+		handleTraitsRequest(db, "", w, r)
+	}))
+	router.Handle("/rarity", instrument("/rarity", func(w http.ResponseWriter, r *http.Request) {
+		handleRarityRequest(rarity, "", w, r)
+	}))
+	router.Handle("/collections", instrument("/collections", func(w http.ResponseWriter, r *http.Request) {
+		handleCollectionsRequest(db, w, r)
+	}))
+	router.Handle("/collections/", collectionRoutes(db, rarity))
+	router.Handle("/metrics", metrics.Handler())
+
+	slog.Info("Starting server", "addr", ":8080")
+	return http.ListenAndServe(":8080", logging.RequestIDMiddleware(router))
+}
+
+// tokenRoutes serves a single token, and its image under the /image
+// suffix. CIDs may be paths, so the suffix is all that tells them apart.
+func tokenRoutes(db *sql.DB, blobs *assets.Blobs) http.Handler {
+	token := instrument("/tokens/{cid}", func(w http.ResponseWriter, r *http.Request) {
 		handleSingleTokenRequest(db, w, r)
 	})
+	image := instrument("/tokens/{cid}/image", func(w http.ResponseWriter, r *http.Request) {
+		cid := strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/tokens/"), "/image")
+		handleImageRequest(db, blobs, cid, w, r)
+	})
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasSuffix(r.URL.Path, "/image") {
+			image.ServeHTTP(w, r)
+			return
+		}
+		token.ServeHTTP(w, r)
+	})
+}
 
-	log.Println("Starting server on :8080")
-	err := http.ListenAndServe(":8080", router)
-	if err != nil {
-		log.Fatalf("Error starting server: %v", err)
+// instrument records metrics, a trace span and an access log line for
+// every request to route. Incoming W3C trace context is honoured so API
+// spans join the caller's trace.
+func instrument(route string, h http.HandlerFunc) http.Handler {
+	traced := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		ctx := tracing.Extract(r.Context(), r.Header)
+		ctx, span := tracing.Start(ctx, r.Method+" "+route,
+			semconv.HTTPMethod(r.Method), semconv.HTTPRoute(route))
+		defer span.End()
+
+		sw := &statusWriter{ResponseWriter: w, status: http.StatusOK}
+		h(sw, r.WithContext(ctx))
+
+		span.SetAttributes(semconv.HTTPStatusCode(sw.status))
+		logging.From(ctx).Info("Handled request",
+			"method", r.Method,
+			"route", route,
+			logging.Status, sw.status,
+			logging.Duration, time.Since(start))
+	})
+	return metrics.InstrumentRoute(route, traced)
+}
+
+// statusWriter remembers the status code written by a handler.
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+func (w *statusWriter) WriteHeader(status int) {
+	w.status = status
+	w.ResponseWriter.WriteHeader(status)
+}
+
+// Flush lets streaming handlers flush through the wrapper.
+func (w *statusWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
 	}
 }
 
 func handleAllTokensRequest(db *sql.DB, w http.ResponseWriter, r *http.Request) {
-	log.Println("Fetching all metadata")
-	metadata, err := getAllMetadata(db)
+	logger := logging.From(r.Context())
+	logger.Debug("Fetching all metadata")
+	q := r.URL.Query()
+	metadata, err := getAllMetadata(r.Context(), db, export.Filter{Traits: traitParams(q), Invalid: q.Get("invalid") == "true"})
 	if err != nil {
-		log.Println("Error fetching all metadata:", err)
+		logger.Error("Error fetching all metadata", "error", err)
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
@@ -42,48 +134,131 @@ func handleAllTokensRequest(db *sql.DB, w http.ResponseWriter, r *http.Request)
 
 func handleSingleTokenRequest(db *sql.DB, w http.ResponseWriter, r *http.Request) {
 	cid := strings.TrimPrefix(r.URL.Path, "/tokens/")
-	metadata, err := getMetadataForCID(db, cid)
+	logger := logging.From(r.Context()).With(logging.CID, cid)
+	logger.Debug("Fetching metadata")
+	metadata, err := getMetadataForCID(r.Context(), db, cid)
 	if err != nil {
+		logger.Error("Error fetching metadata", "error", err)
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
-	fmt.Println(cid)
 	json.NewEncoder(w).Encode(metadata)
 }
 
-func getAllMetadata(db *sql.DB) ([]metadata.Metadata, error) {
-	rows, err := db.Query("SELECT cid, image, description, name FROM metadata")
+// handleExportRequest streams the metadata table in the format given by the
+// format query parameter, filtered by the cid, name and limit parameters.
+func handleExportRequest(db *sql.DB, w http.ResponseWriter, r *http.Request) {
+	logger := logging.From(r.Context())
+	q := r.URL.Query()
+
+	format := q.Get("format")
+	if format == "" {
+		format = export.FormatJSONL
+	}
+	filter := export.Filter{Collection: q.Get("collection"), NameContains: q.Get("name"), Traits: traitParams(q), Invalid: q.Get("invalid") == "true"}
+	for _, cid := range strings.Split(q.Get("cid"), ",") {
+		if cid = strings.TrimSpace(cid); cid != "" {
+			filter.CIDs = append(filter.CIDs, cid)
+		}
+	}
+	limit, err := intParam(q.Get("limit"))
 	if err != nil {
-		return nil, fmt.Errorf("error querying metadata: %w", err)
+		http.Error(w, "invalid limit", http.StatusBadRequest)
+		return
+	}
+	filter.Limit = limit
+	if err := export.CheckFormat(format); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
 	}
-	defer rows.Close()
 
-	metadatas := []metadata.Metadata{}
-	for rows.Next() {
-		var m metadata.Metadata
-		if err := rows.Scan(&m.Cid, &m.Image, &m.Description, &m.Name); err != nil {
-			return nil, fmt.Errorf("error scanning row: %w", err)
-		}
-		metadatas = append(metadatas, m)
+	w.Header().Set("Content-Type", export.ContentType(format))
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="metadata.%s"`, format))
+	var flush func()
+	if f, ok := w.(http.Flusher); ok {
+		flush = f.Flush
+	}
+
+	n, err := export.Export(r.Context(), db, w, format, filter, flush)
+	if err != nil {
+		// The status line has usually been sent by now, so all we can do
+		// is stop and log; the client sees a truncated body.
+		logger.Error("Error exporting metadata", "error", err, "rows", n)
+		return
+	}
+	logger.Debug("Exported metadata", "rows", n, "format", format)
+}
+
+// handleSearchRequest runs the full-text query in the q parameter, paged by
+// limit and offset.
+func handleSearchRequest(searcher search.Searcher, w http.ResponseWriter, r *http.Request) {
+	logger := logging.From(r.Context())
+	params := r.URL.Query()
+
+	q := search.Query{Text: strings.TrimSpace(params.Get("q"))}
+	if q.Text == "" {
+		http.Error(w, "missing q parameter", http.StatusBadRequest)
+		return
+	}
+	var err error
+	if q.Limit, err = intParam(params.Get("limit")); err != nil {
+		http.Error(w, "invalid limit", http.StatusBadRequest)
+		return
+	}
+	if q.Offset, err = intParam(params.Get("offset")); err != nil {
+		http.Error(w, "invalid offset", http.StatusBadRequest)
+		return
 	}
 
-	if err := rows.Err(); err != nil {
-		return nil, fmt.Errorf("error reading rows: %w", err)
+	results, err := searcher.Search(r.Context(), q)
+	if err != nil {
+		logger.Error("Error searching metadata", "error", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	logger.Debug("Searched metadata", "query", q.Text, "total", results.Total)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(results)
+}
+
+// intParam parses an optional non-negative integer query parameter.
+func intParam(s string) (int, error) {
+	if s == "" {
+		return 0, nil
+	}
+	n, err := strconv.Atoi(s)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid number %q", s)
 	}
+	return n, nil
+}
 
+// getAllMetadata returns the stored metadata matching filter.
+func getAllMetadata(ctx context.Context, db *sql.DB, filter export.Filter) ([]metadata.Metadata, error) {
+	metadatas := []metadata.Metadata{}
+	err := export.Each(ctx, db, filter, func(m *metadata.Metadata) error {
+		metadatas = append(metadatas, *m)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
 	return metadatas, nil
 }
 
-func getMetadataForCID(db *sql.DB, cid string) (*metadata.Metadata, error) {
-	row := db.QueryRow("SELECT cid, image, description, name FROM metadata WHERE cid = $1", cid)
+func getMetadataForCID(ctx context.Context, db *sql.DB, cid string) (_ *metadata.Metadata, err error) {
+	ctx, span := tracing.Start(ctx, "db.select metadata", tracing.DBAttributes("SELECT", "metadata")...)
+	defer func() { tracing.End(span, err) }()
+
+	row := db.QueryRowContext(ctx, "SELECT "+metadata.Columns+" FROM metadata WHERE cid = $1", cid)
 
-	var m metadata.Metadata
-	if err := row.Scan(&m.Cid, &m.Image, &m.Description, &m.Name); err != nil {
+	m, err := metadata.Scan(row)
+	if err != nil {
 		if err == sql.ErrNoRows {
 			return nil, nil // return nil, nil if no rows were found
 		}
 		return nil, fmt.Errorf("error scanning row: %w", err)
 	}
 
-	return &m, nil
+	return m, nil
 }
@@ -0,0 +1,131 @@
+package api
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+
+	"github.com/coffeendude/ipfs-cids-go-scraper/collection"
+	"github.com/coffeendude/ipfs-cids-go-scraper/export"
+	"github.com/coffeendude/ipfs-cids-go-scraper/logging"
+)
+
+// collectionHandler serves a route under /collections/{id}.
+type collectionHandler func(db *sql.DB, coll string, rest []string, w http.ResponseWriter, r *http.Request)
+
+// collectionRoutes dispatches /collections/{id}/... by path shape. Each
+// shape is instrumented under its own route pattern so metrics and traces
+// don't carry collection or token IDs.
+func collectionRoutes(db *sql.DB, rarity *rarityCache) http.Handler {
+	routes := map[string]http.Handler{}
+	add := func(route string, h collectionHandler) {
+		routes[route] = instrument(route, func(w http.ResponseWriter, r *http.Request) {
+			parts := strings.Split(strings.Trim(strings.TrimPrefix(r.URL.Path, "/collections/"), "/"), "/")
+			h(db, parts[0], parts[1:], w, r)
+		})
+	}
+	add("/collections/{id}", handleCollectionRequest)
+	add("/collections/{id}/tokens", handleCollectionTokensRequest)
+	add("/collections/{id}/tokens/{tokenId}", handleCollectionTokensRequest)
+	add("/collections/{id}/traits", func(db *sql.DB, coll string, _ []string, w http.ResponseWriter, r *http.Request) {
+		handleTraitsRequest(db, coll, w, r)
+	})
+	add("/collections/{id}/rarity", func(_ *sql.DB, coll string, _ []string, w http.ResponseWriter, r *http.Request) {
+		handleRarityRequest(rarity, coll, w, r)
+	})
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		parts := strings.Split(strings.Trim(strings.TrimPrefix(r.URL.Path, "/collections/"), "/"), "/")
+		route := ""
+		switch {
+		case parts[0] == "":
+		case len(parts) == 1:
+			route = "/collections/{id}"
+		case len(parts) == 2 && parts[1] == "tokens":
+			route = "/collections/{id}/tokens"
+		case len(parts) == 3 && parts[1] == "tokens":
+			route = "/collections/{id}/tokens/{tokenId}"
+		case len(parts) == 2 && (parts[1] == "traits" || parts[1] == "rarity"):
+			route = "/collections/{id}/" + parts[1]
+		}
+		if route == "" {
+			http.NotFound(w, r)
+			return
+		}
+		routes[route].ServeHTTP(w, r)
+	})
+}
+
+func handleCollectionsRequest(db *sql.DB, w http.ResponseWriter, r *http.Request) {
+	collections, err := collection.List(r.Context(), db)
+	if err != nil {
+		logging.From(r.Context()).Error("Error listing collections", "error", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(collections)
+}
+
+func handleCollectionRequest(db *sql.DB, coll string, _ []string, w http.ResponseWriter, r *http.Request) {
+	c, err := collection.Get(r.Context(), db, coll)
+	if err != nil {
+		collectionError(w, r, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(c)
+}
+
+// handleCollectionTokensRequest lists a collection's tokens in token ID
+// order, paged by limit and offset and filtered by trait, or returns one
+// token when rest holds its ID.
+func handleCollectionTokensRequest(db *sql.DB, coll string, rest []string, w http.ResponseWriter, r *http.Request) {
+	if _, err := collection.Get(r.Context(), db, coll); err != nil {
+		collectionError(w, r, err)
+		return
+	}
+	q := r.URL.Query()
+	filter := export.Filter{Collection: coll, Traits: traitParams(q), Invalid: q.Get("invalid") == "true"}
+	if len(rest) == 2 {
+		filter.TokenID = rest[1]
+	}
+	var err error
+	if filter.Limit, err = intParam(q.Get("limit")); err != nil {
+		http.Error(w, "invalid limit", http.StatusBadRequest)
+		return
+	}
+	if filter.Offset, err = intParam(q.Get("offset")); err != nil {
+		http.Error(w, "invalid offset", http.StatusBadRequest)
+		return
+	}
+
+	tokens, err := getAllMetadata(r.Context(), db, filter)
+	if err != nil {
+		logging.From(r.Context()).Error("Error fetching collection tokens", "collection", coll, "error", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if filter.TokenID == "" {
+		json.NewEncoder(w).Encode(tokens)
+		return
+	}
+	if len(tokens) == 0 {
+		http.Error(w, "no such token, or its metadata has not been scraped", http.StatusNotFound)
+		return
+	}
+	json.NewEncoder(w).Encode(tokens[0])
+}
+
+func collectionError(w http.ResponseWriter, r *http.Request, err error) {
+	if errors.Is(err, collection.ErrNotFound) {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	logging.From(r.Context()).Error("Error loading collection", "error", err)
+	http.Error(w, err.Error(), http.StatusInternalServerError)
+}
@@ -0,0 +1,123 @@
+package api
+
+import (
+	"bytes"
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/coffeendude/ipfs-cids-go-scraper/assets"
+	"github.com/coffeendude/ipfs-cids-go-scraper/logging"
+	"github.com/coffeendude/ipfs-cids-go-scraper/resolve"
+)
+
+// immutable is the Cache-Control of image responses, which only ever
+// serve one image at a URL.
+const immutable = "public, max-age=31536000, immutable"
+
+// handleImageRequest serves the archived image of a document, or with the
+// size query parameter a thumbnail of it. Thumbnails are made on first
+// request and cached next to the originals.
+//
+// An image whose document or URI can change, such as that of an IPNS name,
+// is served under a URL naming its content hash in the sha256 parameter;
+// requests without it, or with an old one, are redirected there.
+func handleImageRequest(db *sql.DB, blobs *assets.Blobs, cid string, w http.ResponseWriter, r *http.Request) {
+	logger := logging.From(r.Context()).With(logging.CID, cid)
+	if blobs == nil {
+		http.Error(w, "asset archive is not enabled (-assets-dir)", http.StatusNotFound)
+		return
+	}
+
+	size := 0
+	if s := r.URL.Query().Get("size"); s != "" {
+		var err error
+		size, err = strconv.Atoi(s)
+		if err != nil || !assets.ValidThumbnailSize(size) {
+			http.Error(w, fmt.Sprintf("invalid size %q, must be one of %v", s, assets.ThumbnailSizes), http.StatusBadRequest)
+			return
+		}
+	}
+
+	a, err := assets.Get(r.Context(), db, cid, assets.FieldImage)
+	if err != nil {
+		if errors.Is(err, assets.ErrNotFound) {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		logger.Error("Error loading asset", "error", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if a.Status != assets.StatusOK || !assets.ValidHash(a.Hash) {
+		http.Error(w, fmt.Sprintf("image of %s is %s: %s", cid, a.Status, a.Error), http.StatusNotFound)
+		return
+	}
+	if !assets.Servable(a.ContentType) {
+		http.Error(w, fmt.Sprintf("image of %s is %s, which isn't served", cid, a.ContentType), http.StatusUnsupportedMediaType)
+		return
+	}
+	if hash := r.URL.Query().Get("sha256"); hash != a.Hash && (hash != "" || !immutableImage(cid, a.URI)) {
+		q := r.URL.Query()
+		q.Set("sha256", a.Hash)
+		w.Header().Set("Cache-Control", "no-cache")
+		http.Redirect(w, r, r.URL.EscapedPath()+"?"+q.Encode(), http.StatusFound)
+		return
+	}
+
+	data, err := os.ReadFile(blobs.Path(a.Hash))
+	if err != nil {
+		logger.Error("Error reading asset", "sha256", a.Hash, "error", err)
+		http.Error(w, "archived image is missing", http.StatusNotFound)
+		return
+	}
+	contentType, etag := a.ContentType, `"`+a.Hash+`"`
+	if size > 0 {
+		etag = `"` + a.Hash + "-" + strconv.Itoa(size) + `"`
+		if data, contentType, err = thumbnail(blobs.Thumbnails(size), a.Hash, data, size); err != nil {
+			logger.Warn("Error making thumbnail", "size", size, "error", err)
+			http.Error(w, err.Error(), http.StatusUnsupportedMediaType)
+			return
+		}
+	}
+
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Cache-Control", immutable)
+	w.Header().Set("ETag", etag)
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.Header().Set("Content-Security-Policy", "default-src 'none'")
+	http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(data))
+}
+
+// immutableImage reports whether the image of the document stored under
+// cid, fetched from uri, can never change: both are content addressed.
+func immutableImage(cid, uri string) bool {
+	for _, u := range []string{cid, uri} {
+		src, err := resolve.Parse(u)
+		if err != nil || !src.Immutable() {
+			return false
+		}
+	}
+	return true
+}
+
+// thumbnail returns the cached thumbnail of the image with hash, making it
+// if needed. Thumbnails are always JPEG or PNG, which can be told apart by
+// their first bytes.
+func thumbnail(cache *assets.Blobs, hash string, data []byte, size int) ([]byte, string, error) {
+	if thumb, err := os.ReadFile(cache.Path(hash)); err == nil {
+		return thumb, http.DetectContentType(thumb), nil
+	}
+	thumb, contentType, err := assets.Thumbnail(data, size)
+	if err != nil {
+		return nil, "", err
+	}
+	// A thumbnail that can't be cached is still served; it is only made
+	// again next time.
+	cache.Put(hash, thumb)
+	return thumb, contentType, nil
+}
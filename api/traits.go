@@ -0,0 +1,203 @@
+package api
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/coffeendude/ipfs-cids-go-scraper/export"
+	"github.com/coffeendude/ipfs-cids-go-scraper/logging"
+	"github.com/coffeendude/ipfs-cids-go-scraper/metadata"
+	"github.com/coffeendude/ipfs-cids-go-scraper/traits"
+)
+
+// traitPrefix marks query parameters that filter by trait, as in
+// ?trait.Background=Blue. Repeating a trait matches any of its values.
+const traitPrefix = "trait."
+
+// traitParams returns the trait filters in q, or nil if there are none.
+func traitParams(q url.Values) map[string][]string {
+	var filters map[string][]string
+	for key, values := range q {
+		name, ok := strings.CutPrefix(key, traitPrefix)
+		if !ok || name == "" {
+			continue
+		}
+		if filters == nil {
+			filters = map[string][]string{}
+		}
+		filters[name] = append(filters[name], values...)
+	}
+	return filters
+}
+
+// handleTraitsRequest returns how many tokens have each value of each
+// trait, among the tokens of coll (all tokens if empty) matching any trait
+// filters.
+func handleTraitsRequest(db *sql.DB, coll string, w http.ResponseWriter, r *http.Request) {
+	logger := logging.From(r.Context())
+	tokens, err := getAllMetadata(r.Context(), db, export.Filter{Collection: coll, Traits: traitParams(r.URL.Query())})
+	if err != nil {
+		logger.Error("Error fetching metadata", "error", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(traits.Distribute(tokens))
+}
+
+// rarityTTL is how long rarity scores are reused. Scoring reads every
+// token of a collection, so it isn't repeated for every request.
+const rarityTTL = time.Minute
+
+// rarityCache keeps the rarity scores of each collection, under each
+// method, for ttl. Requests for scores that are being computed wait for
+// them instead of computing them again.
+type rarityCache struct {
+	db  *sql.DB
+	ttl time.Duration
+
+	mu      sync.Mutex
+	entries map[rarityKey]*rarityEntry
+}
+
+type rarityKey struct {
+	coll, method string
+}
+
+type rarityEntry struct {
+	done    chan struct{}
+	scores  []traits.Score
+	err     error
+	expires time.Time
+}
+
+func newRarityCache(db *sql.DB, ttl time.Duration) *rarityCache {
+	return &rarityCache{db: db, ttl: ttl, entries: map[rarityKey]*rarityEntry{}}
+}
+
+// scores returns the scores of the tokens of coll, or of every stored
+// token if coll is empty, ordered by rank under method.
+func (c *rarityCache) scores(ctx context.Context, coll, method string) ([]traits.Score, error) {
+	key := rarityKey{coll, method}
+	c.mu.Lock()
+	e, ok := c.entries[key]
+	if ok && c.stale(e) {
+		ok = false
+	}
+	if !ok {
+		for k, old := range c.entries {
+			if c.stale(old) {
+				delete(c.entries, k)
+			}
+		}
+		e = &rarityEntry{done: make(chan struct{})}
+		c.entries[key] = e
+	}
+	c.mu.Unlock()
+
+	if !ok {
+		// Other requests may be waiting, so the scores are computed even
+		// if this one is cancelled.
+		var tokens []metadata.Metadata
+		tokens, e.err = getAllMetadata(context.WithoutCancel(ctx), c.db, export.Filter{Collection: coll})
+		if e.err == nil {
+			e.scores = traits.Rarity(tokens, method)
+		}
+		e.expires = time.Now().Add(c.ttl)
+		close(e.done)
+	}
+	select {
+	case <-e.done:
+		return e.scores, e.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// stale reports whether e has expired or failed. It must be called with
+// c.mu held.
+func (c *rarityCache) stale(e *rarityEntry) bool {
+	select {
+	case <-e.done:
+		return e.err != nil || !time.Now().Before(e.expires)
+	default:
+		return false
+	}
+}
+
+// rarityResponse is a page of rarity scores ordered by rank.
+type rarityResponse struct {
+	Method  string         `json:"method"`
+	Total   int            `json:"total"`
+	Limit   int            `json:"limit,omitempty"`
+	Offset  int            `json:"offset"`
+	Results []traits.Score `json:"results"`
+}
+
+// handleRarityRequest ranks every token of coll, or every stored token if
+// coll is empty, by rarity. The method parameter
+// picks the ordering, normalized by default; cid returns a single token's
+// scores, and limit and offset page through the ranking. Scores come from
+// cache, so they may be up to rarityTTL old.
+func handleRarityRequest(cache *rarityCache, coll string, w http.ResponseWriter, r *http.Request) {
+	logger := logging.From(r.Context())
+	q := r.URL.Query()
+
+	method := q.Get("method")
+	switch method {
+	case "":
+		method = traits.Normalized
+	case traits.Normalized, traits.Statistical:
+	default:
+		http.Error(w, "invalid method: want normalized or statistical", http.StatusBadRequest)
+		return
+	}
+	limit, err := intParam(q.Get("limit"))
+	if err != nil {
+		http.Error(w, "invalid limit", http.StatusBadRequest)
+		return
+	}
+	offset, err := intParam(q.Get("offset"))
+	if err != nil {
+		http.Error(w, "invalid offset", http.StatusBadRequest)
+		return
+	}
+
+	// Rarity is relative to the whole collection, so every token is
+	// scored even when only one is asked for.
+	scores, err := cache.scores(r.Context(), coll, method)
+	if err != nil {
+		logger.Error("Error fetching metadata", "error", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if cid := q.Get("cid"); cid != "" {
+		for _, s := range scores {
+			if s.Cid == cid {
+				w.Header().Set("Content-Type", "application/json")
+				json.NewEncoder(w).Encode(s)
+				return
+			}
+		}
+		http.Error(w, "no such token", http.StatusNotFound)
+		return
+	}
+
+	resp := rarityResponse{Method: method, Total: len(scores), Limit: limit, Offset: offset, Results: []traits.Score{}}
+	if offset < len(scores) {
+		end := len(scores)
+		if limit > 0 && offset+limit < end {
+			end = offset + limit
+		}
+		resp.Results = scores[offset:end]
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
@@ -0,0 +1,155 @@
+// Package arweave resolves ar:// URIs to gateway URLs. A URI names a
+// transaction, optionally followed by a path inside a path manifest, e.g.
+// ar://<manifest tx>/42.json. Manifests are fetched once and cached, since
+// every token of a collection usually shares one.
+package arweave
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+	"sync"
+)
+
+// DefaultGateway is the public Arweave gateway.
+const DefaultGateway = "https://arweave.net"
+
+// manifestType is the "manifest" field of a path manifest.
+const manifestType = "arweave/paths"
+
+// ErrPathNotFound is returned for a path that isn't in a manifest.
+var ErrPathNotFound = errors.New("path not found in manifest")
+
+// Manifest is an Arweave path manifest, mapping paths to transactions.
+type Manifest struct {
+	Manifest string `json:"manifest"`
+	Version  string `json:"version"`
+	Index    *struct {
+		Path string `json:"path"`
+	} `json:"index,omitempty"`
+	Paths map[string]struct {
+		ID string `json:"id"`
+	} `json:"paths"`
+}
+
+// ParseManifest decodes a path manifest.
+func ParseManifest(b []byte) (*Manifest, error) {
+	var m Manifest
+	if err := json.Unmarshal(b, &m); err != nil {
+		return nil, fmt.Errorf("error decoding manifest: %w", err)
+	}
+	if m.Manifest != manifestType {
+		return nil, fmt.Errorf("not a path manifest: manifest is %q", m.Manifest)
+	}
+	return &m, nil
+}
+
+// Resolve returns the transaction ID of path. An empty path resolves to
+// the index, if the manifest has one.
+func (m *Manifest) Resolve(path string) (string, error) {
+	path = strings.Trim(path, "/")
+	if path == "" {
+		if m.Index == nil {
+			return "", fmt.Errorf("%w: manifest has no index", ErrPathNotFound)
+		}
+		path = m.Index.Path
+	}
+	if p, ok := m.Paths[path]; ok && p.ID != "" {
+		return p.ID, nil
+	}
+	if unescaped, err := url.PathUnescape(path); err == nil {
+		if p, ok := m.Paths[unescaped]; ok && p.ID != "" {
+			return p.ID, nil
+		}
+	}
+	return "", fmt.Errorf("%w: %s", ErrPathNotFound, path)
+}
+
+// ValidTxID reports whether s is a transaction ID: 43 characters of
+// unpadded base64url.
+func ValidTxID(s string) bool {
+	if len(s) != 43 {
+		return false
+	}
+	return strings.IndexFunc(s, func(r rune) bool {
+		return !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '-' || r == '_')
+	}) < 0
+}
+
+// Resolver turns ar:// paths into gateway URLs.
+type Resolver struct {
+	// Gateway is the gateway base URL, e.g. DefaultGateway.
+	Gateway string
+	// Fetch downloads a URL. The scraper passes its own so that manifest
+	// requests share its rate limits.
+	Fetch func(ctx context.Context, url string) ([]byte, error)
+
+	mu        sync.Mutex
+	manifests map[string]*manifestEntry
+}
+
+type manifestEntry struct {
+	ready    chan struct{}
+	manifest *Manifest
+	err      error
+}
+
+// URL returns the gateway URL of path, the part of an ar:// URI after the
+// scheme. A path inside a manifest is resolved to its own transaction.
+func (r *Resolver) URL(ctx context.Context, path string) (string, error) {
+	tx, sub, _ := strings.Cut(strings.TrimPrefix(path, "/"), "/")
+	if !ValidTxID(tx) {
+		return "", fmt.Errorf("invalid Arweave transaction ID %q", tx)
+	}
+	if sub = strings.Trim(sub, "/"); sub != "" {
+		m, err := r.manifest(ctx, tx)
+		if err != nil {
+			return "", err
+		}
+		if tx, err = m.Resolve(sub); err != nil {
+			return "", fmt.Errorf("error resolving ar://%s: %w", path, err)
+		}
+	}
+	return strings.TrimRight(r.Gateway, "/") + "/" + tx, nil
+}
+
+// manifest returns the manifest in tx, fetching it unless another caller
+// already has. Failures aren't cached.
+func (r *Resolver) manifest(ctx context.Context, tx string) (*Manifest, error) {
+	r.mu.Lock()
+	if r.manifests == nil {
+		r.manifests = map[string]*manifestEntry{}
+	}
+	e, ok := r.manifests[tx]
+	if !ok {
+		e = &manifestEntry{ready: make(chan struct{})}
+		r.manifests[tx] = e
+	}
+	r.mu.Unlock()
+
+	if ok {
+		select {
+		case <-e.ready:
+			return e.manifest, e.err
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+
+	// The raw endpoint serves the manifest itself rather than its index.
+	body, err := r.Fetch(ctx, strings.TrimRight(r.Gateway, "/")+"/raw/"+tx)
+	if err == nil {
+		e.manifest, err = ParseManifest(body)
+	}
+	if err != nil {
+		e.err = fmt.Errorf("error loading manifest %s: %w", tx, err)
+		r.mu.Lock()
+		delete(r.manifests, tx)
+		r.mu.Unlock()
+	}
+	close(e.ready)
+	return e.manifest, e.err
+}
@@ -0,0 +1,85 @@
+package arweave
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+)
+
+const (
+	manifestTx = "bNbA3TEQVL60xlgCcqdz4ZPHFZ711cZ3hmkpGttDt_U"
+	tokenTx    = "Kbbs0tVUBVrqVdB7MBJdNc6ZvTjdjUSWq33mXnzlpkA"
+)
+
+var manifest = []byte(`{
+  "manifest": "arweave/paths",
+  "version": "0.1.0",
+  "index": {"path": "0.json"},
+  "paths": {
+    "0.json": {"id": "` + tokenTx + `"},
+    "my token.json": {"id": "` + tokenTx + `"}
+  }
+}`)
+
+func TestResolverURL(t *testing.T) {
+	var fetches atomic.Int32
+	r := &Resolver{
+		Gateway: "https://arweave.example/",
+		Fetch: func(ctx context.Context, url string) ([]byte, error) {
+			fetches.Add(1)
+			if url != "https://arweave.example/raw/"+manifestTx {
+				t.Errorf("fetched %s", url)
+			}
+			return manifest, nil
+		},
+	}
+	ctx := context.Background()
+
+	tests := map[string]string{
+		tokenTx:                         "https://arweave.example/" + tokenTx,
+		manifestTx + "/0.json":          "https://arweave.example/" + tokenTx,
+		manifestTx + "/my%20token.json": "https://arweave.example/" + tokenTx,
+		"/" + manifestTx + "/0.json/":   "https://arweave.example/" + tokenTx,
+	}
+	for path, want := range tests {
+		got, err := r.URL(ctx, path)
+		if err != nil || got != want {
+			t.Errorf("URL(%q) = %q, %v; want %q", path, got, err, want)
+		}
+	}
+	if n := fetches.Load(); n != 1 {
+		t.Errorf("manifest fetched %d times, want 1", n)
+	}
+
+	if _, err := r.URL(ctx, manifestTx+"/missing.json"); !errors.Is(err, ErrPathNotFound) {
+		t.Errorf("missing path: got %v, want ErrPathNotFound", err)
+	}
+	if _, err := r.URL(ctx, "not-a-tx/0.json"); err == nil {
+		t.Error("expected an error for an invalid transaction ID")
+	}
+}
+
+func TestManifestErrorsNotCached(t *testing.T) {
+	fail := true
+	r := &Resolver{
+		Gateway: DefaultGateway,
+		Fetch: func(ctx context.Context, url string) ([]byte, error) {
+			if fail {
+				return nil, errors.New("gateway down")
+			}
+			return manifest, nil
+		},
+	}
+	if _, err := r.URL(context.Background(), manifestTx+"/0.json"); err == nil {
+		t.Fatal("expected an error")
+	}
+	fail = false
+	if _, err := r.URL(context.Background(), manifestTx+"/0.json"); err != nil {
+		t.Errorf("retry after failure: %v", err)
+	}
+
+	if _, err := ParseManifest([]byte(`{"name": "not a manifest"}`)); err == nil {
+		t.Error("expected an error for a document that isn't a manifest")
+	}
+}
@@ -0,0 +1,213 @@
+// Package assets archives the images and animations that token metadata
+// points at. Asset bytes are kept in a content-addressed blob directory and
+// what was found about each one, including whether it could be fetched at
+// all, is recorded in the assets table.
+package assets
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"image"
+	// Decoders for image.DecodeConfig.
+	_ "image/gif"
+	_ "image/jpeg"
+	_ "image/png"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Fields of Metadata that reference assets.
+const (
+	FieldImage        = "image"
+	FieldAnimationURL = "animation_url"
+)
+
+// Asset statuses.
+const (
+	StatusOK = "ok"
+	// StatusBroken is an asset whose URI can't be resolved or whose bytes
+	// aren't what they claim to be, such as an image that doesn't decode.
+	StatusBroken = "broken"
+	// StatusUnreachable is an asset that couldn't be fetched.
+	StatusUnreachable = "unreachable"
+	// StatusUnstored is an asset that was fetched but couldn't be written
+	// to the blob directory.
+	StatusUnstored = "unstored"
+	// StatusUnsupported is an asset that isn't a PNG, JPEG or GIF image,
+	// such as a video, an SVG or a web page. Its bytes are archived but
+	// never served, since they could carry script.
+	StatusUnsupported = "unsupported"
+)
+
+// ErrNotFound is returned by Get for an asset that hasn't been archived.
+var ErrNotFound = errors.New("asset not found")
+
+// Asset is one asset reference of a document.
+type Asset struct {
+	Cid         string    `json:"cid"`
+	Field       string    `json:"field"`
+	URI         string    `json:"uri"`
+	Status      string    `json:"status"`
+	ContentType string    `json:"content_type,omitempty"`
+	Size        int64     `json:"size"`
+	Hash        string    `json:"sha256,omitempty"`
+	Width       int       `json:"width,omitempty"`
+	Height      int       `json:"height,omitempty"`
+	Error       string    `json:"error,omitempty"`
+	FetchedAt   time.Time `json:"fetched_at"`
+}
+
+// Servable reports whether assets of contentType may be served: PNG, JPEG
+// and GIF images, the only types that can't carry script.
+func Servable(contentType string) bool {
+	switch contentType {
+	case "image/png", "image/jpeg", "image/gif":
+		return true
+	}
+	return false
+}
+
+// Inspect fills in what can be learnt from an asset's bytes. An image that
+// can't be decoded marks the asset broken, and anything but a PNG, JPEG or
+// GIF image marks it unsupported.
+func (a *Asset) Inspect(data []byte) {
+	sum := sha256.Sum256(data)
+	a.Hash = hex.EncodeToString(sum[:])
+	a.Size = int64(len(data))
+	a.ContentType = http.DetectContentType(data)
+	a.Status = StatusOK
+	if len(data) == 0 {
+		a.Status, a.Error = StatusBroken, "empty body"
+		return
+	}
+	if !Servable(a.ContentType) {
+		a.Status, a.Error = StatusUnsupported, "unsupported content type "+a.ContentType
+		return
+	}
+	cfg, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		a.Status, a.Error = StatusBroken, fmt.Sprintf("error decoding image: %v", err)
+		return
+	}
+	a.Width, a.Height = cfg.Width, cfg.Height
+}
+
+// Blobs is a directory of asset bytes named by their SHA-256 hash, fanned
+// out as <dir>/<first 2 hex digits>/<hash>.
+type Blobs struct {
+	Dir string
+}
+
+// Path returns where the blob with hash is stored.
+func (b *Blobs) Path(hash string) string {
+	return filepath.Join(b.Dir, hash[:2], hash)
+}
+
+// Put stores data under hash, its SHA-256. Existing blobs are left alone.
+func (b *Blobs) Put(hash string, data []byte) error {
+	path := b.Path(hash)
+	if _, err := os.Stat(path); err == nil {
+		return nil
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return fmt.Errorf("error creating blob directory: %w", err)
+	}
+	// Write to a temporary file first so a crash never leaves a partial
+	// blob under its final name.
+	tmp, err := os.CreateTemp(filepath.Dir(path), hash+".tmp*")
+	if err != nil {
+		return fmt.Errorf("error creating blob: %w", err)
+	}
+	_, err = tmp.Write(data)
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), path)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return fmt.Errorf("error writing blob %s: %w", hash, err)
+	}
+	return nil
+}
+
+// ValidHash reports whether s is a hex SHA-256 hash, and so safe to use in
+// a blob path.
+func ValidHash(s string) bool {
+	if len(s) != 64 {
+		return false
+	}
+	_, err := hex.DecodeString(s)
+	return err == nil && strings.ToLower(s) == s
+}
+
+func CreateTable(db *sql.DB) error {
+	_, err := db.Exec(`
+        CREATE TABLE IF NOT EXISTS assets (
+            cid TEXT NOT NULL,
+            field TEXT NOT NULL,
+            uri TEXT NOT NULL,
+            status TEXT NOT NULL,
+            content_type TEXT NOT NULL DEFAULT '',
+            size BIGINT NOT NULL DEFAULT 0,
+            sha256 TEXT NOT NULL DEFAULT '',
+            width INT NOT NULL DEFAULT 0,
+            height INT NOT NULL DEFAULT 0,
+            error TEXT NOT NULL DEFAULT '',
+            fetched_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+            PRIMARY KEY (cid, field)
+        );
+        CREATE INDEX IF NOT EXISTS assets_status_idx ON assets (status)
+    `)
+	if err != nil {
+		return fmt.Errorf("error creating assets table: %w", err)
+	}
+	return nil
+}
+
+// Save records a.
+func Save(ctx context.Context, db *sql.DB, a *Asset) error {
+	_, err := db.ExecContext(ctx, `
+        INSERT INTO assets (cid, field, uri, status, content_type, size, sha256, width, height, error, fetched_at)
+        VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, now())
+        ON CONFLICT (cid, field) DO UPDATE SET
+        uri = EXCLUDED.uri,
+        status = EXCLUDED.status,
+        content_type = EXCLUDED.content_type,
+        size = EXCLUDED.size,
+        sha256 = EXCLUDED.sha256,
+        width = EXCLUDED.width,
+        height = EXCLUDED.height,
+        error = EXCLUDED.error,
+        fetched_at = EXCLUDED.fetched_at`,
+		a.Cid, a.Field, a.URI, a.Status, a.ContentType, a.Size, a.Hash, a.Width, a.Height, a.Error)
+	if err != nil {
+		return fmt.Errorf("error saving %s asset of CID %s: %w", a.Field, a.Cid, err)
+	}
+	return nil
+}
+
+// Get returns the asset in field of document cid, or ErrNotFound.
+func Get(ctx context.Context, db *sql.DB, cid, field string) (*Asset, error) {
+	var a Asset
+	err := db.QueryRowContext(ctx, `
+        SELECT cid, field, uri, status, content_type, size, sha256, width, height, error, fetched_at
+        FROM assets WHERE cid = $1 AND field = $2`, cid, field).
+		Scan(&a.Cid, &a.Field, &a.URI, &a.Status, &a.ContentType, &a.Size, &a.Hash, &a.Width, &a.Height, &a.Error, &a.FetchedAt)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, fmt.Errorf("%w: %s of %s", ErrNotFound, field, cid)
+		}
+		return nil, fmt.Errorf("error loading asset: %w", err)
+	}
+	return &a, nil
+}
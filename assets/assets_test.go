@@ -0,0 +1,120 @@
+package assets
+
+import (
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"image"
+	"image/color"
+	"image/gif"
+	"image/png"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestInspect(t *testing.T) {
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, image.NewRGBA(image.Rect(0, 0, 3, 2))); err != nil {
+		t.Fatal(err)
+	}
+
+	var a Asset
+	a.Inspect(buf.Bytes())
+	if a.Status != StatusOK || a.ContentType != "image/png" || a.Width != 3 || a.Height != 2 || a.Size != int64(buf.Len()) || !ValidHash(a.Hash) {
+		t.Errorf("png: %+v", a)
+	}
+
+	var broken Asset
+	broken.Inspect(buf.Bytes()[:20])
+	if broken.Status != StatusBroken || broken.Error == "" {
+		t.Errorf("truncated png: %+v", broken)
+	}
+
+	var empty Asset
+	empty.Inspect(nil)
+	if empty.Status != StatusBroken {
+		t.Errorf("empty: %+v", empty)
+	}
+
+	var text Asset
+	text.Inspect([]byte("<svg xmlns='http://www.w3.org/2000/svg'/>"))
+	if text.Status != StatusUnsupported || text.Width != 0 || !ValidHash(text.Hash) {
+		t.Errorf("svg: %+v", text)
+	}
+}
+
+func TestBlobs(t *testing.T) {
+	b := &Blobs{Dir: t.TempDir()}
+	var a Asset
+	a.Inspect([]byte("hello"))
+	for i := 0; i < 2; i++ {
+		if err := b.Put(a.Hash, []byte("hello")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	data, err := os.ReadFile(b.Path(a.Hash))
+	if err != nil || string(data) != "hello" {
+		t.Errorf("read back %q, %v", data, err)
+	}
+	if ValidHash("../../etc/passwd") || ValidHash(a.Hash[:10]) {
+		t.Error("ValidHash accepted an invalid hash")
+	}
+}
+
+func TestThumbnail(t *testing.T) {
+	src := image.NewRGBA(image.Rect(0, 0, 400, 100))
+	for x := 0; x < 400; x++ {
+		for y := 0; y < 100; y++ {
+			src.Set(x, y, color.RGBA{255, 0, 0, 255})
+		}
+	}
+	var buf bytes.Buffer
+	if err := gif.Encode(&buf, src, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	thumb, contentType, err := Thumbnail(buf.Bytes(), 64)
+	if err != nil {
+		t.Fatal(err)
+	}
+	img, err := png.Decode(bytes.NewReader(thumb))
+	if err != nil || contentType != "image/png" {
+		t.Fatalf("thumbnail of a gif should be a png: %s, %v", contentType, err)
+	}
+	if b := img.Bounds(); b.Dx() != 64 || b.Dy() != 16 {
+		t.Errorf("size = %v, want 64x16", b)
+	}
+	if r, g, _, _ := img.At(10, 10).RGBA(); r>>8 != 255 || g != 0 {
+		t.Errorf("colour = %v", img.At(10, 10))
+	}
+
+	// Small images aren't enlarged.
+	thumb, _, err = Thumbnail(buf.Bytes(), 512)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg, _ := png.DecodeConfig(bytes.NewReader(thumb)); cfg.Width != 400 {
+		t.Errorf("width = %d, want 400", cfg.Width)
+	}
+
+	if _, _, err := Thumbnail([]byte("not an image"), 64); err == nil {
+		t.Error("expected an error for a non-image")
+	}
+}
+
+func TestThumbnailTooLarge(t *testing.T) {
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, image.NewGray(image.Rect(0, 0, 1, 1))); err != nil {
+		t.Fatal(err)
+	}
+	// Claim 10000x10000 in the header, fixing up its checksum.
+	data := buf.Bytes()
+	binary.BigEndian.PutUint32(data[16:], 10000)
+	binary.BigEndian.PutUint32(data[20:], 10000)
+	binary.BigEndian.PutUint32(data[29:], crc32.ChecksumIEEE(data[12:29]))
+
+	if _, _, err := Thumbnail(data, 64); err == nil || !strings.Contains(err.Error(), "more than") {
+		t.Errorf("err = %v, want too many pixels", err)
+	}
+}
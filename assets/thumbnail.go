@@ -0,0 +1,106 @@
+package assets
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"path/filepath"
+	"strconv"
+)
+
+// ThumbnailSizes are the sizes, in pixels along the longer side, that
+// thumbnails are made in. Allowing only a few keeps the cache small.
+var ThumbnailSizes = []int{64, 128, 256, 512}
+
+// ValidThumbnailSize reports whether size is one of ThumbnailSizes.
+func ValidThumbnailSize(size int) bool {
+	for _, s := range ThumbnailSizes {
+		if s == size {
+			return true
+		}
+	}
+	return false
+}
+
+// MaxThumbnailPixels is the largest image, in pixels, that thumbnails are
+// made of. Decoding takes memory in proportion to the pixel count rather
+// than the file size, which a small file can claim to be huge.
+const MaxThumbnailPixels = 40_000_000
+
+// Thumbnails returns the blob directory that thumbnails of size are cached
+// in, under the same hashes as the originals.
+func (b *Blobs) Thumbnails(size int) *Blobs {
+	return &Blobs{Dir: filepath.Join(b.Dir, "thumbs", strconv.Itoa(size))}
+}
+
+// Thumbnail scales a PNG, JPEG or GIF image to fit in size x size and
+// returns it with its content type. JPEGs stay JPEGs; everything else
+// becomes a PNG, and of an animated GIF only the first frame is kept.
+// Images that already fit are re-encoded but not enlarged, and images of
+// more than MaxThumbnailPixels are refused before they are decoded.
+func Thumbnail(data []byte, size int) ([]byte, string, error) {
+	cfg, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return nil, "", fmt.Errorf("error decoding image: %w", err)
+	}
+	if pixels := int64(cfg.Width) * int64(cfg.Height); pixels > MaxThumbnailPixels {
+		return nil, "", fmt.Errorf("image is %dx%d, more than %d pixels", cfg.Width, cfg.Height, MaxThumbnailPixels)
+	}
+	img, format, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, "", fmt.Errorf("error decoding image: %w", err)
+	}
+	thumb := scale(img, size)
+
+	var buf bytes.Buffer
+	if format == "jpeg" {
+		err = jpeg.Encode(&buf, thumb, &jpeg.Options{Quality: 85})
+	} else {
+		err = png.Encode(&buf, thumb)
+	}
+	if err != nil {
+		return nil, "", fmt.Errorf("error encoding thumbnail: %w", err)
+	}
+	if format == "jpeg" {
+		return buf.Bytes(), "image/jpeg", nil
+	}
+	return buf.Bytes(), "image/png", nil
+}
+
+// scale shrinks img to fit in size x size, averaging the source pixels
+// that fall in each destination pixel.
+func scale(img image.Image, size int) *image.RGBA64 {
+	b := img.Bounds()
+	w, h := b.Dx(), b.Dy()
+	dw, dh := w, h
+	if w > size || h > size {
+		if w >= h {
+			dw, dh = size, max(1, h*size/w)
+		} else {
+			dw, dh = max(1, w*size/h), size
+		}
+	}
+
+	dst := image.NewRGBA64(image.Rect(0, 0, dw, dh))
+	for y := 0; y < dh; y++ {
+		y0, y1 := b.Min.Y+y*h/dh, b.Min.Y+max((y+1)*h/dh, y*h/dh+1)
+		for x := 0; x < dw; x++ {
+			x0, x1 := b.Min.X+x*w/dw, b.Min.X+max((x+1)*w/dw, x*w/dw+1)
+			// RGBA returns alpha-premultiplied values, which is what
+			// averaging needs and what RGBA64 stores.
+			var r, g, bl, a, n uint64
+			for sy := y0; sy < y1; sy++ {
+				for sx := x0; sx < x1; sx++ {
+					cr, cg, cb, ca := img.At(sx, sy).RGBA()
+					r, g, bl, a = r+uint64(cr), g+uint64(cg), bl+uint64(cb), a+uint64(ca)
+					n++
+				}
+			}
+			dst.SetRGBA64(x, y, color.RGBA64{uint16(r / n), uint16(g / n), uint16(bl / n), uint16(a / n)})
+		}
+	}
+	return dst
+}
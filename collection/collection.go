@@ -0,0 +1,268 @@
+package collection
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// ErrNotFound is returned for a collection ID that isn't registered.
+var ErrNotFound = errors.New("collection not found")
+
+// Collection is an NFT project whose tokens are scraped together.
+type Collection struct {
+	ID       string `json:"id"`
+	Name     string `json:"name"`
+	Chain    string `json:"chain,omitempty"`
+	Contract string `json:"contract_address,omitempty"`
+	// BaseURI is where token metadata lives, e.g. ipfs://<dir CID>/. A
+	// "{id}" placeholder is replaced by the token ID; otherwise the ID is
+	// appended.
+	BaseURI string `json:"base_uri,omitempty"`
+	// Schema is the JSON Schema its documents are validated against: a
+	// built-in name such as erc721, or the schema document. Empty means
+	// the default schema.
+	Schema string `json:"schema,omitempty"`
+	// Mapping is the mapping document that says where its documents keep
+	// the metadata fields, if they don't follow the standard layout.
+	Mapping string `json:"mapping,omitempty"`
+	// FirstToken and LastToken bound the token IDs, inclusive. Both are
+	// zero when the range is unknown.
+	FirstToken int64     `json:"first_token_id"`
+	LastToken  int64     `json:"last_token_id"`
+	Tokens     int       `json:"tokens"`
+	CreatedAt  time.Time `json:"created_at"`
+}
+
+// HasRange reports whether the token range is known.
+func (c *Collection) HasRange() bool {
+	return c.FirstToken != 0 || c.LastToken != 0
+}
+
+// TokenCID returns the IPFS path of a token's metadata under BaseURI, e.g.
+// "<dir CID>/42", or "" if BaseURI isn't an ipfs:// URI.
+func (c *Collection) TokenCID(tokenID string) string {
+	path, ok := strings.CutPrefix(c.BaseURI, "ipfs://")
+	if !ok || path == "" {
+		return ""
+	}
+	path = strings.TrimPrefix(path, "ipfs/")
+	if strings.Contains(path, "{id}") {
+		return strings.ReplaceAll(path, "{id}", tokenID)
+	}
+	return strings.TrimSuffix(path, "/") + "/" + tokenID
+}
+
+// Validate checks the fields that can't be checked by the database.
+func (c *Collection) Validate() error {
+	if c.ID == "" {
+		return errors.New("collection ID is required")
+	}
+	if strings.Contains(c.ID, "/") {
+		return fmt.Errorf("invalid collection ID %q: must not contain /", c.ID)
+	}
+	if c.FirstToken < 0 || c.LastToken < c.FirstToken {
+		return fmt.Errorf("invalid token range %d-%d", c.FirstToken, c.LastToken)
+	}
+	if c.HasRange() && c.TokenCID("0") == "" {
+		return fmt.Errorf("a token range needs an ipfs:// base URI, got %q", c.BaseURI)
+	}
+	return nil
+}
+
+func CreateTables(db *sql.DB) error {
+	_, err := db.Exec(`
+        CREATE TABLE IF NOT EXISTS collections (
+            id TEXT PRIMARY KEY,
+            name TEXT NOT NULL DEFAULT '',
+            chain TEXT NOT NULL DEFAULT '',
+            contract_address TEXT NOT NULL DEFAULT '',
+            base_uri TEXT NOT NULL DEFAULT '',
+            first_token_id BIGINT NOT NULL DEFAULT 0,
+            last_token_id BIGINT NOT NULL DEFAULT 0,
+            schema TEXT NOT NULL DEFAULT '',
+            mapping TEXT NOT NULL DEFAULT '',
+            created_at TIMESTAMPTZ NOT NULL DEFAULT now()
+        );
+        CREATE TABLE IF NOT EXISTS collection_tokens (
+            collection_id TEXT NOT NULL REFERENCES collections (id) ON DELETE CASCADE,
+            token_id TEXT NOT NULL,
+            cid TEXT NOT NULL,
+            PRIMARY KEY (collection_id, token_id)
+        );
+        CREATE INDEX IF NOT EXISTS collection_tokens_cid_idx ON collection_tokens (cid)
+    `)
+	if err != nil {
+		return fmt.Errorf("error creating collection tables: %w", err)
+	}
+	return nil
+}
+
+// Save creates or updates c. If c has a token range, every token in it is
+// linked to its CID under the base URI.
+func Save(ctx context.Context, db *sql.DB, c *Collection) error {
+	if err := c.Validate(); err != nil {
+		return err
+	}
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("error starting transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	_, err = tx.ExecContext(ctx, `
+        INSERT INTO collections (id, name, chain, contract_address, base_uri, first_token_id, last_token_id, schema, mapping)
+        VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)
+        ON CONFLICT (id) DO UPDATE SET
+        name = EXCLUDED.name,
+        chain = EXCLUDED.chain,
+        contract_address = EXCLUDED.contract_address,
+        base_uri = EXCLUDED.base_uri,
+        first_token_id = EXCLUDED.first_token_id,
+        last_token_id = EXCLUDED.last_token_id,
+        schema = EXCLUDED.schema,
+        mapping = EXCLUDED.mapping`,
+		c.ID, c.Name, c.Chain, strings.ToLower(c.Contract), c.BaseURI, c.FirstToken, c.LastToken, c.Schema, c.Mapping)
+	if err != nil {
+		return fmt.Errorf("error saving collection: %w", err)
+	}
+
+	if c.HasRange() {
+		var tokens, cids []string
+		for id := c.FirstToken; id <= c.LastToken; id++ {
+			token := strconv.FormatInt(id, 10)
+			tokens = append(tokens, token)
+			cids = append(cids, c.TokenCID(token))
+		}
+		_, err = tx.ExecContext(ctx, `
+            INSERT INTO collection_tokens (collection_id, token_id, cid)
+            SELECT $1, t.token_id, t.cid FROM unnest($2::text[], $3::text[]) AS t (token_id, cid)
+            ON CONFLICT (collection_id, token_id) DO UPDATE SET cid = EXCLUDED.cid`,
+			c.ID, pq.Array(tokens), pq.Array(cids))
+		if err != nil {
+			return fmt.Errorf("error linking collection tokens: %w", err)
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("error committing collection: %w", err)
+	}
+	return nil
+}
+
+// Link records that tokenID of collection id has its metadata at cid.
+func Link(ctx context.Context, db *sql.DB, id, tokenID, cid string) error {
+	_, err := db.ExecContext(ctx, `
+        INSERT INTO collection_tokens (collection_id, token_id, cid)
+        VALUES ($1, $2, $3)
+        ON CONFLICT (collection_id, token_id) DO UPDATE SET cid = EXCLUDED.cid`,
+		id, tokenID, cid)
+	if err != nil {
+		var pqErr *pq.Error
+		if errors.As(err, &pqErr) && pqErr.Code == "23503" { // foreign_key_violation
+			return fmt.Errorf("%w: %s", ErrNotFound, id)
+		}
+		return fmt.Errorf("error linking token %s of collection %s: %w", tokenID, id, err)
+	}
+	return nil
+}
+
+const selectCollections = `
+    SELECT c.id, c.name, c.chain, c.contract_address, c.base_uri, c.first_token_id, c.last_token_id, c.schema, c.mapping, c.created_at,
+        (SELECT count(*) FROM collection_tokens t WHERE t.collection_id = c.id)
+    FROM collections c`
+
+func scan(s interface{ Scan(...any) error }) (*Collection, error) {
+	var c Collection
+	err := s.Scan(&c.ID, &c.Name, &c.Chain, &c.Contract, &c.BaseURI, &c.FirstToken, &c.LastToken, &c.Schema, &c.Mapping, &c.CreatedAt, &c.Tokens)
+	if err != nil {
+		return nil, err
+	}
+	return &c, nil
+}
+
+// Get returns collection id, or ErrNotFound.
+func Get(ctx context.Context, db *sql.DB, id string) (*Collection, error) {
+	c, err := scan(db.QueryRowContext(ctx, selectCollections+" WHERE c.id = $1", id))
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, fmt.Errorf("%w: %s", ErrNotFound, id)
+		}
+		return nil, fmt.Errorf("error loading collection: %w", err)
+	}
+	return c, nil
+}
+
+// List returns every collection ordered by ID.
+func List(ctx context.Context, db *sql.DB) ([]Collection, error) {
+	rows, err := db.QueryContext(ctx, selectCollections+" ORDER BY c.id")
+	if err != nil {
+		return nil, fmt.Errorf("error querying collections: %w", err)
+	}
+	defer rows.Close()
+
+	collections := []Collection{}
+	for rows.Next() {
+		c, err := scan(rows)
+		if err != nil {
+			return nil, fmt.Errorf("error scanning row: %w", err)
+		}
+		collections = append(collections, *c)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error reading rows: %w", err)
+	}
+	return collections, nil
+}
+
+// CIDs returns the CIDs of every token linked to collection id.
+func CIDs(ctx context.Context, db *sql.DB, id string) ([]string, error) {
+	rows, err := db.QueryContext(ctx, `
+        SELECT cid FROM collection_tokens WHERE collection_id = $1
+        ORDER BY length(token_id), token_id`, id)
+	if err != nil {
+		return nil, fmt.Errorf("error querying collection tokens: %w", err)
+	}
+	defer rows.Close()
+
+	var cids []string
+	for rows.Next() {
+		var cid string
+		if err := rows.Scan(&cid); err != nil {
+			return nil, fmt.Errorf("error scanning row: %w", err)
+		}
+		cids = append(cids, cid)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error reading rows: %w", err)
+	}
+	return cids, nil
+}
+
+// Of returns the IDs of the collections cid is linked to, in order.
+func Of(ctx context.Context, db *sql.DB, cid string) ([]string, error) {
+	rows, err := db.QueryContext(ctx, `SELECT DISTINCT collection_id FROM collection_tokens WHERE cid = $1 ORDER BY collection_id`, cid)
+	if err != nil {
+		return nil, fmt.Errorf("error looking up collections of CID %s: %w", cid, err)
+	}
+	defer rows.Close()
+
+	var ids []string
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			return nil, fmt.Errorf("error scanning row: %w", err)
+		}
+		ids = append(ids, id)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error reading rows: %w", err)
+	}
+	return ids, nil
+}
@@ -0,0 +1,48 @@
+package collection
+
+import "testing"
+
+func TestTokenCID(t *testing.T) {
+	tests := []struct {
+		baseURI string
+		want    string
+	}{
+		{"ipfs://bafydir/", "bafydir/42"},
+		{"ipfs://bafydir", "bafydir/42"},
+		{"ipfs://ipfs/bafydir/", "bafydir/42"},
+		{"ipfs://bafydir/{id}.json", "bafydir/42.json"},
+		{"https://example.com/meta/", ""},
+		{"", ""},
+	}
+	for _, tt := range tests {
+		c := Collection{BaseURI: tt.baseURI}
+		if got := c.TokenCID("42"); got != tt.want {
+			t.Errorf("TokenCID with base %q = %q, want %q", tt.baseURI, got, tt.want)
+		}
+	}
+}
+
+func TestValidate(t *testing.T) {
+	valid := []Collection{
+		{ID: "apes"},
+		{ID: "apes", BaseURI: "https://example.com/"},
+		{ID: "apes", BaseURI: "ipfs://bafydir/", FirstToken: 0, LastToken: 9999},
+	}
+	for _, c := range valid {
+		if err := c.Validate(); err != nil {
+			t.Errorf("%+v: %v", c, err)
+		}
+	}
+
+	invalid := []Collection{
+		{},
+		{ID: "a/b"},
+		{ID: "apes", BaseURI: "ipfs://bafydir/", FirstToken: 10, LastToken: 5},
+		{ID: "apes", BaseURI: "https://example.com/", FirstToken: 1, LastToken: 5},
+	}
+	for _, c := range invalid {
+		if err := c.Validate(); err == nil {
+			t.Errorf("%+v: expected an error", c)
+		}
+	}
+}
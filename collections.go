@@ -0,0 +1,106 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"text/tabwriter"
+
+	"github.com/coffeendude/ipfs-cids-go-scraper/collection"
+	"github.com/coffeendude/ipfs-cids-go-scraper/mapping"
+	"github.com/coffeendude/ipfs-cids-go-scraper/schema"
+)
+
+// runCollections implements the collections subcommand: "collections add"
+// registers or updates a collection, and "collections list" prints them.
+func runCollections(args []string) error {
+	if len(args) == 0 || (args[0] != "add" && args[0] != "list") {
+		fmt.Fprintln(os.Stderr, "usage: collections add|list [flags]")
+		os.Exit(2)
+	}
+	cmd := args[0]
+
+	fs := flag.NewFlagSet("collections "+cmd, flag.ExitOnError)
+	var dbc dbConfig
+	var lc logConfig
+	dbc.register(fs)
+	lc.register(fs)
+	var c collection.Collection
+	if cmd == "add" {
+		fs.StringVar(&c.ID, "id", "", "Collection ID, used in API paths")
+		fs.StringVar(&c.Name, "name", "", "Display name")
+		fs.StringVar(&c.Chain, "chain", "", "Chain the contract is deployed on, e.g. ethereum")
+		fs.StringVar(&c.Contract, "contract", "", "Contract address")
+		fs.StringVar(&c.BaseURI, "base-uri", "", "Token metadata base URI, e.g. ipfs://<dir CID>/")
+		fs.Int64Var(&c.FirstToken, "first-token", 0, "First token ID")
+		fs.Int64Var(&c.LastToken, "last-token", 0, "Last token ID (inclusive); with -first-token, links every token to its CID under -base-uri")
+		fs.StringVar(&c.Schema, "schema", "", "JSON Schema to validate the collection's documents against: erc721, erc1155 or a schema file, whose contents are stored with the collection (default: the validate -schema)")
+		fs.StringVar(&c.Mapping, "mapping", "", "Mapping file saying where the collection's documents keep name, image and the other fields; its contents are stored with the collection")
+	}
+	fs.Parse(args[1:])
+
+	lc.setup()
+	if cmd == "add" && c.ID == "" {
+		return fail("Error reading flags", errors.New("-id is required"))
+	}
+	// Schema and mapping files are stored by their contents, so that every
+	// replica and later run uses the same ones wherever it runs.
+	if c.Schema != "" {
+		if _, err := schema.Load(c.Schema); err != nil {
+			return fail("Error reading flags", err)
+		}
+		if !schema.IsBuiltin(c.Schema) {
+			data, err := os.ReadFile(c.Schema)
+			if err != nil {
+				return fail("Error reading flags", err)
+			}
+			c.Schema = string(data)
+		}
+	}
+	if c.Mapping != "" {
+		if _, err := mapping.Load(c.Mapping); err != nil {
+			return fail("Error reading flags", err)
+		}
+		data, err := os.ReadFile(c.Mapping)
+		if err != nil {
+			return fail("Error reading flags", err)
+		}
+		c.Mapping = string(data)
+	}
+
+	db, err := dbc.connect()
+	if err != nil {
+		return fail("Error connecting to database", err)
+	}
+	defer db.Close()
+	if err := collection.CreateTables(db); err != nil {
+		return fail("Error creating collection tables", err)
+	}
+
+	ctx := context.Background()
+	var collections []collection.Collection
+	if cmd == "add" {
+		if err := collection.Save(ctx, db, &c); err != nil {
+			return fail("Error saving collection", err)
+		}
+		saved, err := collection.Get(ctx, db, c.ID)
+		if err != nil {
+			return fail("Error loading collection", err)
+		}
+		collections = append(collections, *saved)
+	} else if collections, err = collection.List(ctx, db); err != nil {
+		return fail("Error listing collections", err)
+	}
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "ID\tName\tChain\tContract\tTokens\tBase URI")
+	for _, c := range collections {
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%d\t%s\n", c.ID, c.Name, c.Chain, c.Contract, c.Tokens, c.BaseURI)
+	}
+	if err := tw.Flush(); err != nil {
+		return fail("Error printing collections", err)
+	}
+	return nil
+}
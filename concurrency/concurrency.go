@@ -0,0 +1,258 @@
+package concurrency
+
+import (
+	"context"
+	"log/slog"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/coffeendude/ipfs-cids-go-scraper/logging"
+)
+
+const (
+	// overloadFactor is applied to a gateway's limit when it answers with
+	// 429, a 5xx or not at all.
+	overloadFactor = 0.5
+	// slowFactor is applied when a request takes longer than the latency
+	// target.
+	slowFactor = 0.9
+)
+
+// Outcome describes one finished request and is fed back into the group.
+type Outcome struct {
+	Latency time.Duration
+	Status  int // HTTP status, 0 if no response was received
+	// NoResponse is set when the gateway didn't answer at all: a timeout
+	// or a refused or reset connection. A zero Status without it, such as
+	// a request the caller cancelled, says nothing about the gateway and
+	// leaves its limit alone.
+	NoResponse bool
+}
+
+func (o Outcome) overloaded() bool {
+	return o.NoResponse || o.Status == 429 || o.Status >= 500
+}
+
+// ignored reports whether o carries no signal about the gateway.
+func (o Outcome) ignored() bool {
+	return o.Status == 0 && !o.NoResponse
+}
+
+// Gateway is an IPFS gateway along with its current concurrency limit.
+type Gateway struct {
+	URL  string
+	Host string
+
+	limit        float64
+	inflight     int
+	congested    bool
+	lastDecrease time.Time
+}
+
+// Group hands out request slots across a set of gateways, and for other
+// hosts by name. Each gateway or host has its own AIMD limit: it grows by
+// one slot per round trip while requests are fast and successful, and is
+// cut multiplicatively when the server slows down or starts rejecting
+// requests.
+type Group struct {
+	mu       sync.Mutex
+	wake     chan struct{}
+	gateways []*Gateway
+	// hosts are servers requested directly rather than as gateways, such
+	// as those serving HTTP token URIs. They get limits of their own but
+	// are never handed out by Acquire.
+	hosts    map[string]*Gateway
+	min, max float64
+	target   time.Duration
+}
+
+// NewGroup creates a group for gateways, each bounded to [min, max]
+// concurrent requests. target is the latency above which a gateway is
+// treated as saturated.
+func NewGroup(gateways []string, min, max int, target time.Duration) *Group {
+	if min < 1 {
+		min = 1
+	}
+	if max < min {
+		max = min
+	}
+
+	g := &Group{
+		wake:   make(chan struct{}),
+		hosts:  map[string]*Gateway{},
+		min:    float64(min),
+		max:    float64(max),
+		target: target,
+	}
+	for _, raw := range gateways {
+		host := raw
+		if u, err := url.Parse(raw); err == nil && u.Host != "" {
+			host = u.Host
+		}
+		g.gateways = append(g.gateways, &Gateway{URL: raw, Host: host, limit: float64(min)})
+	}
+	return g
+}
+
+// MaxConcurrency is the most requests the group will ever allow at once.
+func (g *Group) MaxConcurrency() int {
+	return int(g.max) * len(g.gateways)
+}
+
+// Acquire blocks until a gateway has a free slot and returns it. The
+// gateway with the most headroom is preferred. Every successful Acquire
+// must be paired with a Release or Cancel.
+func (g *Group) Acquire(ctx context.Context) (*Gateway, error) {
+	for {
+		g.mu.Lock()
+		var best *Gateway
+		bestRoom := 0
+		for _, gw := range g.gateways {
+			if room := int(gw.limit) - gw.inflight; room > bestRoom {
+				best, bestRoom = gw, room
+			}
+		}
+		if best != nil {
+			best.inflight++
+			g.mu.Unlock()
+			return best, nil
+		}
+		wake := g.wake
+		g.mu.Unlock()
+
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-wake:
+		}
+	}
+}
+
+// AcquireHost blocks until host has a free slot and returns it, so that
+// requests to a server other than the gateways are limited the same way.
+// The result is paired with Release or Cancel like that of Acquire.
+func (g *Group) AcquireHost(ctx context.Context, host string) (*Gateway, error) {
+	for {
+		g.mu.Lock()
+		h, ok := g.hosts[host]
+		if !ok {
+			h = &Gateway{Host: host, limit: g.min}
+			g.hosts[host] = h
+		}
+		if h.inflight < int(h.limit) {
+			h.inflight++
+			g.mu.Unlock()
+			return h, nil
+		}
+		wake := g.wake
+		g.mu.Unlock()
+
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-wake:
+		}
+	}
+}
+
+// Release returns gw's slot and adjusts its limit based on o.
+func (g *Group) Release(gw *Gateway, o Outcome) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	gw.inflight--
+	before := int(gw.limit)
+	now := time.Now()
+
+	switch {
+	case o.ignored():
+	case o.overloaded():
+		g.decrease(gw, overloadFactor, now)
+	case g.target > 0 && o.Latency > g.target:
+		g.decrease(gw, slowFactor, now)
+	case gw.congested:
+		gw.limit += 1 / gw.limit
+	default:
+		// Slow start: grow by one per success until the first sign of
+		// trouble, which doubles the limit every round trip.
+		gw.limit++
+	}
+	if gw.limit > g.max {
+		gw.limit = g.max
+	}
+
+	if after := int(gw.limit); after != before {
+		slog.Info("Gateway concurrency changed",
+			logging.Gateway, gw.Host,
+			"from", before,
+			"to", after,
+			logging.Status, o.Status,
+			logging.Duration, o.Latency)
+	}
+
+	close(g.wake)
+	g.wake = make(chan struct{})
+}
+
+// Cancel returns gw's slot without adjusting its limit, for requests that
+// were never sent.
+func (g *Group) Cancel(gw *Gateway) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	gw.inflight--
+	close(g.wake)
+	g.wake = make(chan struct{})
+}
+
+// decrease cuts gw's limit by factor. Requests that were already in flight
+// when the gateway got into trouble will report the same problem, so the
+// limit is cut at most once per latency target.
+func (g *Group) decrease(gw *Gateway, factor float64, now time.Time) {
+	gw.congested = true
+	if now.Sub(gw.lastDecrease) < g.target {
+		return
+	}
+	gw.lastDecrease = now
+	gw.limit *= factor
+	if gw.limit < g.min {
+		gw.limit = g.min
+	}
+}
+
+// Limit reports gw's current concurrency limit.
+func (g *Group) Limit(gw *Gateway) int {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return int(gw.limit)
+}
+
+// Limits reports the current concurrency limit of every gateway, keyed by
+// host.
+func (g *Group) Limits() map[string]int {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	limits := make(map[string]int, len(g.gateways))
+	for _, gw := range g.gateways {
+		limits[gw.Host] = int(gw.limit)
+	}
+	return limits
+}
+
+// Inflight reports how many requests are currently running across all
+// gateways and hosts.
+func (g *Group) Inflight() int {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	n := 0
+	for _, gw := range g.gateways {
+		n += gw.inflight
+	}
+	for _, h := range g.hosts {
+		n += h.inflight
+	}
+	return n
+}
@@ -0,0 +1,117 @@
+package concurrency
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestGroupAIMD(t *testing.T) {
+	g := NewGroup([]string{"https://ipfs.io"}, 1, 8, time.Second)
+	ctx := context.Background()
+
+	// Slow start doubles the limit while every request succeeds quickly.
+	for i := 0; i < 3; i++ {
+		gw, err := g.Acquire(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		g.Release(gw, Outcome{Latency: 10 * time.Millisecond, Status: 200})
+	}
+	if got := g.Limits()["ipfs.io"]; got != 4 {
+		t.Fatalf("limit after slow start = %d, want 4", got)
+	}
+
+	gw, _ := g.Acquire(ctx)
+	g.Release(gw, Outcome{Latency: 10 * time.Millisecond, Status: 429})
+	if got := g.Limits()["ipfs.io"]; got != 2 {
+		t.Fatalf("limit after 429 = %d, want 2", got)
+	}
+
+	// A second failure inside the same window must not cut the limit again.
+	gw, _ = g.Acquire(ctx)
+	g.Release(gw, Outcome{Latency: 10 * time.Millisecond, Status: 503})
+	if got := g.Limits()["ipfs.io"]; got != 2 {
+		t.Fatalf("limit after repeated failure = %d, want 2", got)
+	}
+}
+
+func TestGroupIgnoresCancelled(t *testing.T) {
+	g := NewGroup([]string{"https://ipfs.io"}, 1, 8, time.Second)
+	ctx := context.Background()
+	for i := 0; i < 2; i++ {
+		gw, _ := g.Acquire(ctx)
+		g.Release(gw, Outcome{Latency: 10 * time.Millisecond, Status: 200})
+	}
+
+	gw, _ := g.Acquire(ctx)
+	g.Release(gw, Outcome{Latency: 10 * time.Millisecond})
+	if got := g.Limits()["ipfs.io"]; got != 3 {
+		t.Fatalf("limit after a cancelled request = %d, want 3", got)
+	}
+
+	gw, _ = g.Acquire(ctx)
+	g.Release(gw, Outcome{Latency: 10 * time.Millisecond, NoResponse: true})
+	if got := g.Limits()["ipfs.io"]; got != 1 {
+		t.Fatalf("limit after a timeout = %d, want 1", got)
+	}
+}
+
+func TestGroupBounds(t *testing.T) {
+	g := NewGroup([]string{"https://ipfs.io"}, 2, 3, time.Second)
+	ctx := context.Background()
+
+	for i := 0; i < 10; i++ {
+		gw, _ := g.Acquire(ctx)
+		g.Release(gw, Outcome{Latency: time.Millisecond, Status: 200})
+	}
+	if got := g.Limits()["ipfs.io"]; got != 3 {
+		t.Fatalf("limit = %d, want max 3", got)
+	}
+
+	var held []*Gateway
+	for i := 0; i < 3; i++ {
+		gw, _ := g.Acquire(ctx)
+		held = append(held, gw)
+	}
+	ctx, cancel := context.WithTimeout(ctx, 20*time.Millisecond)
+	defer cancel()
+	if _, err := g.Acquire(ctx); err == nil {
+		t.Fatal("Acquire beyond the limit should block until the context ends")
+	}
+	for _, gw := range held {
+		g.Release(gw, Outcome{Latency: time.Millisecond, Status: 200})
+	}
+}
+
+func TestGroupHosts(t *testing.T) {
+	g := NewGroup([]string{"https://ipfs.io"}, 1, 8, time.Second)
+	ctx := context.Background()
+
+	h, err := g.AcquireHost(ctx, "example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The host's single slot is taken; the gateway's is not.
+	short, cancel := context.WithTimeout(ctx, 10*time.Millisecond)
+	defer cancel()
+	if _, err := g.AcquireHost(short, "example.com"); err == nil {
+		t.Fatal("AcquireHost past the host's limit succeeded")
+	}
+	gw, err := g.Acquire(ctx)
+	if err != nil || gw.Host != "ipfs.io" {
+		t.Fatalf("Acquire = %v, %v, want the gateway", gw, err)
+	}
+	if got := g.Inflight(); got != 2 {
+		t.Errorf("Inflight = %d, want 2", got)
+	}
+
+	g.Release(h, Outcome{Latency: 10 * time.Millisecond, Status: 200})
+	if got := g.Limit(h); got != 2 {
+		t.Errorf("host limit after success = %d, want 2", got)
+	}
+	if _, ok := g.Limits()["example.com"]; ok {
+		t.Error("Limits lists a host as a gateway")
+	}
+	g.Release(gw, Outcome{Status: 200})
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+
+	"github.com/coffeendude/ipfs-cids-go-scraper/collection"
+	"github.com/coffeendude/ipfs-cids-go-scraper/export"
+	"github.com/coffeendude/ipfs-cids-go-scraper/schema"
+)
+
+// runExport implements the export subcommand, which writes the metadata
+// table to a file or stdout as CSV, JSONL or Parquet.
+func runExport(args []string) error {
+	fs := flag.NewFlagSet("export", flag.ExitOnError)
+	var dbc dbConfig
+	var lc logConfig
+	dbc.register(fs)
+	lc.register(fs)
+	format := fs.String("format", export.FormatCSV, "Output format: csv, jsonl or parquet")
+	out := fs.String("out", "-", "File to write to, or - for stdout")
+	cids := fs.String("cids", "", "Comma-separated CIDs to export (default all)")
+	name := fs.String("name", "", "Only export rows whose name contains this text")
+	coll := fs.String("collection", "", "Only export tokens of this collection, ordered by token ID")
+	invalid := fs.Bool("invalid", false, "Only export documents that failed schema validation")
+	limit := fs.Int("limit", 0, "Maximum number of rows to export (0 for no limit)")
+	fs.Parse(args)
+
+	lc.setup()
+	if err := export.CheckFormat(*format); err != nil {
+		return fail("Error exporting metadata", err)
+	}
+
+	db, err := dbc.connect()
+	if err != nil {
+		return fail("Error connecting to database", err)
+	}
+	defer db.Close()
+
+	if err := ensureMetadataTable(db); err != nil {
+		return fail("Error creating metadata table", err)
+	}
+	if err := collection.CreateTables(db); err != nil {
+		return fail("Error creating collection tables", err)
+	}
+	if err := schema.CreateTable(db); err != nil {
+		return fail("Error creating validations table", err)
+	}
+
+	var w io.Writer = os.Stdout
+	var f *os.File
+	if *out != "-" {
+		f, err = os.Create(*out)
+		if err != nil {
+			return fail("Error creating export file", err)
+		}
+		w = f
+	}
+
+	filter := export.Filter{
+		Collection:   *coll,
+		CIDs:         splitList(*cids),
+		NameContains: *name,
+		Invalid:      *invalid,
+		Limit:        *limit,
+	}
+	n, err := export.Export(context.Background(), db, w, *format, filter, nil)
+	if f != nil {
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+		// A partial file would look like a complete export.
+		if err != nil {
+			os.Remove(*out)
+		}
+	}
+	if err != nil {
+		return fail("Error exporting metadata", err)
+	}
+	slog.Info("Exported metadata", "rows", n, "format", *format, "out", *out)
+	return nil
+}
+
+// splitList splits a comma-separated flag value, dropping empty entries.
+func splitList(s string) []string {
+	var items []string
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
@@ -0,0 +1,392 @@
+package export
+
+import (
+	"bufio"
+	"context"
+	"database/sql"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+
+	"github.com/coffeendude/ipfs-cids-go-scraper/metadata"
+	"github.com/coffeendude/ipfs-cids-go-scraper/tracing"
+	"github.com/coffeendude/ipfs-cids-go-scraper/traits"
+	"github.com/lib/pq"
+	"github.com/parquet-go/parquet-go"
+)
+
+const (
+	FormatCSV     = "csv"
+	FormatJSONL   = "jsonl"
+	FormatParquet = "parquet"
+
+	// parquetRowGroupSize bounds how many rows are buffered in memory
+	// before a parquet row group is written out.
+	parquetRowGroupSize = 10000
+
+	flushEvery = 1000
+)
+
+// Columns is the column order used by the CSV export, the columns of the
+// metadata table, and accepted as a header by the importer. Attributes and
+// linked CIDs are written as JSON arrays.
+var Columns = strings.Split(metadata.Columns, ", ")
+
+// Writer writes metadata rows in one export format. Close must be called
+// to flush buffered rows and any trailer the format needs.
+type Writer interface {
+	Write(m *metadata.Metadata) error
+	// Flush writes out buffered rows where the format allows it.
+	Flush() error
+	Close() error
+}
+
+// CheckFormat returns an error if format is not one NewWriter knows.
+func CheckFormat(format string) error {
+	switch format {
+	case FormatCSV, FormatJSONL, FormatParquet:
+		return nil
+	}
+	return fmt.Errorf("unknown export format %q: want csv, jsonl or parquet", format)
+}
+
+// NewWriter returns a Writer for format that writes to w.
+func NewWriter(format string, w io.Writer) (Writer, error) {
+	switch format {
+	case FormatCSV:
+		cw := csv.NewWriter(w)
+		if err := cw.Write(Columns); err != nil {
+			return nil, fmt.Errorf("error writing CSV header: %w", err)
+		}
+		return &csvWriter{w: cw}, nil
+	case FormatJSONL:
+		bw := bufio.NewWriter(w)
+		return &jsonlWriter{w: bw, enc: json.NewEncoder(bw)}, nil
+	case FormatParquet:
+		return &parquetWriter{w: parquet.NewGenericWriter[parquetRow](w)}, nil
+	}
+	return nil, CheckFormat(format)
+}
+
+// ContentType is the MIME type served for format.
+func ContentType(format string) string {
+	switch format {
+	case FormatCSV:
+		return "text/csv"
+	case FormatJSONL:
+		return "application/x-ndjson"
+	case FormatParquet:
+		return "application/vnd.apache.parquet"
+	}
+	return "application/octet-stream"
+}
+
+type csvWriter struct {
+	w *csv.Writer
+}
+
+func (c *csvWriter) Write(m *metadata.Metadata) error {
+	row := make([]string, len(Columns))
+	for i, col := range Columns {
+		row[i] = column(m, col)
+	}
+	return c.w.Write(row)
+}
+
+// column returns the value of m's column col as exported.
+func column(m *metadata.Metadata, col string) string {
+	switch col {
+	case "cid":
+		return m.Cid
+	case "image":
+		return m.Image
+	case "description":
+		return m.Description
+	case "name":
+		return m.Name
+	case "attributes":
+		return string(m.AttributesJSON())
+	case "token_uri":
+		return m.TokenURI
+	case "source_scheme":
+		return m.SourceScheme
+	case "source_network":
+		return m.SourceNetwork
+	case "animation_url":
+		return m.AnimationURL
+	case "media_type":
+		return m.MediaType
+	case "linked_cids":
+		return string(m.LinksJSON())
+	}
+	return ""
+}
+
+func (c *csvWriter) Flush() error {
+	c.w.Flush()
+	return c.w.Error()
+}
+
+func (c *csvWriter) Close() error {
+	return c.Flush()
+}
+
+type jsonlWriter struct {
+	w   *bufio.Writer
+	enc *json.Encoder
+}
+
+// jsonlRow is a row as exported to JSONL: the metadata along with the raw
+// document it was parsed from, so that an import can restore it.
+type jsonlRow struct {
+	*metadata.Metadata
+	Raw json.RawMessage `json:"raw,omitempty"`
+}
+
+func (j *jsonlWriter) Write(m *metadata.Metadata) error {
+	return j.enc.Encode(jsonlRow{m, m.Raw})
+}
+
+func (j *jsonlWriter) Flush() error {
+	return j.w.Flush()
+}
+
+func (j *jsonlWriter) Close() error {
+	return j.w.Flush()
+}
+
+type parquetRow struct {
+	Cid           string `parquet:"cid"`
+	Name          string `parquet:"name"`
+	Description   string `parquet:"description"`
+	Image         string `parquet:"image"`
+	Attributes    string `parquet:"attributes"`
+	TokenURI      string `parquet:"token_uri"`
+	SourceScheme  string `parquet:"source_scheme"`
+	SourceNetwork string `parquet:"source_network"`
+	AnimationURL  string `parquet:"animation_url"`
+	MediaType     string `parquet:"media_type"`
+	LinkedCIDs    string `parquet:"linked_cids"`
+}
+
+type parquetWriter struct {
+	w       *parquet.GenericWriter[parquetRow]
+	pending int
+}
+
+func (p *parquetWriter) Write(m *metadata.Metadata) error {
+	row := parquetRow{
+		Cid:           m.Cid,
+		Name:          m.Name,
+		Description:   m.Description,
+		Image:         m.Image,
+		Attributes:    string(m.AttributesJSON()),
+		TokenURI:      m.TokenURI,
+		SourceScheme:  m.SourceScheme,
+		SourceNetwork: m.SourceNetwork,
+		AnimationURL:  m.AnimationURL,
+		MediaType:     m.MediaType,
+		LinkedCIDs:    string(m.LinksJSON()),
+	}
+	if _, err := p.w.Write([]parquetRow{row}); err != nil {
+		return err
+	}
+	if p.pending++; p.pending >= parquetRowGroupSize {
+		p.pending = 0
+		return p.w.Flush()
+	}
+	return nil
+}
+
+// Flush is a no-op: parquet rows can only be written out a whole row group
+// at a time, which Write already does every parquetRowGroupSize rows.
+func (p *parquetWriter) Flush() error {
+	return nil
+}
+
+func (p *parquetWriter) Close() error {
+	return p.w.Close()
+}
+
+// Filter narrows the rows exported. Zero values match everything.
+type Filter struct {
+	// Collection restricts the export to the tokens linked to this
+	// collection, and fills in their collection and token ID.
+	Collection string
+	// TokenID picks a single token of Collection.
+	TokenID string
+	// CIDs restricts the export to these CIDs.
+	CIDs []string
+	// NameContains matches names containing this text, ignoring case.
+	NameContains string
+	// Traits keeps rows that have, for every trait type given, one of the
+	// listed values. The value traits.None matches rows without the trait.
+	Traits map[string][]string
+	// Invalid keeps only documents that failed schema validation.
+	Invalid bool
+	// WithRaw also loads the raw document of each row.
+	WithRaw bool
+	// Limit caps the number of rows; 0 means no limit.
+	Limit int
+	// Offset skips this many rows first.
+	Offset int
+}
+
+// likeEscaper escapes the LIKE wildcards in text matched literally.
+var likeEscaper = strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`)
+
+// query builds the SELECT for f. Rows are ordered by CID, or by token ID
+// within a collection.
+func (f Filter) query() (string, []any) {
+	var where []string
+	var args []any
+	cols := metadata.QualifiedColumns("m") + ", NULL"
+	if f.WithRaw {
+		cols = metadata.QualifiedColumns("m") + ", m.raw"
+	}
+	q := "SELECT " + cols + ", NULL, NULL FROM metadata m"
+	order := "m.cid"
+	if f.Collection != "" {
+		args = append(args, f.Collection)
+		q = "SELECT " + cols + ", t.collection_id, t.token_id FROM metadata m" +
+			" JOIN collection_tokens t ON t.cid = m.cid AND t.collection_id = $1"
+		order = "length(t.token_id), t.token_id"
+		if f.TokenID != "" {
+			args = append(args, f.TokenID)
+			where = append(where, fmt.Sprintf("t.token_id = $%d", len(args)))
+		}
+	}
+	if len(f.CIDs) > 0 {
+		var ph []string
+		for _, cid := range f.CIDs {
+			args = append(args, cid)
+			ph = append(ph, fmt.Sprintf("$%d", len(args)))
+		}
+		where = append(where, "m.cid IN ("+strings.Join(ph, ", ")+")")
+	}
+	if f.NameContains != "" {
+		args = append(args, "%"+likeEscaper.Replace(f.NameContains)+"%")
+		where = append(where, fmt.Sprintf(`m.name ILIKE $%d ESCAPE '\'`, len(args)))
+	}
+
+	if f.Invalid {
+		where = append(where, "EXISTS (SELECT 1 FROM validations v WHERE v.cid = m.cid AND NOT v.valid)")
+	}
+
+	names := make([]string, 0, len(f.Traits))
+	for name := range f.Traits {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		var values []string
+		none := false
+		for _, v := range f.Traits[name] {
+			if v == traits.None {
+				none = true
+			} else {
+				values = append(values, v)
+			}
+		}
+		args = append(args, name)
+		trait := len(args)
+		var clauses []string
+		if len(values) > 0 {
+			args = append(args, pq.Array(values))
+			clauses = append(clauses, fmt.Sprintf(
+				"EXISTS (SELECT 1 FROM jsonb_array_elements(m.attributes) a WHERE a->>'trait_type' = $%d AND a->>'value' = ANY($%d))",
+				trait, len(args)))
+		}
+		if none {
+			clauses = append(clauses, fmt.Sprintf(
+				"NOT EXISTS (SELECT 1 FROM jsonb_array_elements(m.attributes) a WHERE a->>'trait_type' = $%d)", trait))
+		}
+		where = append(where, "("+strings.Join(clauses, " OR ")+")")
+	}
+
+	if len(where) > 0 {
+		q += " WHERE " + strings.Join(where, " AND ")
+	}
+	q += " ORDER BY " + order
+	if f.Limit > 0 {
+		args = append(args, f.Limit)
+		q += fmt.Sprintf(" LIMIT $%d", len(args))
+	}
+	if f.Offset > 0 {
+		args = append(args, f.Offset)
+		q += fmt.Sprintf(" OFFSET $%d", len(args))
+	}
+	return q, args
+}
+
+// Each calls fn for every metadata row matching f, one row at a time, so
+// tables larger than memory can be exported.
+func Each(ctx context.Context, db *sql.DB, f Filter, fn func(*metadata.Metadata) error) (err error) {
+	ctx, span := tracing.Start(ctx, "db.select metadata", tracing.DBAttributes("SELECT", "metadata")...)
+	defer func() { tracing.End(span, err) }()
+
+	q, args := f.query()
+	rows, err := db.QueryContext(ctx, q, args...)
+	if err != nil {
+		return fmt.Errorf("error querying metadata: %w", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var raw []byte
+		var collection, tokenID sql.NullString
+		m, err := metadata.Scan(rows, &raw, &collection, &tokenID)
+		if err != nil {
+			return fmt.Errorf("error scanning row: %w", err)
+		}
+		m.Raw, m.Collection, m.TokenID = raw, collection.String, tokenID.String
+		if err := fn(m); err != nil {
+			return err
+		}
+	}
+
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("error reading rows: %w", err)
+	}
+	return nil
+}
+
+// Export streams the rows matching f to w in format and returns how many
+// were written. Buffered rows are flushed every flushEvery rows and flush,
+// if not nil, is then called so HTTP clients receive data as it is read.
+func Export(ctx context.Context, db *sql.DB, w io.Writer, format string, f Filter, flush func()) (int, error) {
+	ew, err := NewWriter(format, w)
+	if err != nil {
+		return 0, err
+	}
+	// Only JSONL has room for the raw document.
+	f.WithRaw = format == FormatJSONL
+
+	n := 0
+	err = Each(ctx, db, f, func(m *metadata.Metadata) error {
+		if err := ew.Write(m); err != nil {
+			return fmt.Errorf("error writing %s row: %w", format, err)
+		}
+		n++
+		if n%flushEvery == 0 {
+			if err := ew.Flush(); err != nil {
+				return fmt.Errorf("error writing %s rows: %w", format, err)
+			}
+			if flush != nil {
+				flush()
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return n, err
+	}
+
+	if err := ew.Close(); err != nil {
+		return n, fmt.Errorf("error finishing %s export: %w", format, err)
+	}
+	return n, nil
+}
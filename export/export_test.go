@@ -0,0 +1,226 @@
+package export
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/coffeendude/ipfs-cids-go-scraper/metadata"
+	"github.com/lib/pq"
+	"github.com/parquet-go/parquet-go"
+)
+
+var rows = []metadata.Metadata{
+	{Cid: "QmA", Name: "One", Description: "has, a comma", Image: "ipfs://img1",
+		Attributes: metadata.Attributes{{TraitType: "Eyes", Value: "Laser"}, {TraitType: "Level", Value: float64(3)}},
+		Raw:        json.RawMessage(`{"name":"One"}`)},
+	{Cid: "QmB", Name: "Two", Description: "line\nbreak", Image: "ipfs://img2", AnimationURL: "ipfs://anim",
+		TokenURI: "ipfs://QmB", SourceScheme: "ipfs", SourceNetwork: "ipfs", MediaType: "application/vnd.ipld.dag-json",
+		Links: []metadata.Link{{Path: "image", Cid: "QmImg"}}},
+}
+
+func write(t *testing.T, format string) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	w, err := NewWriter(format, &buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := range rows {
+		if err := w.Write(&rows[i]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestCSV(t *testing.T) {
+	got := string(write(t, FormatCSV))
+	want := "cid,image,description,name,attributes,token_uri,source_scheme,source_network,animation_url,media_type,linked_cids\n" +
+		"QmA,ipfs://img1,\"has, a comma\",One,\"[{\"\"trait_type\"\":\"\"Eyes\"\",\"\"value\"\":\"\"Laser\"\"},{\"\"trait_type\"\":\"\"Level\"\",\"\"value\"\":3}]\",,,,,,\n" +
+		"QmB,ipfs://img2,\"line\nbreak\",Two,[],ipfs://QmB,ipfs,ipfs,ipfs://anim,application/vnd.ipld.dag-json,\"[{\"\"path\"\":\"\"image\"\",\"\"cid\"\":\"\"QmImg\"\"}]\"\n"
+	if got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestJSONL(t *testing.T) {
+	got := string(write(t, FormatJSONL))
+	want := `{"cid":"QmA","image":"ipfs://img1","description":"has, a comma","name":"One",` +
+		`"attributes":[{"trait_type":"Eyes","value":"Laser"},{"trait_type":"Level","value":3}],"raw":{"name":"One"}}` + "\n" +
+		`{"cid":"QmB","image":"ipfs://img2","description":"line\nbreak","name":"Two","animation_url":"ipfs://anim",` +
+		`"token_uri":"ipfs://QmB","source_scheme":"ipfs","source_network":"ipfs","media_type":"application/vnd.ipld.dag-json",` +
+		`"linked_cids":[{"path":"image","cid":"QmImg"}]}` + "\n"
+	if got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestParquet(t *testing.T) {
+	b := write(t, FormatParquet)
+	got, err := parquet.Read[parquetRow](bytes.NewReader(b), int64(len(b)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != len(rows) || got[1].Cid != "QmB" || got[1].Description != "line\nbreak" ||
+		got[0].Attributes != `[{"trait_type":"Eyes","value":"Laser"},{"trait_type":"Level","value":3}]` ||
+		got[1].MediaType != "application/vnd.ipld.dag-json" || got[1].LinkedCIDs != `[{"path":"image","cid":"QmImg"}]` {
+		t.Errorf("got %+v", got)
+	}
+}
+
+func TestUnknownFormat(t *testing.T) {
+	if _, err := NewWriter("xml", &bytes.Buffer{}); err == nil {
+		t.Error("expected an error for an unknown format")
+	}
+	if err := CheckFormat("xml"); err == nil {
+		t.Error("CheckFormat accepted xml")
+	}
+}
+
+func TestFilterQuery(t *testing.T) {
+	const cols = "SELECT m.cid, m.image, m.description, m.name, m.attributes, m.token_uri, m.source_scheme, m.source_network, m.animation_url, m.media_type, m.linked_cids, "
+
+	q, args := Filter{CIDs: []string{"QmA", "QmB"}, NameContains: "ape", Limit: 5, Offset: 10}.query()
+	wantQ := cols + "NULL, NULL, NULL FROM metadata m WHERE m.cid IN ($1, $2) AND m.name ILIKE $3 ESCAPE '\\' ORDER BY m.cid LIMIT $4 OFFSET $5"
+	if q != wantQ {
+		t.Errorf("query = %q, want %q", q, wantQ)
+	}
+	if want := []any{"QmA", "QmB", "%ape%", 5, 10}; !reflect.DeepEqual(args, want) {
+		t.Errorf("args = %v, want %v", args, want)
+	}
+
+	q, args = Filter{Traits: map[string][]string{"Hat": {"Cap", "(none)"}, "Eyes": {"Laser"}}}.query()
+	wantQ = cols + "NULL, NULL, NULL FROM metadata m WHERE " +
+		"(EXISTS (SELECT 1 FROM jsonb_array_elements(m.attributes) a WHERE a->>'trait_type' = $1 AND a->>'value' = ANY($2))) AND " +
+		"(EXISTS (SELECT 1 FROM jsonb_array_elements(m.attributes) a WHERE a->>'trait_type' = $3 AND a->>'value' = ANY($4)) OR " +
+		"NOT EXISTS (SELECT 1 FROM jsonb_array_elements(m.attributes) a WHERE a->>'trait_type' = $3)) ORDER BY m.cid"
+	if q != wantQ {
+		t.Errorf("query = %q, want %q", q, wantQ)
+	}
+	if want := []any{"Eyes", pq.Array([]string{"Laser"}), "Hat", pq.Array([]string{"Cap"})}; !reflect.DeepEqual(args, want) {
+		t.Errorf("args = %v, want %v", args, want)
+	}
+
+	q, args = Filter{Collection: "apes", NameContains: "x"}.query()
+	wantQ = cols + "NULL, t.collection_id, t.token_id FROM metadata m JOIN collection_tokens t ON t.cid = m.cid AND t.collection_id = $1 " +
+		"WHERE m.name ILIKE $2 ESCAPE '\\' ORDER BY length(t.token_id), t.token_id"
+	if q != wantQ || !reflect.DeepEqual(args, []any{"apes", "%x%"}) {
+		t.Errorf("collection: %q %v", q, args)
+	}
+
+	q, args = Filter{NameContains: "x", Invalid: true}.query()
+	wantQ = cols + "NULL, NULL, NULL FROM metadata m WHERE m.name ILIKE $1 ESCAPE '\\' AND " +
+		"EXISTS (SELECT 1 FROM validations v WHERE v.cid = m.cid AND NOT v.valid) ORDER BY m.cid"
+	if q != wantQ || !reflect.DeepEqual(args, []any{"%x%"}) {
+		t.Errorf("invalid: %q %v", q, args)
+	}
+
+	_, args = Filter{NameContains: `50%_off\`}.query()
+	if want := []any{`%50\%\_off\\%`}; !reflect.DeepEqual(args, want) {
+		t.Errorf("escaped name: args = %v, want %v", args, want)
+	}
+
+	q, args = Filter{}.query()
+	if q != cols+"NULL, NULL, NULL FROM metadata m ORDER BY m.cid" || len(args) != 0 {
+		t.Errorf("empty filter: %q %v", q, args)
+	}
+
+	q, _ = Filter{WithRaw: true}.query()
+	if q != cols+"m.raw, NULL, NULL FROM metadata m ORDER BY m.cid" {
+		t.Errorf("with raw: %q", q)
+	}
+}
+
+func readAll(t *testing.T, format, input string) []Record {
+	t.Helper()
+	r, err := NewReader(format, strings.NewReader(input))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var recs []Record
+	for {
+		rec, err := r.Read()
+		if err == io.EOF {
+			return recs
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		recs = append(recs, *rec)
+	}
+}
+
+func TestReadExports(t *testing.T) {
+	for _, format := range []string{FormatCSV, FormatJSONL} {
+		recs := readAll(t, format, string(write(t, format)))
+		if len(recs) != len(rows) {
+			t.Fatalf("%s: read %d records, want %d", format, len(recs), len(rows))
+		}
+		for i, rec := range recs {
+			var m metadata.Metadata
+			if err := json.Unmarshal(rec.Body, &m); err != nil {
+				t.Fatalf("%s: %v", format, err)
+			}
+			m.Cid, m.Raw = rec.Cid, rec.Raw
+			want := rows[i]
+			if format == FormatCSV {
+				// Only JSONL carries the raw document.
+				want.Raw = nil
+			}
+			if !reflect.DeepEqual(m, want) {
+				t.Errorf("%s: record %d = %+v, want %+v", format, i, m, want)
+			}
+			if rec.MediaType != want.MediaType || !reflect.DeepEqual(rec.Links, want.Links) {
+				t.Errorf("%s: record %d media type, links = %q, %v", format, i, rec.MediaType, rec.Links)
+			}
+		}
+	}
+}
+
+func TestReadCSVColumnOrder(t *testing.T) {
+	recs := readAll(t, FormatCSV, "Name,CID\nApe,QmA\n")
+	if len(recs) != 1 || recs[0].Cid != "QmA" || string(recs[0].Body) != `{"name":"Ape"}` {
+		t.Errorf("got %+v", recs)
+	}
+	if _, err := NewReader(FormatCSV, strings.NewReader("name,image\n")); err == nil {
+		t.Error("expected an error for a header without cid")
+	}
+}
+
+func TestReadRaw(t *testing.T) {
+	recs := readAll(t, FormatRaw, `{"QmA": {"name": "One", "attributes": []}, "QmB": "not metadata"}`)
+	if len(recs) != 2 || recs[0].Cid != "QmA" || recs[1].Cid != "QmB" {
+		t.Fatalf("got %+v", recs)
+	}
+	if string(recs[0].Body) != `{"name": "One", "attributes": []}` {
+		t.Errorf("body = %s", recs[0].Body)
+	}
+	if _, err := NewReader(FormatRaw, strings.NewReader(`[]`)); err == nil {
+		t.Error("expected an error for a JSON array")
+	}
+}
+
+func TestFormatFromPath(t *testing.T) {
+	for path, want := range map[string]string{
+		"out.csv":      FormatCSV,
+		"OUT.JSONL":    FormatJSONL,
+		"out.ndjson":   FormatJSONL,
+		"token-1.json": FormatRaw,
+	} {
+		if got, err := FormatFromPath(path); got != want || err != nil {
+			t.Errorf("FormatFromPath(%q) = %q, %v, want %q", path, got, err, want)
+		}
+	}
+	for _, path := range []string{"out.parquet", "out.txt", "out"} {
+		if got, err := FormatFromPath(path); err == nil {
+			t.Errorf("FormatFromPath(%q) = %q, want an error", path, got)
+		}
+	}
+}
@@ -0,0 +1,225 @@
+package export
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"path/filepath"
+	"strings"
+
+	"github.com/coffeendude/ipfs-cids-go-scraper/metadata"
+)
+
+// FormatRaw is a single JSON object mapping each CID to the metadata
+// document stored under it, as fetched from IPFS. It can be imported but
+// not exported.
+const FormatRaw = "json"
+
+// Record is one metadata document read from an import file.
+type Record struct {
+	Cid string
+	// Body is the document as JSON, to be parsed like a gateway response.
+	Body []byte
+	// Pos locates the record in the input for error messages, e.g. "line 3".
+	Pos string
+	// Raw, MediaType and Links are the raw document, media type and CID
+	// links of an exported row, which parsing Body can't recover.
+	Raw       json.RawMessage
+	MediaType string
+	Links     []metadata.Link
+}
+
+// Reader reads records from an import file. Read returns io.EOF once the
+// input is exhausted.
+type Reader interface {
+	Read() (*Record, error)
+}
+
+// NewReader returns a Reader for format that reads from r.
+func NewReader(format string, r io.Reader) (Reader, error) {
+	switch format {
+	case FormatCSV:
+		return newCSVReader(r)
+	case FormatJSONL:
+		return &jsonlReader{s: newLineScanner(r)}, nil
+	case FormatRaw:
+		return newRawReader(r)
+	}
+	return nil, fmt.Errorf("unknown import format %q: want csv, jsonl or json", format)
+}
+
+// FormatFromPath guesses the import format of a file from its extension.
+// Parquet exports cannot be imported.
+func FormatFromPath(path string) (string, error) {
+	switch ext := strings.ToLower(filepath.Ext(path)); ext {
+	case ".csv":
+		return FormatCSV, nil
+	case ".jsonl", ".ndjson":
+		return FormatJSONL, nil
+	case ".json":
+		return FormatRaw, nil
+	case ".parquet":
+		return "", fmt.Errorf("cannot import parquet file %s: export as csv or jsonl instead", path)
+	default:
+		return "", fmt.Errorf("cannot tell the format of %s from its extension %q: pass -format", path, ext)
+	}
+}
+
+type csvReader struct {
+	r       *csv.Reader
+	columns map[string]int
+	line    int
+}
+
+func newCSVReader(r io.Reader) (*csvReader, error) {
+	cr := csv.NewReader(r)
+	cr.FieldsPerRecord = -1
+	header, err := cr.Read()
+	if err != nil {
+		return nil, fmt.Errorf("error reading CSV header: %w", err)
+	}
+
+	columns := map[string]int{}
+	for i, name := range header {
+		columns[strings.ToLower(strings.TrimSpace(name))] = i
+	}
+	if _, ok := columns["cid"]; !ok {
+		return nil, fmt.Errorf("CSV header has no cid column: want %s", strings.Join(Columns, ","))
+	}
+	return &csvReader{r: cr, columns: columns, line: 1}, nil
+}
+
+func (c *csvReader) Read() (*Record, error) {
+	row, err := c.r.Read()
+	if err != nil {
+		if err == io.EOF {
+			return nil, io.EOF
+		}
+		return nil, fmt.Errorf("error reading CSV: %w", err)
+	}
+	c.line, _ = c.r.FieldPos(0)
+
+	field := func(name string) string {
+		if i, ok := c.columns[name]; ok && i < len(row) {
+			return row[i]
+		}
+		return ""
+	}
+	var body bytes.Buffer
+	body.WriteByte('{')
+	for _, name := range Columns[1:] {
+		if _, ok := c.columns[name]; !ok {
+			continue
+		}
+		value := field(name)
+		isJSON := name == "attributes" || name == "linked_cids"
+		if isJSON && strings.TrimSpace(value) == "" {
+			continue
+		}
+		if body.Len() > 1 {
+			body.WriteByte(',')
+		}
+		key, _ := json.Marshal(name)
+		body.Write(key)
+		body.WriteByte(':')
+		if isJSON {
+			// Already JSON. Invalid values are passed through as they are
+			// so the document fails validation like any other bad input.
+			body.WriteString(value)
+		} else {
+			v, _ := json.Marshal(value)
+			body.Write(v)
+		}
+	}
+	body.WriteByte('}')
+	rec := &Record{Cid: strings.TrimSpace(field("cid")), Body: body.Bytes(), Pos: fmt.Sprintf("line %d", c.line), MediaType: field("media_type")}
+	if links := field("linked_cids"); strings.TrimSpace(links) != "" {
+		// Invalid links leave the body invalid too, which reports them.
+		json.Unmarshal([]byte(links), &rec.Links)
+	}
+	return rec, nil
+}
+
+// newLineScanner scans lines of any length, since metadata documents can
+// be larger than bufio's default token size.
+func newLineScanner(r io.Reader) *bufio.Scanner {
+	s := bufio.NewScanner(r)
+	s.Buffer(make([]byte, 64*1024), 64*1024*1024)
+	return s
+}
+
+type jsonlReader struct {
+	s    *bufio.Scanner
+	line int
+}
+
+func (j *jsonlReader) Read() (*Record, error) {
+	for j.s.Scan() {
+		j.line++
+		line := bytes.TrimSpace(j.s.Bytes())
+		if len(line) == 0 {
+			continue
+		}
+		rec := &Record{Body: append([]byte(nil), line...), Pos: fmt.Sprintf("line %d", j.line)}
+		var key struct {
+			Cid       string          `json:"cid"`
+			Raw       json.RawMessage `json:"raw"`
+			MediaType string          `json:"media_type"`
+			Links     []metadata.Link `json:"linked_cids"`
+		}
+		// Invalid lines are passed on with no CID so the caller reports
+		// them alongside other invalid documents.
+		if json.Unmarshal(line, &key) == nil {
+			rec.Cid = strings.TrimSpace(key.Cid)
+			rec.MediaType, rec.Links = key.MediaType, key.Links
+			if !bytes.Equal(key.Raw, []byte("null")) {
+				rec.Raw = key.Raw
+			}
+		}
+		return rec, nil
+	}
+	if err := j.s.Err(); err != nil {
+		return nil, fmt.Errorf("error reading JSONL: %w", err)
+	}
+	return nil, io.EOF
+}
+
+// rawReader streams the entries of a {"<cid>": {...}, ...} object one at
+// a time.
+type rawReader struct {
+	dec  *json.Decoder
+	done bool
+}
+
+func newRawReader(r io.Reader) (*rawReader, error) {
+	dec := json.NewDecoder(r)
+	tok, err := dec.Token()
+	if err != nil {
+		return nil, fmt.Errorf("error reading JSON: %w", err)
+	}
+	if d, ok := tok.(json.Delim); !ok || d != '{' {
+		return nil, errors.New("error reading JSON: want an object keyed by CID")
+	}
+	return &rawReader{dec: dec}, nil
+}
+
+func (r *rawReader) Read() (*Record, error) {
+	if r.done || !r.dec.More() {
+		r.done = true
+		return nil, io.EOF
+	}
+	tok, err := r.dec.Token()
+	if err != nil {
+		return nil, fmt.Errorf("error reading JSON: %w", err)
+	}
+	cid, _ := tok.(string)
+	var body json.RawMessage
+	if err := r.dec.Decode(&body); err != nil {
+		return nil, fmt.Errorf("error reading JSON document for CID %s: %w", cid, err)
+	}
+	return &Record{Cid: strings.TrimSpace(cid), Body: body, Pos: "key " + cid}, nil
+}
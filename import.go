@@ -0,0 +1,373 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/coffeendude/ipfs-cids-go-scraper/collection"
+	"github.com/coffeendude/ipfs-cids-go-scraper/export"
+	"github.com/coffeendude/ipfs-cids-go-scraper/logging"
+	"github.com/coffeendude/ipfs-cids-go-scraper/mapping"
+	"github.com/coffeendude/ipfs-cids-go-scraper/metadata"
+	"github.com/coffeendude/ipfs-cids-go-scraper/schema"
+)
+
+// Conflict modes for rows that already exist when importing.
+const (
+	// modeUpsert updates existing rows with the imported fields that are
+	// not empty, keeping the stored value otherwise.
+	modeUpsert = "upsert"
+	// modeSkip leaves existing rows untouched.
+	modeSkip = "skip"
+	// modeOverwrite replaces existing rows with the imported ones.
+	modeOverwrite = "overwrite"
+)
+
+// Import actions, as reported per row.
+const (
+	actionInsert    = "insert"
+	actionUpdate    = "update"
+	actionUnchanged = "unchanged"
+	actionSkip      = "skip"
+	actionInvalid   = "invalid"
+
+	// countSchemaInvalid counts the rows written that failed validation.
+	countSchemaInvalid = "failed validation"
+)
+
+// fieldChange is one column an import would change.
+type fieldChange struct {
+	Field string
+	Old   string
+	New   string
+}
+
+// planImport decides what importing incoming does given the stored row, or
+// nil if there is none. It returns the action, the row to store and the
+// columns that change.
+func planImport(existing, incoming *metadata.Metadata, mode string) (string, *metadata.Metadata, []fieldChange) {
+	if existing == nil {
+		return actionInsert, incoming, nil
+	}
+	if mode == modeSkip {
+		return actionSkip, existing, nil
+	}
+
+	merged := *incoming
+	if mode == modeUpsert {
+		if merged.Name == "" {
+			merged.Name = existing.Name
+		}
+		if merged.Description == "" {
+			merged.Description = existing.Description
+		}
+		if merged.Image == "" {
+			merged.Image = existing.Image
+		}
+		if len(merged.Attributes) == 0 {
+			merged.Attributes = existing.Attributes
+		}
+		if merged.AnimationURL == "" {
+			merged.AnimationURL = existing.AnimationURL
+		}
+		if len(merged.Links) == 0 {
+			merged.Links = existing.Links
+		}
+		if merged.MediaType == "" {
+			merged.MediaType = existing.MediaType
+		}
+		if merged.TokenURI == "" {
+			merged.TokenURI = existing.TokenURI
+		}
+		// As stored: the document fetched before is kept.
+		if len(existing.Raw) > 0 {
+			merged.Raw = existing.Raw
+		}
+	}
+
+	var changes []fieldChange
+	diff := func(field, from, to string) {
+		if from != to {
+			changes = append(changes, fieldChange{field, from, to})
+		}
+	}
+	diff("name", existing.Name, merged.Name)
+	diff("description", existing.Description, merged.Description)
+	diff("image", existing.Image, merged.Image)
+	diff("attributes", string(existing.AttributesJSON()), string(merged.AttributesJSON()))
+	diff("animation_url", existing.AnimationURL, merged.AnimationURL)
+	diff("token_uri", existing.TokenURI, merged.TokenURI)
+	if len(changes) == 0 {
+		return actionUnchanged, existing, nil
+	}
+	return actionUpdate, &merged, changes
+}
+
+// runImport implements the import subcommand, which loads exported or raw
+// metadata into the database without fetching anything from IPFS. Every
+// document goes through the same parsing, mapping, validation and storage
+// as a scrape.
+func runImport(args []string) error {
+	fs := flag.NewFlagSet("import", flag.ExitOnError)
+	var dbc dbConfig
+	var lc logConfig
+	dbc.register(fs)
+	lc.register(fs)
+	file := fs.String("file", "", "File to import")
+	format := fs.String("format", "", "Input format: csv, jsonl or json (default from the file extension)")
+	mode := fs.String("mode", modeUpsert, "What to do with CIDs already stored: upsert, skip or overwrite")
+	dryRun := fs.Bool("dry-run", false, "Print what would change without writing anything")
+	validate := fs.String("validate", "", "Validate each document against its collection's schema, or else this one: erc721, erc1155 or a schema file (disabled if empty)")
+	fs.Parse(args)
+
+	lc.setup()
+	if *file == "" {
+		return fail("Error reading flags", errors.New("-file is required"))
+	}
+	switch *mode {
+	case modeUpsert, modeSkip, modeOverwrite:
+	default:
+		return fail("Error reading flags", fmt.Errorf("invalid -mode %q: want upsert, skip or overwrite", *mode))
+	}
+	if *format == "" {
+		var err error
+		if *format, err = export.FormatFromPath(*file); err != nil {
+			return fail("Error reading flags", err)
+		}
+	}
+
+	f, err := os.Open(*file)
+	if err != nil {
+		return fail("Error opening import file", err)
+	}
+	defer f.Close()
+	r, err := export.NewReader(*format, f)
+	if err != nil {
+		return fail("Error reading import file", err)
+	}
+
+	db, err := dbc.connect()
+	if err != nil {
+		return fail("Error connecting to database", err)
+	}
+	defer db.Close()
+
+	ctx := context.Background()
+	im := &importer{db: db, mode: *mode, dryRun: *dryRun, out: os.Stdout}
+	hasCollections := true
+	if *dryRun {
+		// A dry run changes nothing, not even the schema. Without a
+		// metadata table every record would be an insert.
+		exists, err := tableExists(ctx, db, "metadata")
+		if err != nil {
+			return fail("Error checking metadata table", err)
+		}
+		if !exists {
+			im.db = nil
+		}
+		if hasCollections, err = tableExists(ctx, db, "collections"); err != nil {
+			return fail("Error checking collections table", err)
+		}
+	} else {
+		if err := ensureMetadataTable(db); err != nil {
+			return fail("Error creating metadata table", err)
+		}
+		if err := collection.CreateTables(db); err != nil {
+			return fail("Error creating collection tables", err)
+		}
+		if *validate != "" {
+			if err := schema.CreateTable(db); err != nil {
+				return fail("Error creating validations table", err)
+			}
+		}
+	}
+
+	// Records are mapped and validated as scraped documents are.
+	var collections []collection.Collection
+	if hasCollections {
+		if collections, err = collection.List(ctx, db); err != nil {
+			return fail("Error listing collections", err)
+		}
+	}
+	if im.mapper, err = mapperFor(db, collections); err != nil {
+		return fail("Error loading mappings", err)
+	}
+	if *validate != "" {
+		if im.validator, err = validatorFor(db, *validate, collections); err != nil {
+			return fail("Error loading schemas", err)
+		}
+	}
+
+	counts, err := im.run(ctx, r)
+	if err != nil {
+		return fail("Error importing metadata", err)
+	}
+	if err := writeImportSummary(os.Stdout, counts, *dryRun, im.validator != nil); err != nil {
+		return fail("Error printing import summary", err)
+	}
+	return nil
+}
+
+// importer stores imported records the way a scrape stores documents.
+type importer struct {
+	// db is nil in a dry run when there is no metadata table yet.
+	db     *sql.DB
+	mapper *mapper
+	// validator is nil unless records are validated.
+	validator *validator
+	mode      string
+	// dryRun stores nothing and writes each change to out instead.
+	dryRun bool
+	out    io.Writer
+}
+
+// run reads every record from r and imports it, returning how many rows
+// took each action, and with a validator how many failed validation.
+func (im *importer) run(ctx context.Context, r export.Reader) (map[string]int, error) {
+	counts := map[string]int{}
+	for {
+		rec, err := r.Read()
+		if err == io.EOF {
+			return counts, nil
+		}
+		if err != nil {
+			return counts, err
+		}
+
+		ctx := logging.With(ctx, logging.CID, rec.Cid)
+		if rec.Cid == "" {
+			counts[actionInvalid]++
+			logging.From(ctx).Warn("Skipping record without a CID", "pos", rec.Pos)
+			continue
+		}
+		incoming, err := parseMetadata(ctx, rec.Cid, rec.Body)
+		if err != nil {
+			counts[actionInvalid]++
+			logging.From(ctx).Warn("Skipping invalid record", "pos", rec.Pos, "error", err)
+			continue
+		}
+		if rec.Raw != nil {
+			incoming.Raw = rec.Raw
+		}
+		if rec.MediaType != "" {
+			incoming.MediaType = rec.MediaType
+		}
+		if rec.Links != nil {
+			incoming.Links = rec.Links
+		}
+		// An unmapped record is still imported; remap can fix it later.
+		mt, err := im.mapper.apply(ctx, incoming)
+		if err != nil {
+			logging.From(ctx).Error("Error mapping metadata", "pos", rec.Pos, "error", err)
+		}
+
+		var existing *metadata.Metadata
+		if im.db != nil {
+			if existing, err = loadMetadata(ctx, im.db, rec.Cid); err != nil {
+				return counts, err
+			}
+		}
+		action, row, changes := planImport(existing, incoming, im.mode)
+		counts[action]++
+		if action != actionInsert && action != actionUpdate {
+			continue
+		}
+
+		if im.dryRun {
+			fmt.Fprintf(im.out, "%s %s\n", action, rec.Cid)
+			for _, c := range changes {
+				fmt.Fprintf(im.out, "    %s: %q -> %q\n", c.Field, c.Old, c.New)
+			}
+			if mt != nil {
+				fmt.Fprintf(im.out, "    mapped by %s\n", mt.Name)
+			}
+		} else {
+			// An upserted record may hold only some fields, so the
+			// document fetched before stays the one validate and remap
+			// work from.
+			if err := upsertMetadata(ctx, im.db, row, im.mode == modeUpsert); err != nil {
+				return counts, fmt.Errorf("%w for CID %s: %w", errStore, rec.Cid, err)
+			}
+		}
+		if im.validator != nil {
+			if err := im.validate(ctx, row, mt, counts); err != nil {
+				return counts, err
+			}
+		}
+	}
+}
+
+// validate checks row as it is stored, mapped by mt, against its schema.
+// The result is stored, or written to out in a dry run.
+func (im *importer) validate(ctx context.Context, row *metadata.Metadata, mt *mapping.Mapping, counts map[string]int) error {
+	if rawJSON(row.Raw) == nil {
+		// Without a raw document there is nothing to validate, nor any
+		// old result to keep.
+		if im.dryRun {
+			return nil
+		}
+		return im.validator.forget(ctx, row.Cid)
+	}
+	doc, err := mappedDocument(row, mt)
+	if err != nil {
+		logging.From(ctx).Error("Error validating metadata", "error", err)
+		return nil
+	}
+	s, r, err := im.validator.check(ctx, row.Cid, doc)
+	if err != nil {
+		return err
+	}
+	if !r.Valid {
+		counts[countSchemaInvalid]++
+	}
+	if im.dryRun {
+		if r.Valid {
+			fmt.Fprintf(im.out, "    valid against %s\n", s.Name)
+		} else {
+			fmt.Fprintf(im.out, "    invalid against %s: %s\n", s.Name, strings.Join(r.Errors, "; "))
+		}
+		return nil
+	}
+	if !r.Valid {
+		logging.From(ctx).Warn("Metadata is invalid", "errors", r.Errors)
+	}
+	return schema.Save(ctx, im.validator.db, row.Cid, s.Name, r)
+}
+
+// loadMetadata returns the stored row for cid, with its raw document, or
+// nil if there is none.
+func loadMetadata(ctx context.Context, db *sql.DB, cid string) (*metadata.Metadata, error) {
+	var raw []byte
+	m, err := metadata.Scan(db.QueryRowContext(ctx, "SELECT "+metadata.Columns+", raw FROM metadata WHERE cid = $1", cid), &raw)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("error loading metadata: %w", err)
+	}
+	m.Raw = raw
+	return m, nil
+}
+
+func writeImportSummary(w io.Writer, counts map[string]int, dryRun, validated bool) error {
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	if dryRun {
+		fmt.Fprintln(tw, "Import summary (dry run, nothing written)")
+	} else {
+		fmt.Fprintln(tw, "Import summary")
+	}
+	for _, action := range []string{actionInsert, actionUpdate, actionUnchanged, actionSkip, actionInvalid} {
+		fmt.Fprintf(tw, "  %s\t%d\n", action, counts[action])
+	}
+	if validated {
+		fmt.Fprintf(tw, "  %s\t%d\n", countSchemaInvalid, counts[countSchemaInvalid])
+	}
+	return tw.Flush()
+}
@@ -0,0 +1,347 @@
+// Package input reads the CSV files of tokens to scrape. A file may be a
+// bare list of CIDs or an export with extra columns; a Schema says which
+// column holds which field and whether the first line is a header.
+package input
+
+import (
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/coffeendude/ipfs-cids-go-scraper/resolve"
+)
+
+// The fields a row can carry.
+const (
+	FieldCID        = "cid"
+	FieldTokenURI   = "token_uri"
+	FieldTokenID    = "token_id"
+	FieldCollection = "collection"
+	FieldPriority   = "priority"
+)
+
+// Header modes.
+const (
+	HeaderAuto = "auto"
+	HeaderYes  = "yes"
+	HeaderNo   = "no"
+)
+
+var fields = []string{FieldCID, FieldTokenURI, FieldTokenID, FieldCollection, FieldPriority}
+
+// aliases are the header names recognised for each field, compared after
+// normalize.
+var aliases = map[string][]string{
+	FieldCID:        {"cid", "ipfscid", "hash"},
+	FieldTokenURI:   {"tokenuri", "uri", "metadatauri", "url"},
+	FieldTokenID:    {"tokenid", "id", "token"},
+	FieldCollection: {"collection", "collectionid"},
+	FieldPriority:   {"priority"},
+}
+
+// positional is the column layout of a headerless file with no column
+// mapping: cid, then optionally collection and token ID.
+var positional = map[string]string{FieldCID: "1", FieldCollection: "2", FieldTokenID: "3"}
+
+// Schema describes an input file.
+type Schema struct {
+	// Delimiter separates columns; zero means a comma.
+	Delimiter rune
+	// Header is HeaderAuto, HeaderYes or HeaderNo. In auto mode the first
+	// line is a header if any cell names a known field or a mapped column.
+	Header string
+	// Columns maps a field to a header name or a 1-based column number.
+	// Fields not listed are found by their usual header names, or by
+	// position in a headerless file.
+	Columns map[string]string
+}
+
+// Row is one token to scrape.
+type Row struct {
+	// Cid is the document's key: the IPFS path, or for a token URI that
+	// isn't on IPFS, the key given by resolve.
+	Cid        string
+	TokenURI   string
+	TokenID    string
+	Collection string
+	Priority   int
+	// Line is the 1-based line number in the file, for error messages.
+	Line int
+}
+
+// ParseDelimiter parses a delimiter flag: a single character, or "tab".
+func ParseDelimiter(s string) (rune, error) {
+	switch s {
+	case "", ",":
+		return ',', nil
+	case "tab", `\t`, "\t":
+		return '\t', nil
+	}
+	r := []rune(s)
+	if len(r) != 1 || r[0] == '"' || r[0] == '\r' || r[0] == '\n' {
+		return 0, fmt.Errorf("invalid delimiter %q", s)
+	}
+	return r[0], nil
+}
+
+// ParseColumns parses a column mapping such as "cid=hash,token_id=3".
+func ParseColumns(s string) (map[string]string, error) {
+	columns := map[string]string{}
+	for _, part := range strings.Split(s, ",") {
+		if part = strings.TrimSpace(part); part == "" {
+			continue
+		}
+		field, column, ok := strings.Cut(part, "=")
+		field, column = strings.TrimSpace(field), strings.TrimSpace(column)
+		if !ok || column == "" {
+			return nil, fmt.Errorf("invalid column mapping %q: want field=column", part)
+		}
+		if _, known := aliases[field]; !known {
+			return nil, fmt.Errorf("unknown field %q in column mapping (want one of %s)", field, strings.Join(fields, ", "))
+		}
+		columns[field] = column
+	}
+	return columns, nil
+}
+
+// ReadFile reads the rows of the file at path.
+func ReadFile(path string, s Schema) ([]Row, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("error opening file: %w", err)
+	}
+	defer file.Close()
+	return Read(file, s)
+}
+
+// Read reads every row from r.
+func Read(r io.Reader, s Schema) ([]Row, error) {
+	reader := csv.NewReader(r)
+	reader.FieldsPerRecord = -1
+	reader.TrimLeadingSpace = true
+	if s.Delimiter != 0 {
+		reader.Comma = s.Delimiter
+	}
+	var lines [][]string
+	var numbers []int
+	for {
+		line, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("error reading CSV: %w", err)
+		}
+		n, _ := reader.FieldPos(0)
+		lines = append(lines, line)
+		numbers = append(numbers, n)
+	}
+	if len(lines) == 0 {
+		return nil, nil
+	}
+
+	header := false
+	switch s.Header {
+	case "", HeaderAuto:
+		header = isHeader(lines[0], s.Columns)
+	case HeaderYes:
+		header = true
+	case HeaderNo:
+	default:
+		return nil, fmt.Errorf("invalid header mode %q", s.Header)
+	}
+
+	var index map[string]int
+	var err error
+	first := 0
+	if header {
+		first = 1
+		index, err = headerIndex(lines[0], s.Columns)
+	} else {
+		index, err = positionIndex(s.Columns)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var rows []Row
+	for i := first; i < len(lines); i++ {
+		row, err := parseRow(lines[i], index)
+		if err != nil {
+			return nil, fmt.Errorf("error reading CSV line %d: %w", numbers[i], err)
+		}
+		if row == nil {
+			continue
+		}
+		row.Line = numbers[i]
+		rows = append(rows, *row)
+	}
+	return rows, nil
+}
+
+// SortByPriority orders rows by descending priority, keeping file order
+// among equal priorities.
+func SortByPriority(rows []Row) {
+	sort.SliceStable(rows, func(i, j int) bool { return rows[i].Priority > rows[j].Priority })
+}
+
+func normalize(s string) string {
+	return strings.Map(func(r rune) rune {
+		if r == '_' || r == '-' || r == ' ' {
+			return -1
+		}
+		return r
+	}, strings.ToLower(strings.TrimSpace(s)))
+}
+
+// isHeader reports whether line names a known field or a mapped column.
+// Columns mapped by number name nothing, so a cell holding that number is
+// data.
+func isHeader(line []string, columns map[string]string) bool {
+	names := map[string]bool{}
+	for _, field := range fields {
+		for _, a := range aliases[field] {
+			names[a] = true
+		}
+	}
+	for _, column := range columns {
+		if _, err := strconv.Atoi(column); err == nil {
+			continue
+		}
+		names[normalize(column)] = true
+	}
+	for _, cell := range line {
+		if names[normalize(cell)] {
+			return true
+		}
+	}
+	return false
+}
+
+// headerIndex finds the column of each field in a header line.
+func headerIndex(line []string, columns map[string]string) (map[string]int, error) {
+	byName := map[string]int{}
+	for i, cell := range line {
+		if n := normalize(cell); n != "" {
+			if _, dup := byName[n]; !dup {
+				byName[n] = i
+			}
+		}
+	}
+
+	index := map[string]int{}
+	for _, field := range fields {
+		if column, ok := columns[field]; ok {
+			i, err := columnIndex(column, byName)
+			if err != nil {
+				return nil, fmt.Errorf("error mapping %s: %w", field, err)
+			}
+			index[field] = i
+			continue
+		}
+		for _, a := range aliases[field] {
+			if i, ok := byName[a]; ok {
+				index[field] = i
+				break
+			}
+		}
+	}
+	if err := checkIndex(index); err != nil {
+		return nil, err
+	}
+	return index, nil
+}
+
+// positionIndex finds the column of each field in a headerless file.
+func positionIndex(columns map[string]string) (map[string]int, error) {
+	if len(columns) == 0 {
+		columns = positional
+	}
+	index := map[string]int{}
+	for field, column := range columns {
+		i, err := columnIndex(column, nil)
+		if err != nil {
+			return nil, fmt.Errorf("error mapping %s: %w", field, err)
+		}
+		index[field] = i
+	}
+	if err := checkIndex(index); err != nil {
+		return nil, err
+	}
+	return index, nil
+}
+
+// columnIndex resolves a 1-based column number or, given a header, a
+// column name.
+func columnIndex(column string, byName map[string]int) (int, error) {
+	if n, err := strconv.Atoi(column); err == nil {
+		if n < 1 {
+			return 0, fmt.Errorf("invalid column number %d", n)
+		}
+		return n - 1, nil
+	}
+	if byName == nil {
+		return 0, fmt.Errorf("column %q needs a header line, use a column number", column)
+	}
+	i, ok := byName[normalize(column)]
+	if !ok {
+		return 0, fmt.Errorf("no column named %q", column)
+	}
+	return i, nil
+}
+
+func checkIndex(index map[string]int) error {
+	_, cid := index[FieldCID]
+	_, uri := index[FieldTokenURI]
+	if !cid && !uri {
+		return errors.New("input has no cid or token_uri column")
+	}
+	return nil
+}
+
+// parseRow reads a line using index. It returns nil for a blank line.
+func parseRow(line []string, index map[string]int) (*Row, error) {
+	cell := func(field string) string {
+		i, ok := index[field]
+		if !ok || i >= len(line) {
+			return ""
+		}
+		return strings.TrimSpace(line[i])
+	}
+
+	row := &Row{
+		Cid:        cell(FieldCID),
+		TokenURI:   cell(FieldTokenURI),
+		TokenID:    cell(FieldTokenID),
+		Collection: cell(FieldCollection),
+	}
+	if p := cell(FieldPriority); p != "" {
+		n, err := strconv.Atoi(p)
+		if err != nil {
+			return nil, fmt.Errorf("invalid priority %q", p)
+		}
+		row.Priority = n
+	}
+	if row.Cid == "" && row.TokenURI == "" {
+		if row.TokenID == "" && row.Collection == "" && row.Priority == 0 {
+			return nil, nil
+		}
+		return nil, errors.New("row has no cid or token_uri")
+	}
+	if row.Cid == "" {
+		src, err := resolve.Parse(row.TokenURI)
+		if err != nil {
+			return nil, err
+		}
+		row.Cid = src.Key()
+	}
+	if row.Collection != "" && row.TokenID == "" {
+		return nil, fmt.Errorf("row names collection %q but no token_id", row.Collection)
+	}
+	return row, nil
+}
@@ -0,0 +1,85 @@
+package input
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestReadPlain(t *testing.T) {
+	rows, err := Read(strings.NewReader("QmA\n\nQmB,apes,7\n"), Schema{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []Row{
+		{Cid: "QmA", Line: 1},
+		{Cid: "QmB", Collection: "apes", TokenID: "7", Line: 3},
+	}
+	if !reflect.DeepEqual(rows, want) {
+		t.Errorf("got %+v, want %+v", rows, want)
+	}
+
+	if _, err := Read(strings.NewReader("QmA,apes\n"), Schema{}); err == nil {
+		t.Error("expected an error for a collection without a token ID")
+	}
+}
+
+func TestReadHeader(t *testing.T) {
+	in := "Token ID;Token URI;Owner;Priority\n" +
+		"1;ipfs://bafydir/1;0xabc;\n" +
+		"2;https://api.example.com/2;0xdef;5\n"
+	rows, err := Read(strings.NewReader(in), Schema{Delimiter: ';'})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []Row{
+		{Cid: "bafydir/1", TokenURI: "ipfs://bafydir/1", TokenID: "1", Line: 2},
+		{Cid: "https://api.example.com/2", TokenURI: "https://api.example.com/2", TokenID: "2", Priority: 5, Line: 3},
+	}
+	if !reflect.DeepEqual(rows, want) {
+		t.Errorf("got %+v, want %+v", rows, want)
+	}
+
+	SortByPriority(rows)
+	if rows[0].TokenID != "2" {
+		t.Errorf("priority order = %+v", rows)
+	}
+}
+
+func TestReadColumns(t *testing.T) {
+	columns, err := ParseColumns("cid=content_hash, collection=3, token_id=2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	in := "content_hash,token,project\nQmA,9,apes\n"
+	rows, err := Read(strings.NewReader(in), Schema{Columns: columns})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []Row{{Cid: "QmA", TokenID: "9", Collection: "apes", Line: 2}}; !reflect.DeepEqual(rows, want) {
+		t.Errorf("got %+v, want %+v", rows, want)
+	}
+
+	rows, err = Read(strings.NewReader("x\tQmA\n"), Schema{Delimiter: '\t', Header: HeaderNo, Columns: map[string]string{FieldCID: "2"}})
+	if err != nil || len(rows) != 1 || rows[0].Cid != "QmA" {
+		t.Errorf("headerless mapping: %+v, %v", rows, err)
+	}
+
+	// A data cell equal to a column number is not a header.
+	rows, err = Read(strings.NewReader("QmA,2\nQmB,3\n"), Schema{Columns: map[string]string{FieldCID: "1", FieldTokenID: "2"}})
+	if err != nil || len(rows) != 2 || rows[0].TokenID != "2" {
+		t.Errorf("numeric mapping: %+v, %v", rows, err)
+	}
+	if isHeader([]string{"QmA", "3"}, map[string]string{FieldCID: "1", FieldTokenID: "3"}) {
+		t.Error("isHeader treated a column number as a column name")
+	}
+
+	for _, bad := range []string{"owner=2", "cid", "cid="} {
+		if _, err := ParseColumns(bad); err == nil {
+			t.Errorf("ParseColumns(%q): expected an error", bad)
+		}
+	}
+	if _, err := Read(strings.NewReader("name,owner\na,b\n"), Schema{Header: HeaderYes}); err == nil {
+		t.Error("expected an error for a header without a cid or token_uri column")
+	}
+}
@@ -0,0 +1,281 @@
+// Package ipld decodes metadata stored as IPLD blocks, in dag-cbor or
+// dag-json, into plain JSON, keeping track of the CID links it contains.
+package ipld
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"unicode/utf8"
+
+	"github.com/coffeendude/ipfs-cids-go-scraper/unixfs"
+)
+
+// Link is a CID link in a decoded document. Path is where it was found,
+// as keys and array indexes joined by "/", and is only set by ToJSON.
+type Link struct {
+	Path string
+	Cid  string
+}
+
+// cidTag is the CBOR tag of a CID link.
+const cidTag = 42
+
+// maxDepth bounds nesting so a hostile block can't exhaust the stack.
+const maxDepth = 64
+
+// DecodeCBOR decodes a dag-cbor block into maps, slices, strings, []byte,
+// int64, uint64, float64, bool, nil and Link values.
+func DecodeCBOR(b []byte) (any, error) {
+	d := &cborDecoder{b: b}
+	v, err := d.value(0)
+	if err != nil {
+		return nil, fmt.Errorf("error decoding dag-cbor at byte %d: %w", d.pos, err)
+	}
+	if d.pos != len(b) {
+		return nil, fmt.Errorf("error decoding dag-cbor: %d trailing bytes", len(b)-d.pos)
+	}
+	return v, nil
+}
+
+type cborDecoder struct {
+	b   []byte
+	pos int
+}
+
+var errTruncated = errors.New("unexpected end of data")
+
+// head reads the initial byte of an item and its argument.
+func (d *cborDecoder) head() (major byte, info byte, arg uint64, err error) {
+	if d.pos >= len(d.b) {
+		return 0, 0, 0, errTruncated
+	}
+	major, info = d.b[d.pos]>>5, d.b[d.pos]&0x1f
+	d.pos++
+	switch {
+	case info < 24:
+		return major, info, uint64(info), nil
+	case info <= 27:
+		size := 1 << (info - 24)
+		if len(d.b)-d.pos < size {
+			return 0, 0, 0, errTruncated
+		}
+		for _, c := range d.b[d.pos : d.pos+size] {
+			arg = arg<<8 | uint64(c)
+		}
+		d.pos += size
+		return major, info, arg, nil
+	}
+	return 0, 0, 0, errors.New("indefinite lengths aren't allowed in dag-cbor")
+}
+
+// bytes reads n bytes of a string.
+func (d *cborDecoder) bytes(n uint64) ([]byte, error) {
+	if n > uint64(len(d.b)-d.pos) {
+		return nil, errTruncated
+	}
+	b := d.b[d.pos : d.pos+int(n)]
+	d.pos += int(n)
+	return b, nil
+}
+
+func (d *cborDecoder) value(depth int) (any, error) {
+	if depth > maxDepth {
+		return nil, errors.New("nested too deeply")
+	}
+	major, info, arg, err := d.head()
+	if err != nil {
+		return nil, err
+	}
+	switch major {
+	case 0:
+		if arg > math.MaxInt64 {
+			return arg, nil
+		}
+		return int64(arg), nil
+	case 1:
+		if arg > math.MaxInt64 {
+			return nil, errors.New("negative integer out of range")
+		}
+		return -1 - int64(arg), nil
+	case 2:
+		b, err := d.bytes(arg)
+		return append([]byte(nil), b...), err
+	case 3:
+		b, err := d.bytes(arg)
+		if err != nil {
+			return nil, err
+		}
+		if !utf8.Valid(b) {
+			return nil, errors.New("invalid UTF-8 in string")
+		}
+		return string(b), nil
+	case 4:
+		// Every item takes at least a byte, which rejects huge counts.
+		if arg > uint64(len(d.b)-d.pos) {
+			return nil, errTruncated
+		}
+		list := make([]any, 0, arg)
+		for i := uint64(0); i < arg; i++ {
+			v, err := d.value(depth + 1)
+			if err != nil {
+				return nil, err
+			}
+			list = append(list, v)
+		}
+		return list, nil
+	case 5:
+		if arg > uint64(len(d.b)-d.pos) {
+			return nil, errTruncated
+		}
+		m := make(map[string]any, arg)
+		for i := uint64(0); i < arg; i++ {
+			k, err := d.value(depth + 1)
+			if err != nil {
+				return nil, err
+			}
+			key, ok := k.(string)
+			if !ok {
+				return nil, errors.New("map keys must be strings")
+			}
+			if m[key], err = d.value(depth + 1); err != nil {
+				return nil, err
+			}
+		}
+		return m, nil
+	case 6:
+		if arg != cidTag {
+			return nil, fmt.Errorf("unsupported tag %d", arg)
+		}
+		v, err := d.value(depth + 1)
+		if err != nil {
+			return nil, err
+		}
+		// CIDs are byte strings with a leading 0x00, the identity multibase.
+		b, ok := v.([]byte)
+		if !ok || len(b) == 0 || b[0] != 0 {
+			return nil, errors.New("invalid CID link")
+		}
+		cid, err := unixfs.CIDString(b[1:])
+		if err != nil {
+			return nil, err
+		}
+		return Link{Cid: cid}, nil
+	}
+
+	switch info {
+	case 20:
+		return false, nil
+	case 21:
+		return true, nil
+	case 22:
+		return nil, nil
+	case 26:
+		return float64(math.Float32frombits(uint32(arg))), nil
+	case 27:
+		return math.Float64frombits(arg), nil
+	}
+	return nil, fmt.Errorf("unsupported simple value %d", info)
+}
+
+// DecodeJSON decodes a dag-json document into the same values as
+// DecodeCBOR, turning {"/": "<cid>"} into a Link and
+// {"/": {"bytes": "<base64>"}} into a []byte. Numbers are json.Number.
+func DecodeJSON(b []byte) (any, error) {
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.UseNumber()
+	var v any
+	if err := dec.Decode(&v); err != nil {
+		return nil, fmt.Errorf("error decoding dag-json: %w", err)
+	}
+	if _, err := dec.Token(); err != io.EOF {
+		return nil, errors.New("error decoding dag-json: data after the document")
+	}
+	return fromJSON(v)
+}
+
+func fromJSON(v any) (any, error) {
+	switch v := v.(type) {
+	case map[string]any:
+		if slash, ok := v["/"]; ok && len(v) == 1 {
+			switch slash := slash.(type) {
+			case string:
+				return Link{Cid: slash}, nil
+			case map[string]any:
+				if s, ok := slash["bytes"].(string); ok && len(slash) == 1 {
+					b, err := base64.RawStdEncoding.DecodeString(s)
+					if err != nil {
+						return nil, fmt.Errorf("invalid dag-json bytes: %w", err)
+					}
+					return b, nil
+				}
+			}
+		}
+		for k, e := range v {
+			var err error
+			if v[k], err = fromJSON(e); err != nil {
+				return nil, err
+			}
+		}
+	case []any:
+		for i, e := range v {
+			var err error
+			if v[i], err = fromJSON(e); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return v, nil
+}
+
+// ToJSON encodes a decoded document as plain JSON. Each link becomes an
+// "ipfs://<cid>" string, so it can be fetched like any other URI, and is
+// also returned with its path. Byte strings become base64.
+func ToJSON(v any) ([]byte, []Link, error) {
+	var links []Link
+	plain := toPlain(v, "", &links)
+	b, err := json.Marshal(plain)
+	if err != nil {
+		return nil, nil, fmt.Errorf("error encoding document: %w", err)
+	}
+	sort.Slice(links, func(i, j int) bool { return links[i].Path < links[j].Path })
+	return b, links, nil
+}
+
+func toPlain(v any, path string, links *[]Link) any {
+	join := func(k string) string {
+		if path == "" {
+			return k
+		}
+		return path + "/" + k
+	}
+	switch v := v.(type) {
+	case Link:
+		*links = append(*links, Link{Path: path, Cid: v.Cid})
+		return "ipfs://" + v.Cid
+	case map[string]any:
+		m := make(map[string]any, len(v))
+		for k, e := range v {
+			m[k] = toPlain(e, join(k), links)
+		}
+		return m
+	case []any:
+		list := make([]any, len(v))
+		for i, e := range v {
+			list[i] = toPlain(e, join(strconv.Itoa(i)), links)
+		}
+		return list
+	case float64:
+		// JSON has no NaN or infinities.
+		if math.IsNaN(v) || math.IsInf(v, 0) {
+			return nil
+		}
+	}
+	return v
+}
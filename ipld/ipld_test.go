@@ -0,0 +1,100 @@
+package ipld
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math"
+	"reflect"
+	"testing"
+
+	"github.com/coffeendude/ipfs-cids-go-scraper/unixfs"
+)
+
+func head(major byte, arg uint64) []byte {
+	switch {
+	case arg < 24:
+		return []byte{major<<5 | byte(arg)}
+	case arg <= math.MaxUint8:
+		return []byte{major<<5 | 24, byte(arg)}
+	case arg <= math.MaxUint16:
+		return binary.BigEndian.AppendUint16([]byte{major<<5 | 25}, uint16(arg))
+	}
+	return binary.BigEndian.AppendUint32([]byte{major<<5 | 26}, uint32(arg))
+}
+
+func text(s string) []byte { return append(head(3, uint64(len(s))), s...) }
+
+func cat(parts ...[]byte) []byte { return bytes.Join(parts, nil) }
+
+var cidV0 = append([]byte{0x12, 0x20}, bytes.Repeat([]byte{0xe3}, 32)...)
+
+func TestDecodeCBOR(t *testing.T) {
+	link := cat(head(6, cidTag), head(2, 35), []byte{0}, cidV0)
+	block := cat(head(5, 4),
+		text("name"), text("Ape #1"),
+		text("image"), link,
+		text("attributes"), cat(head(4, 2),
+			cat(head(5, 2), text("trait_type"), text("Level"), text("value"), head(0, 300)),
+			cat(head(5, 2), text("trait_type"), text("Debt"), text("value"), head(1, 9)),
+		),
+		text("ok"), []byte{0xf5},
+	)
+
+	v, err := DecodeCBOR(block)
+	if err != nil {
+		t.Fatal(err)
+	}
+	doc, links, err := ToJSON(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cid, err := unixfs.CIDString(cidV0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `{"attributes":[{"trait_type":"Level","value":300},{"trait_type":"Debt","value":-10}],"image":"ipfs://` + cid + `","name":"Ape #1","ok":true}`
+	if string(doc) != want {
+		t.Errorf("got  %s\nwant %s", doc, want)
+	}
+	if !reflect.DeepEqual(links, []Link{{Path: "image", Cid: cid}}) {
+		t.Errorf("links = %+v", links)
+	}
+
+	for name, bad := range map[string][]byte{
+		"truncated":      block[:len(block)-3],
+		"trailing":       append(append([]byte(nil), block...), 0),
+		"indefinite":     {0xbf, 0xff},
+		"int key":        cat(head(5, 1), head(0, 1), head(0, 2)),
+		"other tag":      cat(head(6, 1), head(0, 0)),
+		"huge map":       {0xbb, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff},
+		"bad link":       cat(head(6, cidTag), text("Qm")),
+		"invalid string": cat(head(3, 1), []byte{0xff}),
+	} {
+		if _, err := DecodeCBOR(bad); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+}
+
+func TestDecodeJSON(t *testing.T) {
+	v, err := DecodeJSON([]byte(`{"name":"Ape","image":{"/":"bafkqaaa"},"properties":{"files":[{"/":"bafkqaab"}],"raw":{"/":{"bytes":"aGk"}}},"n":1.5}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	doc, links, err := ToJSON(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `{"image":"ipfs://bafkqaaa","n":1.5,"name":"Ape","properties":{"files":["ipfs://bafkqaab"],"raw":"aGk="}}`
+	if string(doc) != want {
+		t.Errorf("got  %s\nwant %s", doc, want)
+	}
+	wantLinks := []Link{{Path: "image", Cid: "bafkqaaa"}, {Path: "properties/files/0", Cid: "bafkqaab"}}
+	if !reflect.DeepEqual(links, wantLinks) {
+		t.Errorf("links = %+v, want %+v", links, wantLinks)
+	}
+
+	if _, err := DecodeJSON([]byte(`{"/":{"bytes":"!!"}}`)); err == nil {
+		t.Error("expected an error for invalid bytes")
+	}
+}
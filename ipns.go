@@ -0,0 +1,181 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/signal"
+	"syscall"
+	"text/tabwriter"
+	"time"
+
+	"github.com/coffeendude/ipfs-cids-go-scraper/ipns"
+	"github.com/coffeendude/ipfs-cids-go-scraper/logging"
+	"github.com/coffeendude/ipfs-cids-go-scraper/progress"
+	"github.com/coffeendude/ipfs-cids-go-scraper/report"
+)
+
+// runIPNS implements the ipns subcommand: "ipns list" prints the IPNS names
+// and DNSLink domains seen so far and what they resolved to, and "ipns
+// refresh" resolves them again, refetching the documents of every name that
+// has moved. With -every, refresh keeps doing so on a schedule.
+func runIPNS(args []string) error {
+	if len(args) == 0 || (args[0] != "list" && args[0] != "refresh") {
+		fmt.Fprintln(os.Stderr, "usage: ipns list|refresh [flags]")
+		os.Exit(2)
+	}
+	cmd := args[0]
+
+	fs := flag.NewFlagSet("ipns "+cmd, flag.ExitOnError)
+	var dbc dbConfig
+	var sc scrapeConfig
+	var tc traceConfig
+	var lc logConfig
+	dbc.register(fs)
+	lc.register(fs)
+	var every *time.Duration
+	if cmd == "refresh" {
+		sc.register(fs)
+		tc.register(fs)
+		every = fs.Duration("every", 0, "Refresh at this interval until interrupted (0 refreshes once)")
+	}
+	fs.Parse(args[1:])
+
+	lc.setup()
+	if cmd == "refresh" {
+		defer tc.setup()()
+	}
+
+	db, err := dbc.connect()
+	if err != nil {
+		return fail("Error connecting to database", err)
+	}
+	defer db.Close()
+	if err := ipns.CreateTable(db); err != nil {
+		return fail("Error creating ipns table", err)
+	}
+
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer cancel()
+
+	if cmd == "list" {
+		names, err := ipns.List(ctx, db)
+		if err != nil {
+			return fail("Error listing names", err)
+		}
+		tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(tw, "Name\tPath\tResolved\tChanged")
+		for _, n := range names {
+			fmt.Fprintf(tw, "%s\t%s\t%s\t%s\n", n.Name, n.Path, n.ResolvedAt.Format(time.RFC3339), n.ChangedAt.Format(time.RFC3339))
+		}
+		if err := tw.Flush(); err != nil {
+			return fail("Error printing names", err)
+		}
+		return nil
+	}
+
+	if err := ensureMetadataTable(db); err != nil {
+		return fail("Error creating table", err)
+	}
+	if err := progress.CreateTable(db); err != nil {
+		return fail("Error creating jobs table", err)
+	}
+	s, err := sc.newScraper(db)
+	if err != nil {
+		return fail("Error configuring scraper", err)
+	}
+
+	if *every <= 0 {
+		if err := s.refreshNames(ctx); err != nil {
+			return fail("Error refreshing names", err)
+		}
+		return s.finishRun()
+	}
+	for {
+		// Each refresh is a run of its own, with its own report, and a
+		// failed one doesn't stop the next.
+		s.report, s.progress = report.NewRecorder(), progress.NewTracker()
+		if err := s.refreshNames(ctx); err != nil {
+			slog.Error("Error refreshing names", "error", err)
+		}
+		var ce *commandError
+		if err := s.finishRun(); errors.As(err, &ce) {
+			slog.Error(ce.msg, "error", ce.err)
+		}
+		sleepContext(ctx, *every)
+		if ctx.Err() != nil {
+			return nil
+		}
+	}
+}
+
+// refreshNames resolves every stored name again and refetches the
+// documents under those that point somewhere new.
+func (s *scraper) refreshNames(ctx context.Context) error {
+	names, err := ipns.List(ctx, s.db)
+	if err != nil {
+		return err
+	}
+
+	var cids []string
+	for _, n := range names {
+		p, err := s.ipns.Resolve(ctx, n.Name)
+		if err != nil {
+			slog.Warn("Error resolving IPNS name", "name", n.Name, "error", err)
+			continue
+		}
+		s.names.Store(n.Name, p)
+		changed, err := ipns.Save(ctx, s.db, n.Name, p)
+		if err != nil {
+			return err
+		}
+		if !changed {
+			continue
+		}
+		keys, err := nameKeys(ctx, s.db, n.Name)
+		if err != nil {
+			return err
+		}
+		slog.Info("IPNS name changed", "name", n.Name, "from", n.Path, "to", p, "documents", len(keys))
+		cids = append(cids, keys...)
+	}
+	if len(cids) == 0 {
+		return nil
+	}
+
+	jobID := newJobID()
+	ctx = logging.With(ctx, logging.JobID, jobID)
+	stopProgress := s.startProgress(jobID, s.db)
+	defer stopProgress()
+	return s.fetchAndStoreMetadata(ctx, cids)
+}
+
+// nameKeys returns the keys of the stored documents under an IPNS name.
+func nameKeys(ctx context.Context, db *sql.DB, name string) ([]string, error) {
+	key := "ipns://" + name
+	rows, err := db.QueryContext(ctx, `
+        SELECT cid FROM metadata
+        WHERE cid = $1 OR left(cid, length($2)) = $2
+        ORDER BY cid`, key, key+"/")
+	if err != nil {
+		return nil, fmt.Errorf("error querying documents of %s: %w", name, err)
+	}
+	defer rows.Close()
+
+	var keys []string
+	for rows.Next() {
+		var k string
+		if err := rows.Scan(&k); err != nil {
+			return nil, fmt.Errorf("error scanning row: %w", err)
+		}
+		keys = append(keys, k)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error reading rows: %w", err)
+	}
+	return keys, nil
+}
@@ -0,0 +1,187 @@
+// Package ipns resolves IPNS names and DNSLink domains to the IPFS paths
+// they currently point at, and keeps track of what each name last
+// resolved to so that documents can be refetched when it changes.
+package ipns
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+)
+
+// maxDepth bounds chains of names pointing at names.
+const maxDepth = 8
+
+// ErrNotFound is returned when a name has no record.
+var ErrNotFound = errors.New("name not found")
+
+// NameResolver resolves one IPNS name to a path, "/ipfs/..." or
+// "/ipns/...".
+type NameResolver interface {
+	ResolveName(ctx context.Context, name string) (string, error)
+}
+
+// Resolver resolves names through Names, looking up DNSLink domains in
+// DNS itself when LookupTXT is set.
+type Resolver struct {
+	Names NameResolver
+	// LookupTXT returns the TXT records of a DNS name. It is
+	// net.DefaultResolver.LookupTXT outside tests.
+	LookupTXT func(ctx context.Context, name string) ([]string, error)
+}
+
+// Resolve returns the IPFS path name points at, without the /ipfs/ prefix,
+// e.g. "<CID>" or "<CID>/sub/path".
+func (r *Resolver) Resolve(ctx context.Context, name string) (string, error) {
+	suffix := ""
+	for depth := 0; depth < maxDepth; depth++ {
+		if first, rest, ok := strings.Cut(name, "/"); ok {
+			name, suffix = first, joinPath(rest, suffix)
+		}
+
+		var p string
+		var err error
+		if IsDomain(name) && r.LookupTXT != nil {
+			p, err = r.dnslink(ctx, name)
+		} else {
+			p, err = r.Names.ResolveName(ctx, name)
+		}
+		if err != nil {
+			return "", fmt.Errorf("error resolving %s: %w", name, err)
+		}
+
+		switch {
+		case strings.HasPrefix(p, "/ipfs/"):
+			return joinPath(strings.TrimPrefix(p, "/ipfs/"), suffix), nil
+		case strings.HasPrefix(p, "/ipns/"):
+			name = strings.TrimPrefix(p, "/ipns/")
+		default:
+			return "", fmt.Errorf("error resolving %s: unexpected path %q", name, p)
+		}
+	}
+	return "", fmt.Errorf("error resolving %s: more than %d levels of indirection", name, maxDepth)
+}
+
+// dnslink looks up the dnslink= TXT record of domain, at _dnslink.<domain>
+// or, for older setups, the domain itself.
+func (r *Resolver) dnslink(ctx context.Context, domain string) (string, error) {
+	for _, host := range []string{"_dnslink." + domain, domain} {
+		records, err := r.LookupTXT(ctx, host)
+		if err != nil {
+			continue
+		}
+		var links []string
+		for _, rec := range records {
+			if link, ok := strings.CutPrefix(strings.TrimSpace(rec), "dnslink="); ok {
+				links = append(links, link)
+			}
+		}
+		if len(links) > 0 {
+			// Several records are a misconfiguration; pick one predictably.
+			sort.Strings(links)
+			return links[0], nil
+		}
+	}
+	return "", fmt.Errorf("%w: no dnslink TXT record for %s", ErrNotFound, domain)
+}
+
+// IsDomain reports whether name is a DNSLink domain rather than an IPNS
+// key. Keys never contain dots.
+func IsDomain(name string) bool {
+	return strings.Contains(name, ".")
+}
+
+func joinPath(p, suffix string) string {
+	p = strings.TrimSuffix(p, "/")
+	if suffix == "" {
+		return p
+	}
+	return p + "/" + suffix
+}
+
+// Gateway resolves names by asking an IPFS gateway for /ipns/<name> and
+// reading the root CID from the X-Ipfs-Roots header. Gateways resolve
+// DNSLink domains too.
+type Gateway struct {
+	URL    string
+	Client *http.Client
+	// Wait, if set, is called with the gateway's host before each request
+	// and may block, e.g. for a rate limit. An error stops the request.
+	Wait func(ctx context.Context, host string) error
+}
+
+func (g *Gateway) ResolveName(ctx context.Context, name string) (string, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodHead, strings.TrimRight(g.URL, "/")+"/ipns/"+url.PathEscape(name)+"/", nil)
+	if err != nil {
+		return "", fmt.Errorf("error building request: %w", err)
+	}
+	if g.Wait != nil {
+		if err := g.Wait(ctx, req.URL.Host); err != nil {
+			return "", fmt.Errorf("error waiting for gateway: %w", err)
+		}
+	}
+	resp, err := g.Client.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("error querying gateway: %w", err)
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		return "", ErrNotFound
+	}
+	if resp.StatusCode >= 400 {
+		return "", fmt.Errorf("unexpected status %d from gateway", resp.StatusCode)
+	}
+	if roots := resp.Header.Get("X-Ipfs-Roots"); roots != "" {
+		return "/ipfs/" + strings.TrimSpace(strings.Split(roots, ",")[0]), nil
+	}
+	if p := resp.Header.Get("X-Ipfs-Path"); strings.HasPrefix(p, "/ipfs/") {
+		return p, nil
+	}
+	return "", errors.New("gateway response has no X-Ipfs-Roots header")
+}
+
+// RPC resolves names with the name/resolve call of a Kubo node's RPC API,
+// e.g. http://127.0.0.1:5001.
+type RPC struct {
+	URL    string
+	Client *http.Client
+}
+
+func (c *RPC) ResolveName(ctx context.Context, name string) (string, error) {
+	q := url.Values{"arg": {"/ipns/" + name}, "recursive": {"true"}}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, strings.TrimRight(c.URL, "/")+"/api/v0/name/resolve?"+q.Encode(), nil)
+	if err != nil {
+		return "", fmt.Errorf("error building request: %w", err)
+	}
+	resp, err := c.Client.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("error querying resolver: %w", err)
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 64<<10))
+	if err != nil {
+		return "", fmt.Errorf("error reading resolver response: %w", err)
+	}
+	var res struct {
+		Path    string
+		Message string
+	}
+	if err := json.Unmarshal(body, &res); err != nil {
+		return "", fmt.Errorf("error decoding resolver response: %w", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		if strings.Contains(res.Message, "not found") || strings.Contains(res.Message, "could not resolve") {
+			return "", fmt.Errorf("%w: %s", ErrNotFound, res.Message)
+		}
+		return "", fmt.Errorf("unexpected status %d from resolver: %s", resp.StatusCode, res.Message)
+	}
+	return res.Path, nil
+}
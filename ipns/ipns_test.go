@@ -0,0 +1,93 @@
+package ipns
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// fakeNames stands in for a gateway or Kubo node.
+type fakeNames map[string]string
+
+func (f fakeNames) ResolveName(ctx context.Context, name string) (string, error) {
+	if p, ok := f[name]; ok {
+		return p, nil
+	}
+	return "", ErrNotFound
+}
+
+// fakeDNS stands in for DNS TXT lookups.
+type fakeDNS map[string][]string
+
+func (f fakeDNS) LookupTXT(ctx context.Context, name string) ([]string, error) {
+	if records, ok := f[name]; ok {
+		return records, nil
+	}
+	return nil, errors.New("no such host")
+}
+
+func TestResolve(t *testing.T) {
+	r := &Resolver{
+		Names: fakeNames{
+			"k51key":   "/ipfs/bafyroot",
+			"k51chain": "/ipns/k51key/meta",
+		},
+		LookupTXT: fakeDNS{
+			"_dnslink.apes.example": {"v=spf1 -all", "dnslink=/ipfs/bafyapes"},
+			"legacy.example":        {"dnslink=/ipns/k51key"},
+			"_dnslink.loop.example": {"dnslink=/ipns/loop.example"},
+		}.LookupTXT,
+	}
+	tests := map[string]string{
+		"k51key":           "bafyroot",
+		"k51key/1.json":    "bafyroot/1.json",
+		"k51chain/2":       "bafyroot/meta/2",
+		"apes.example/3":   "bafyapes/3",
+		"legacy.example/4": "bafyroot/4",
+	}
+	for name, want := range tests {
+		got, err := r.Resolve(context.Background(), name)
+		if err != nil || got != want {
+			t.Errorf("Resolve(%q) = %q, %v; want %q", name, got, err, want)
+		}
+	}
+
+	if _, err := r.Resolve(context.Background(), "k51missing"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("missing key: got %v, want ErrNotFound", err)
+	}
+	if _, err := r.Resolve(context.Background(), "nothing.example"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("missing domain: got %v, want ErrNotFound", err)
+	}
+	if _, err := r.Resolve(context.Background(), "loop.example"); err == nil {
+		t.Error("expected an error for a DNSLink loop")
+	}
+}
+
+func TestGatewayWaits(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Ipfs-Roots", "bafyroot,bafychild")
+	}))
+	defer srv.Close()
+
+	var waited []string
+	g := &Gateway{URL: srv.URL, Client: srv.Client(), Wait: func(ctx context.Context, host string) error {
+		waited = append(waited, host)
+		return nil
+	}}
+	p, err := g.ResolveName(context.Background(), "k51key")
+	if err != nil || p != "/ipfs/bafyroot" {
+		t.Fatalf("ResolveName = %q, %v", p, err)
+	}
+	if want := strings.TrimPrefix(srv.URL, "http://"); len(waited) != 1 || waited[0] != want {
+		t.Errorf("waited for %v, want [%s]", waited, want)
+	}
+
+	stop := errors.New("budget exhausted")
+	g.Wait = func(context.Context, string) error { return stop }
+	if _, err := g.ResolveName(context.Background(), "k51key"); !errors.Is(err, stop) {
+		t.Errorf("ResolveName after a failed wait = %v, want %v", err, stop)
+	}
+}
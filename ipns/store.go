@@ -0,0 +1,74 @@
+package ipns
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"time"
+)
+
+// Name is a resolved name as stored in the ipns_names table.
+type Name struct {
+	Name string `json:"name"`
+	// Path is what the name last resolved to, e.g. "<CID>/sub".
+	Path       string    `json:"path"`
+	ResolvedAt time.Time `json:"resolved_at"`
+	// ChangedAt is when Path last changed.
+	ChangedAt time.Time `json:"changed_at"`
+}
+
+func CreateTable(db *sql.DB) error {
+	_, err := db.Exec(`
+        CREATE TABLE IF NOT EXISTS ipns_names (
+            name TEXT PRIMARY KEY,
+            path TEXT NOT NULL,
+            resolved_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+            changed_at TIMESTAMPTZ NOT NULL DEFAULT now()
+        )
+    `)
+	if err != nil {
+		return fmt.Errorf("error creating ipns table: %w", err)
+	}
+	return nil
+}
+
+// Save records that name resolved to path. It reports whether that is new:
+// the first time the name was seen or a different path from last time.
+func Save(ctx context.Context, db *sql.DB, name, path string) (changed bool, err error) {
+	// now() is the same throughout a transaction, so changed_at equals
+	// resolved_at exactly when this statement set it.
+	err = db.QueryRowContext(ctx, `
+        INSERT INTO ipns_names (name, path) VALUES ($1, $2)
+        ON CONFLICT (name) DO UPDATE SET
+        path = EXCLUDED.path,
+        resolved_at = now(),
+        changed_at = CASE WHEN ipns_names.path <> EXCLUDED.path THEN now() ELSE ipns_names.changed_at END
+        RETURNING changed_at = resolved_at`,
+		name, path).Scan(&changed)
+	if err != nil {
+		return false, fmt.Errorf("error saving name %s: %w", name, err)
+	}
+	return changed, nil
+}
+
+// List returns every stored name ordered by name.
+func List(ctx context.Context, db *sql.DB) ([]Name, error) {
+	rows, err := db.QueryContext(ctx, `SELECT name, path, resolved_at, changed_at FROM ipns_names ORDER BY name`)
+	if err != nil {
+		return nil, fmt.Errorf("error querying names: %w", err)
+	}
+	defer rows.Close()
+
+	var names []Name
+	for rows.Next() {
+		var n Name
+		if err := rows.Scan(&n.Name, &n.Path, &n.ResolvedAt, &n.ChangedAt); err != nil {
+			return nil, fmt.Errorf("error scanning row: %w", err)
+		}
+		names = append(names, n)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error reading rows: %w", err)
+	}
+	return names, nil
+}
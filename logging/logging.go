@@ -0,0 +1,94 @@
+package logging
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"strings"
+)
+
+// Field names shared by every log line, so the same key always means the
+// same thing in the log aggregator.
+const (
+	CID     = "cid"
+	Gateway = "gateway"
+	JobID   = "job_id"
+	Attempt = "attempt"
+	// QueueAttempt is how many times a queue item has been leased, as
+	// opposed to Attempt, the request within one lease.
+	QueueAttempt = "queue_attempt"
+	Duration     = "duration"
+	Status       = "status"
+	RequestID    = "request_id"
+)
+
+// RequestIDHeader is read from incoming API requests and echoed back on
+// the response.
+const RequestIDHeader = "X-Request-ID"
+
+type loggerKey struct{}
+
+// Setup installs the default slog logger. level is debug, info, warn or
+// error; format is text or json. The standard log package is routed
+// through the same handler.
+func Setup(w io.Writer, level, format string) error {
+	var lvl slog.Level
+	if err := lvl.UnmarshalText([]byte(level)); err != nil {
+		return fmt.Errorf("invalid log level %q: %w", level, err)
+	}
+
+	opts := &slog.HandlerOptions{Level: lvl}
+	var h slog.Handler
+	switch strings.ToLower(format) {
+	case "text":
+		h = slog.NewTextHandler(w, opts)
+	case "json":
+		h = slog.NewJSONHandler(w, opts)
+	default:
+		return fmt.Errorf("invalid log format %q: want text or json", format)
+	}
+
+	slog.SetDefault(slog.New(h))
+	return nil
+}
+
+// With returns a copy of ctx whose logger carries args, e.g. the CID being
+// processed, so everything logged further down includes them.
+func With(ctx context.Context, args ...any) context.Context {
+	return context.WithValue(ctx, loggerKey{}, From(ctx).With(args...))
+}
+
+// From returns the logger stored in ctx, or the default logger.
+func From(ctx context.Context) *slog.Logger {
+	if l, ok := ctx.Value(loggerKey{}).(*slog.Logger); ok {
+		return l
+	}
+	return slog.Default()
+}
+
+// RequestIDMiddleware gives every request an ID, taken from the
+// X-Request-ID header when the caller sent one, and attaches it to the
+// request's logger and response headers.
+func RequestIDMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(RequestIDHeader)
+		if id == "" {
+			id = newRequestID()
+		}
+		w.Header().Set(RequestIDHeader, id)
+		ctx := With(r.Context(), RequestID, id)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+func newRequestID() string {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return "unknown"
+	}
+	return hex.EncodeToString(b)
+}
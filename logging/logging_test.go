@@ -0,0 +1,54 @@
+package logging
+
+import (
+	"bytes"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestRequestIDMiddleware(t *testing.T) {
+	var buf bytes.Buffer
+	if err := Setup(&buf, "info", "json"); err != nil {
+		t.Fatal(err)
+	}
+	defer slog.SetDefault(slog.New(slog.NewTextHandler(&bytes.Buffer{}, nil)))
+
+	h := RequestIDMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		From(r.Context()).Info("hello", CID, "bafy")
+	}))
+
+	req := httptest.NewRequest(http.MethodGet, "/tokens", nil)
+	req.Header.Set(RequestIDHeader, "abc123")
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+
+	if got := rec.Header().Get(RequestIDHeader); got != "abc123" {
+		t.Errorf("response %s = %q, want abc123", RequestIDHeader, got)
+	}
+
+	var line map[string]any
+	if err := json.Unmarshal(buf.Bytes(), &line); err != nil {
+		t.Fatalf("log line is not JSON: %v: %s", err, buf.String())
+	}
+	if line[RequestID] != "abc123" || line[CID] != "bafy" {
+		t.Errorf("log line = %v, want request_id and cid fields", line)
+	}
+
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/tokens", nil))
+	if rec.Header().Get(RequestIDHeader) == "" {
+		t.Error("a request ID should be generated when none is sent")
+	}
+}
+
+func TestSetupRejectsBadConfig(t *testing.T) {
+	if err := Setup(&bytes.Buffer{}, "loud", "text"); err == nil {
+		t.Error("expected error for unknown level")
+	}
+	if err := Setup(&bytes.Buffer{}, "info", "xml"); err == nil {
+		t.Error("expected error for unknown format")
+	}
+}
@@ -1,65 +1,284 @@
 package main
 
 import (
+	"bytes"
 	"context"
+	"crypto/sha256"
 	"database/sql"
-	"encoding/csv"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"io"
-	"log"
+	"log/slog"
+	"math/rand"
+	"net"
 	"net/http"
+	"net/url"
 	"os"
+	"sort"
+	"strconv"
+	"strings"
 	"sync"
+	"time"
 
 	"github.com/coffeendude/ipfs-cids-go-scraper/api"
+	"github.com/coffeendude/ipfs-cids-go-scraper/arweave"
+	"github.com/coffeendude/ipfs-cids-go-scraper/assets"
+	"github.com/coffeendude/ipfs-cids-go-scraper/collection"
+	"github.com/coffeendude/ipfs-cids-go-scraper/concurrency"
+	"github.com/coffeendude/ipfs-cids-go-scraper/input"
+	"github.com/coffeendude/ipfs-cids-go-scraper/ipld"
+	"github.com/coffeendude/ipfs-cids-go-scraper/ipns"
+	"github.com/coffeendude/ipfs-cids-go-scraper/logging"
+	"github.com/coffeendude/ipfs-cids-go-scraper/mapping"
 	"github.com/coffeendude/ipfs-cids-go-scraper/metadata"
+	"github.com/coffeendude/ipfs-cids-go-scraper/metrics"
+	"github.com/coffeendude/ipfs-cids-go-scraper/progress"
+	"github.com/coffeendude/ipfs-cids-go-scraper/ratelimit"
+	"github.com/coffeendude/ipfs-cids-go-scraper/report"
+	"github.com/coffeendude/ipfs-cids-go-scraper/resolve"
+	"github.com/coffeendude/ipfs-cids-go-scraper/schema"
+	"github.com/coffeendude/ipfs-cids-go-scraper/search"
+	"github.com/coffeendude/ipfs-cids-go-scraper/sniff"
+	"github.com/coffeendude/ipfs-cids-go-scraper/tracing"
+	"github.com/coffeendude/ipfs-cids-go-scraper/unixfs"
 
 	_ "github.com/lib/pq"
+	"go.opentelemetry.io/otel/attribute"
+	semconv "go.opentelemetry.io/otel/semconv/v1.21.0"
 )
 
 const (
-	NumWorkers  = 10
-	CIDFilePath = "ipfs_cids.csv"
+	NumWorkers     = 10
+	CIDFilePath    = "ipfs_cids.csv"
+	DefaultGateway = "https://ipfs.io"
+	// DefaultMaxBodySize is far above any real metadata document but
+	// keeps one hostile CID from exhausting memory.
+	DefaultMaxBodySize = 32 << 20
+)
+
+// Values of -non-metadata.
+const (
+	nonMetadataStore = "store"
+	nonMetadataFail  = "fail"
 )
 
 func main() {
-	host := flag.String("host", "localhost", "Database host")
-	port := flag.String("port", "5432", "Database port")
-	user := flag.String("user", "postgres", "Database user")
-	password := flag.String("password", "example", "Database password")
-	dbname := flag.String("dbname", "postgres", "Database name")
-	sslmode := flag.String("sslmode", "disable", "SSL mode")
-	flag.Parse()
+	if err := run(os.Args[1:]); err != nil {
+		var ce *commandError
+		switch {
+		case errors.Is(err, errTooManyFailures):
+			// finishRun has said why.
+		case errors.As(err, &ce):
+			slog.Error(ce.msg, "error", ce.err)
+		default:
+			slog.Error("Error", "error", err)
+		}
+		os.Exit(1)
+	}
+}
+
+// run runs the subcommand named by args[0], or else the default command.
+// Subcommands return their error rather than exiting, so that their
+// deferred cleanup, such as flushing traces, always runs.
+func run(args []string) error {
+	if len(args) > 0 {
+		switch args[0] {
+		case "scrape":
+			return runScrape(args[1:])
+		case "status":
+			return runStatus(args[1:])
+		case "export":
+			return runExport(args[1:])
+		case "import":
+			return runImport(args[1:])
+		case "collections":
+			return runCollections(args[1:])
+		case "validate":
+			return runValidate(args[1:])
+		case "remap":
+			return runRemap(args[1:])
+		case "ipns":
+			return runIPNS(args[1:])
+		}
+	}
+	return runDefault(args)
+}
 
-	db, err := connectToDB(*host, *port, *user, *password, *dbname, *sslmode)
+// runDefault implements the default command: it scrapes the CID file into
+// a fresh metadata table, prints the results and serves the API.
+func runDefault(args []string) error {
+	fs := flag.NewFlagSet(os.Args[0], flag.ExitOnError)
+	var dbc dbConfig
+	var sc scrapeConfig
+	var ic inputConfig
+	var tc traceConfig
+	var lc logConfig
+	dbc.register(fs)
+	sc.register(fs)
+	ic.register(fs)
+	tc.register(fs)
+	lc.register(fs)
+	fs.Parse(args)
+
+	lc.setup()
+	defer tc.setup()()
+
+	inputSchema, err := ic.schema()
+	if err != nil {
+		return fail("Error reading flags", err)
+	}
+
+	db, err := dbc.connect()
 	if err != nil {
-		log.Fatalf("Error connecting to database: %v", err)
+		return fail("Error connecting to database", err)
 	}
 	defer db.Close()
 
 	if err := createMetadataTable(db); err != nil {
-		log.Fatalf("Error creating table: %v", err)
+		return fail("Error creating table", err)
+	}
+	// Search falls back to scanning the table without the index.
+	if err := search.CreateIndex(db); err != nil {
+		slog.Warn("Full-text index unavailable, searching by table scan", "error", err)
+	}
+	if err := progress.CreateTable(db); err != nil {
+		return fail("Error creating jobs table", err)
 	}
 
-	cids, err := readCIDsFromFile(CIDFilePath)
-	if err != nil {
-		log.Fatalf("Error reading CSV: %v", err)
+	if err := collection.CreateTables(db); err != nil {
+		return fail("Error creating collection tables", err)
+	}
+	if err := ipns.CreateTable(db); err != nil {
+		return fail("Error creating ipns table", err)
+	}
+	if err := schema.CreateTable(db); err != nil {
+		return fail("Error creating validations table", err)
 	}
 
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 
-	if err := fetchAndStoreMetadata(ctx, db, cids); err != nil {
-		log.Fatalf("Error fetching and storing metadata: %v", err)
+	rows, err := loadInput(ctx, db, CIDFilePath, inputSchema)
+	if err != nil {
+		return fail("Error reading CSV", err)
+	}
+
+	s, err := sc.newScraper(db)
+	if err != nil {
+		return fail("Error configuring scraper", err)
+	}
+	cids := s.inputCIDs(rows)
+
+	jobID := newJobID()
+	ctx = logging.With(ctx, logging.JobID, jobID)
+	stopProgress := s.startProgress(jobID, db)
+	err = s.fetchAndStoreMetadata(ctx, cids)
+	stopProgress()
+	if err != nil {
+		return fail("Error fetching and storing metadata", err)
 	}
 
 	if err := printMetadata(db); err != nil {
-		log.Fatalf("Error printing metadata: %v", err)
+		return fail("Error printing metadata", err)
+	}
+	// The API is served even if too many CIDs failed; finishRun has
+	// reported that.
+	if err := s.finishRun(); err != nil && !errors.Is(err, errTooManyFailures) {
+		return err
+	}
+
+	if err := api.StartServer(db, s.blobs); err != nil {
+		return fail("Error starting server", err)
+	}
+	return nil
+}
+
+// dbConfig holds the database connection flags shared by every subcommand.
+type dbConfig struct {
+	host, port, user, password, dbname, sslmode string
+}
+
+func (c *dbConfig) register(fs *flag.FlagSet) {
+	fs.StringVar(&c.host, "host", "localhost", "Database host")
+	fs.StringVar(&c.port, "port", "5432", "Database port")
+	fs.StringVar(&c.user, "user", "postgres", "Database user")
+	fs.StringVar(&c.password, "password", "example", "Database password")
+	fs.StringVar(&c.dbname, "dbname", "postgres", "Database name")
+	fs.StringVar(&c.sslmode, "sslmode", "disable", "SSL mode")
+}
+
+func (c *dbConfig) connect() (*sql.DB, error) {
+	return connectToDB(c.host, c.port, c.user, c.password, c.dbname, c.sslmode)
+}
+
+// logConfig holds the logging flags.
+type logConfig struct {
+	level, format string
+}
+
+func (c *logConfig) register(fs *flag.FlagSet) {
+	fs.StringVar(&c.level, "log-level", "info", "Log level: debug, info, warn or error")
+	fs.StringVar(&c.format, "log-format", "text", "Log format: text or json")
+}
+
+func (c *logConfig) setup() {
+	if err := logging.Setup(os.Stderr, c.level, c.format); err != nil {
+		fatal("Error setting up logging", err)
 	}
+}
+
+// fatal logs err and exits. It is only for setup that comes before any
+// cleanup is deferred; later failures are returned with fail.
+func fatal(msg string, err error) {
+	slog.Error(msg, "error", err)
+	os.Exit(1)
+}
+
+// commandError is the error a subcommand fails with: msg says what it was
+// doing, as in the log line main writes for it.
+type commandError struct {
+	msg string
+	err error
+}
+
+func (e *commandError) Error() string { return e.msg + ": " + e.err.Error() }
 
-	api.StartServer(db)
+func (e *commandError) Unwrap() error { return e.err }
+
+// fail returns err as the error of a subcommand, to be logged with msg.
+func fail(msg string, err error) error {
+	return &commandError{msg: msg, err: err}
+}
+
+// traceConfig holds the OpenTelemetry exporter flags.
+type traceConfig struct {
+	cfg tracing.Config
+}
+
+func (c *traceConfig) register(fs *flag.FlagSet) {
+	fs.StringVar(&c.cfg.Exporter, "trace-exporter", tracing.ExporterNone, "Trace exporter: none, stdout, file or otlp")
+	fs.StringVar(&c.cfg.File, "trace-file", "traces.json", "File spans are written to with -trace-exporter=file")
+	fs.StringVar(&c.cfg.Endpoint, "otlp-endpoint", "", "OTLP/HTTP collector host:port (defaults to OTEL_EXPORTER_OTLP_* settings)")
+	fs.BoolVar(&c.cfg.Insecure, "otlp-insecure", false, "Send OTLP traces over plain HTTP")
+}
+
+// setup installs the tracer provider. The returned function flushes any
+// buffered spans and should be deferred by the caller.
+func (c *traceConfig) setup() func() {
+	shutdown, err := tracing.Setup(context.Background(), c.cfg)
+	if err != nil {
+		fatal("Error setting up tracing", err)
+	}
+	return func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := shutdown(ctx); err != nil {
+			slog.Error("Error flushing traces", "error", err)
+		}
+	}
 }
 
 func connectToDB(host, port, user, password, dbname, sslmode string) (*sql.DB, error) {
@@ -78,14 +297,46 @@ func createMetadataTable(db *sql.DB) error {
 		return fmt.Errorf("error dropping table: %w", err)
 	}
 
-	_, err = db.Exec(`
-		
-        CREATE TABLE metadata (
+	return ensureMetadataTable(db)
+}
+
+// tableExists reports whether table exists, for commands that only read
+// and so mustn't create it.
+func tableExists(ctx context.Context, db *sql.DB, table string) (bool, error) {
+	var exists bool
+	if err := db.QueryRowContext(ctx, "SELECT to_regclass($1) IS NOT NULL", table).Scan(&exists); err != nil {
+		return false, fmt.Errorf("error checking for table %s: %w", table, err)
+	}
+	return exists, nil
+}
+
+// ensureMetadataTable creates the metadata table if it is missing, leaving
+// existing rows alone. Queue workers use it so that one replica starting up
+// doesn't wipe the results of the others.
+func ensureMetadataTable(db *sql.DB) error {
+	_, err := db.Exec(`
+        CREATE TABLE IF NOT EXISTS metadata (
             cid TEXT PRIMARY KEY,
             image TEXT,
             description TEXT,
-            name TEXT
-        )
+            name TEXT,
+            attributes JSONB NOT NULL DEFAULT '[]',
+            token_uri TEXT,
+            source_scheme TEXT,
+            source_network TEXT,
+            animation_url TEXT,
+            media_type TEXT,
+            linked_cids JSONB,
+            raw JSONB
+        );
+        ALTER TABLE metadata ADD COLUMN IF NOT EXISTS attributes JSONB NOT NULL DEFAULT '[]';
+        ALTER TABLE metadata ADD COLUMN IF NOT EXISTS token_uri TEXT;
+        ALTER TABLE metadata ADD COLUMN IF NOT EXISTS source_scheme TEXT;
+        ALTER TABLE metadata ADD COLUMN IF NOT EXISTS source_network TEXT;
+        ALTER TABLE metadata ADD COLUMN IF NOT EXISTS animation_url TEXT;
+        ALTER TABLE metadata ADD COLUMN IF NOT EXISTS media_type TEXT;
+        ALTER TABLE metadata ADD COLUMN IF NOT EXISTS linked_cids JSONB;
+        ALTER TABLE metadata ADD COLUMN IF NOT EXISTS raw JSONB
     `)
 	if err != nil {
 		return fmt.Errorf("error creating table: %w", err)
@@ -94,36 +345,442 @@ func createMetadataTable(db *sql.DB) error {
 }
 
 func readCIDsFromFile(filePath string) ([]string, error) {
-	file, err := os.Open(filePath)
+	rows, err := input.ReadFile(filePath, input.Schema{})
 	if err != nil {
-		return nil, fmt.Errorf("error opening file: %w", err)
+		return nil, err
+	}
+	var cids []string
+	for _, row := range rows {
+		cids = append(cids, row.Cid)
 	}
-	defer file.Close()
+	return cids, nil
+}
 
-	reader := csv.NewReader(file)
-	lines, err := reader.ReadAll()
+// inputConfig holds the flags that describe the layout of the CID file.
+type inputConfig struct {
+	delimiter, header, columns string
+}
+
+func (c *inputConfig) register(fs *flag.FlagSet) {
+	fs.StringVar(&c.delimiter, "input-delimiter", ",", `Column delimiter of the CID file: one character, or "tab"`)
+	fs.StringVar(&c.header, "input-header", input.HeaderAuto, "Whether the CID file starts with a header line: auto, yes or no")
+	fs.StringVar(&c.columns, "input-columns", "", "CID file columns as field=name or field=number, comma-separated; fields are cid, token_uri, token_id, collection and priority")
+}
+
+func (c *inputConfig) schema() (input.Schema, error) {
+	delimiter, err := input.ParseDelimiter(c.delimiter)
+	if err != nil {
+		return input.Schema{}, err
+	}
+	columns, err := input.ParseColumns(c.columns)
 	if err != nil {
-		return nil, fmt.Errorf("error reading CSV: %w", err)
+		return input.Schema{}, err
 	}
+	return input.Schema{Delimiter: delimiter, Header: c.header, Columns: columns}, nil
+}
 
-	var cids []string
-	for _, line := range lines {
-		cids = append(cids, line[0])
+// loadInput reads the CID file, highest priority first, and links the rows
+// that name a collection to their token.
+func loadInput(ctx context.Context, db *sql.DB, filePath string, schema input.Schema) ([]input.Row, error) {
+	rows, err := input.ReadFile(filePath, schema)
+	if err != nil {
+		return nil, err
 	}
-	return cids, nil
+	input.SortByPriority(rows)
+	for _, row := range rows {
+		if row.Collection != "" {
+			if err := collection.Link(ctx, db, row.Collection, row.TokenID, row.Cid); err != nil {
+				return nil, fmt.Errorf("error on line %d: %w", row.Line, err)
+			}
+		}
+	}
+	return rows, nil
+}
+
+// scrapeConfig holds the flags that tune how CIDs are fetched.
+type scrapeConfig struct {
+	gateways       string
+	minConcurrency int
+	maxConcurrency int
+	latencyTarget  time.Duration
+	rateLimits     string
+	dailyBudget    int
+	retries        int
+	reportJSON     string
+	maxFailures    float64
+	progressEvery  time.Duration
+	arweaveGateway string
+	ipnsResolver   string
+	assetsDir      string
+	nonMetadata    string
+	maxBodySize    int64
+	validate       string
+}
+
+func (c *scrapeConfig) register(fs *flag.FlagSet) {
+	fs.StringVar(&c.gateways, "gateways", DefaultGateway, "Comma-separated list of IPFS gateway base URLs")
+	fs.IntVar(&c.minConcurrency, "min-concurrency", 1, "Minimum concurrent requests per gateway")
+	fs.IntVar(&c.maxConcurrency, "max-concurrency", NumWorkers, "Maximum concurrent requests per gateway")
+	fs.DurationVar(&c.latencyTarget, "latency-target", 2*time.Second, "Gateway latency above which concurrency is reduced")
+	fs.StringVar(&c.rateLimits, "rate-limits", "", "Per-gateway request rates as host=rps[:burst], comma-separated; * sets the default")
+	fs.IntVar(&c.dailyBudget, "daily-budget", 0, "Maximum gateway requests per UTC day (0 means unlimited)")
+	fs.IntVar(&c.retries, "retries", 2, "Retries for a CID after a 429, 5xx or connection error")
+	fs.StringVar(&c.reportJSON, "report-json", "", "Also write the end-of-run report as JSON to this file")
+	fs.Float64Var(&c.maxFailures, "max-failure-ratio", 1, "Exit non-zero when the share of failed CIDs exceeds this ratio")
+	fs.DurationVar(&c.progressEvery, "progress-interval", 10*time.Second, "How often progress is logged and saved when not on a terminal")
+	fs.StringVar(&c.arweaveGateway, "arweave-gateway", arweave.DefaultGateway, "Arweave gateway base URL for ar:// token URIs")
+	fs.StringVar(&c.assetsDir, "assets-dir", "", "Archive each document's image and animation_url into this directory (disabled if empty)")
+	fs.Int64Var(&c.maxBodySize, "max-body-size", DefaultMaxBodySize, "Largest response body read, in bytes, for documents and assets alike (0 means no limit)")
+	fs.StringVar(&c.validate, "validate", "", "Validate each document against its collection's schema, or else this one: erc721, erc1155 or a schema file (disabled if empty)")
+	fs.StringVar(&c.nonMetadata, "non-metadata", nonMetadataStore, `What to do with bodies that aren't metadata, such as images or web pages: "store" their media type, or "fail" the CID`)
+	fs.StringVar(&c.ipnsResolver, "ipns-resolver", "gateway", `How IPNS names are resolved: "gateway" to ask the first of -gateways, or the URL of a Kubo RPC API`)
+}
+
+func (c *scrapeConfig) newScraper(db *sql.DB) (*scraper, error) {
+	var gateways []string
+	for _, gw := range strings.Split(c.gateways, ",") {
+		if gw = strings.TrimRight(strings.TrimSpace(gw), "/"); gw != "" {
+			gateways = append(gateways, gw)
+		}
+	}
+	if len(gateways) == 0 {
+		return nil, errors.New("-gateways is empty: at least one gateway URL is required")
+	}
+	rates, err := ratelimit.ParseRates(c.rateLimits)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing rate limits: %w", err)
+	}
+
+	s := newScraper(db, concurrency.NewGroup(gateways, c.minConcurrency, c.maxConcurrency, c.latencyTarget))
+	s.limiter = ratelimit.New(rates, c.dailyBudget)
+	if err := ratelimit.CreateTable(db); err != nil {
+		return nil, err
+	}
+	// Replicas and later runs share the budget and back-off.
+	s.limiter.Share(ratelimit.NewDB(db))
+	s.retries = c.retries
+	s.reportJSON = c.reportJSON
+	s.maxFailures = c.maxFailures
+	s.progressInterval = c.progressEvery
+	s.arweave.Gateway = strings.TrimRight(c.arweaveGateway, "/")
+	s.maxBodySize = c.maxBodySize
+	switch c.nonMetadata {
+	case nonMetadataStore:
+		s.storeNonMetadata = true
+	case nonMetadataFail:
+	default:
+		return nil, fmt.Errorf("invalid -non-metadata %q: want %s or %s", c.nonMetadata, nonMetadataStore, nonMetadataFail)
+	}
+	if c.assetsDir != "" {
+		if err := assets.CreateTable(db); err != nil {
+			return nil, err
+		}
+		s.blobs = &assets.Blobs{Dir: c.assetsDir}
+	}
+	mp, err := newMapper(context.Background(), db)
+	if err != nil {
+		return nil, err
+	}
+	if len(mp.byCollection) > 0 {
+		s.mapper = mp
+	}
+	if c.validate != "" {
+		if s.validator, err = newValidator(context.Background(), db, c.validate); err != nil {
+			return nil, err
+		}
+	}
+	if c.ipnsResolver != "gateway" {
+		s.ipns.Names = &ipns.RPC{URL: c.ipnsResolver, Client: s.client}
+	} else if len(gateways) > 0 {
+		s.ipns.Names = s.nameGateway(gateways[0])
+	}
+	return s, nil
+}
+
+// scraper holds the state shared by every worker in a crawl.
+type scraper struct {
+	db       *sql.DB
+	client   *http.Client
+	gateways *concurrency.Group
+	limiter  *ratelimit.Limiter
+	retries  int
+	// maxBodySize caps the response bodies read, or 0 for no limit.
+	maxBodySize int64
+	// storeNonMetadata records bodies that aren't metadata by their media
+	// type instead of failing them.
+	storeNonMetadata bool
+	arweave          *arweave.Resolver
+	ipns             *ipns.Resolver
+	// names caches what each IPNS name resolved to during this run.
+	names sync.Map
+
+	// mapper fills the fields of documents whose collection has a mapping
+	// file, or is nil if none has.
+	mapper *mapper
+	// validator checks documents as they are stored, or is nil.
+	validator *validator
+
+	// blobs is where assets are archived, or nil if they aren't.
+	blobs *assets.Blobs
+	// archived caches the asset fetched for each URI during this run, as
+	// many tokens often share one image.
+	archived sync.Map
+	// assetQueue holds the documents whose assets are waiting to be
+	// archived, or is nil when no archive workers are running.
+	assetQueue chan *metadata.Metadata
+
+	report      *report.Recorder
+	reportJSON  string
+	maxFailures float64
+
+	progress         *progress.Tracker
+	progressInterval time.Duration
+
+	// tokenURIs maps a CID to the token URI the input gave for it, so
+	// that it is stored with the metadata. Workers remove a CID's entry
+	// once it has been fetched.
+	tokenURIs sync.Map
+}
+
+func newScraper(db *sql.DB, gateways *concurrency.Group) *scraper {
+	s := &scraper{
+		db:          db,
+		client:      http.DefaultClient,
+		gateways:    gateways,
+		limiter:     ratelimit.New(nil, 0),
+		report:      report.NewRecorder(),
+		maxFailures: 1,
+		maxBodySize: DefaultMaxBodySize,
+		progress:    progress.NewTracker(),
+	}
+	// Manifests are fetched like any other document, without retries of
+	// their own: a failed lookup fails the token, which is retried whole.
+	s.arweave = &arweave.Resolver{
+		Gateway: arweave.DefaultGateway,
+		Fetch: func(ctx context.Context, url string) ([]byte, error) {
+			return s.fetchURL(ctx, url, 0)
+		},
+	}
+	s.ipns = &ipns.Resolver{
+		Names:     s.nameGateway(DefaultGateway),
+		LookupTXT: net.DefaultResolver.LookupTXT,
+	}
+	return s
+}
+
+// nameGateway returns a resolver for IPNS names that asks the gateway at
+// url, within the gateway's rate limit.
+func (s *scraper) nameGateway(url string) *ipns.Gateway {
+	return &ipns.Gateway{
+		URL:    url,
+		Client: s.client,
+		Wait: func(ctx context.Context, host string) error {
+			return s.limiter.Wait(ctx, host)
+		},
+	}
+}
+
+// inputCIDs returns the CIDs of rows in order and remembers their token
+// URIs.
+func (s *scraper) inputCIDs(rows []input.Row) []string {
+	cids := make([]string, 0, len(rows))
+	for _, row := range rows {
+		if row.TokenURI != "" {
+			s.tokenURIs.Store(row.Cid, row.TokenURI)
+		}
+		cids = append(cids, row.Cid)
+	}
+	return cids
+}
+
+// startProgress reports progress on stderr until the returned function is
+// called. If db is not nil the progress is saved under jobID for the status
+// command.
+func (s *scraper) startProgress(jobID string, db *sql.DB) func() {
+	r := &progress.Reporter{
+		JobID:    jobID,
+		Tracker:  s.progress,
+		Out:      os.Stderr,
+		Interval: s.progressInterval,
+		DB:       db,
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		r.Run(ctx)
+	}()
+	return func() {
+		cancel()
+		<-done
+	}
+}
+
+// newJobID names a scrape run that wasn't given a job ID. The random
+// suffix keeps runs started in the same second apart.
+func newJobID() string {
+	return fmt.Sprintf("run-%s-%06x", time.Now().UTC().Format("20060102T150405Z"), rand.Intn(1<<24))
+}
+
+// inputJobID names the job of enqueued rows that weren't given a job ID.
+// It is derived from the CIDs, so enqueueing the same input again adds
+// nothing to the job.
+func inputJobID(rows []input.Row) string {
+	cids := make([]string, 0, len(rows))
+	for _, row := range rows {
+		cids = append(cids, row.Cid)
+	}
+	sort.Strings(cids)
+	h := sha256.New()
+	for _, cid := range cids {
+		io.WriteString(h, cid)
+		h.Write([]byte{0})
+	}
+	return "job-" + hex.EncodeToString(h.Sum(nil))[:16]
+}
+
+// errTooManyFailures is returned by finishRun when the failure ratio is
+// over -max-failure-ratio, so that the command exits non-zero.
+var errTooManyFailures = errors.New("failure ratio exceeds threshold")
+
+// finishRun prints the run report and writes it as JSON if asked to. It
+// returns errTooManyFailures, having logged it, if too many CIDs failed.
+func (s *scraper) finishRun() error {
+	summary := s.report.Summary()
+	if err := summary.WriteText(os.Stdout); err != nil {
+		slog.Error("Error printing report", "error", err)
+	}
+	if s.reportJSON != "" {
+		if err := summary.WriteJSONFile(s.reportJSON); err != nil {
+			return fail("Error writing report", err)
+		}
+	}
+	if summary.FailureRatio > s.maxFailures {
+		slog.Error("Failure ratio exceeds threshold",
+			"failure_ratio", summary.FailureRatio,
+			"max_failure_ratio", s.maxFailures)
+		return errTooManyFailures
+	}
+	return nil
+}
+
+// Error classes used to break down failures in the run report.
+const (
+	classThrottled   = "throttled"
+	classHTTP4xx     = "http_4xx"
+	classHTTP5xx     = "http_5xx"
+	classTimeout     = "timeout"
+	classNetwork     = "network"
+	classInvalidJSON = "invalid_json"
+	classParse       = "parse"
+	classStore       = "store"
+	classResolve     = "resolve"
+	classNotMetadata = "not_metadata"
+	classTooLarge    = "too_large"
+	classOther       = "other"
+)
+
+var (
+	errInvalidJSON = errors.New("invalid JSON")
+	errParse       = errors.New("error parsing metadata")
+	errStore       = errors.New("error storing metadata")
+	errResolve     = errors.New("error resolving token URI")
+	errNotMetadata = errors.New("body is not metadata")
+	errTooLarge    = errors.New("response too large")
+)
+
+// classify names the kind of failure err represents.
+func classify(err error) string {
+	var se *statusError
+	var ne net.Error
+	switch {
+	case errors.As(err, &se) && se.Status == http.StatusTooManyRequests:
+		return classThrottled
+	case se != nil && se.Status >= 500:
+		return classHTTP5xx
+	case se != nil:
+		return classHTTP4xx
+	case errors.Is(err, errInvalidJSON):
+		return classInvalidJSON
+	case errors.Is(err, errTooLarge):
+		return classTooLarge
+	case errors.Is(err, errNotMetadata):
+		return classNotMetadata
+	case errors.Is(err, errParse):
+		return classParse
+	case errors.Is(err, errStore):
+		return classStore
+	case errors.Is(err, errResolve), errors.Is(err, arweave.ErrPathNotFound):
+		return classResolve
+	case errors.Is(err, context.DeadlineExceeded), errors.As(err, &ne) && ne.Timeout():
+		return classTimeout
+	case ne != nil:
+		return classNetwork
+	}
+	return classOther
+}
+
+// skipped reports whether err means the CID was never really tried.
+func skipped(err error) bool {
+	return errors.Is(err, ratelimit.ErrBudgetExhausted) || errors.Is(err, context.Canceled)
+}
+
+// statusError is returned when a gateway answers with anything but 200.
+type statusError struct {
+	Cid        string
+	Host       string
+	Status     int
+	RetryAfter time.Duration
+}
+
+func (e *statusError) Error() string {
+	return fmt.Sprintf("unexpected status %d from %s for CID %s", e.Status, e.Host, e.Cid)
+}
+
+// retryable reports whether a failed fetch is worth another attempt:
+// throttling, server errors and network errors usually clear up, anything
+// else will fail the same way again.
+func retryable(err error) bool {
+	if errors.Is(err, ratelimit.ErrBudgetExhausted) || errors.Is(err, context.Canceled) {
+		return false
+	}
+	var se *statusError
+	if errors.As(err, &se) {
+		return se.Status == http.StatusTooManyRequests || se.Status >= 500
+	}
+	var ne net.Error
+	return errors.As(err, &ne)
 }
 
-func fetchAndStoreMetadata(ctx context.Context, db *sql.DB, cids []string) error {
+func (s *scraper) fetchAndStoreMetadata(ctx context.Context, cids []string) error {
 	cidChan := make(chan string)
 	var wg sync.WaitGroup
+	s.report.Start()
+	s.report.Queued(len(cids))
+
+	// Fetch each CID only once
+	unique := make([]string, 0, len(cids))
+	seen := make(map[string]bool, len(cids))
+	for _, cid := range cids {
+		if seen[cid] {
+			s.report.Duplicate()
+			continue
+		}
+		seen[cid] = true
+		unique = append(unique, cid)
+	}
+	s.progress.AddTotal(len(unique))
+	metrics.QueueDepth.Set(float64(len(unique)))
+	waitAssets := s.startArchiving(ctx)
 
-	// Start workers
-	for i := 0; i < NumWorkers; i++ {
-		go worker(ctx, db, cidChan, &wg)
+	// Start enough workers to fill every gateway to its maximum; the
+	// gateway group decides how many of them actually fetch at once.
+	for i := 0; i < s.gateways.MaxConcurrency(); i++ {
+		go s.worker(ctx, cidChan, &wg)
 	}
 
 	// Send CIDs to workers
-	for _, cid := range cids {
+	for _, cid := range unique {
 		wg.Add(1)
 		cidChan <- cid
 	}
@@ -131,74 +788,634 @@ func fetchAndStoreMetadata(ctx context.Context, db *sql.DB, cids []string) error
 
 	// Wait for all metadata to be fetched
 	wg.Wait()
+	waitAssets()
 
+	slog.Info("Finished scrape", "cids", len(cids), "gateway_concurrency", s.gateways.Limits())
 	return nil
 }
 
-func worker(ctx context.Context, db *sql.DB, cidChan <-chan string, wg *sync.WaitGroup) {
+func (s *scraper) worker(ctx context.Context, cidChan <-chan string, wg *sync.WaitGroup) {
 	for cid := range cidChan {
-		fetchAndParseMetadata(db, cid)
+		metrics.QueueDepth.Dec()
+		s.fetchAndParseMetadata(ctx, cid)
+		s.tokenURIs.Delete(cid)
 		wg.Done()
 	}
 }
 
-func fetchAndParseMetadata(db *sql.DB, cid string) (*metadata.Metadata, error) {
-	url := fmt.Sprintf("https://ipfs.io/ipfs/%s", cid)
-	resp, err := http.Get(url)
+func (s *scraper) fetchAndParseMetadata(ctx context.Context, cid string) (_ *metadata.Metadata, err error) {
+	ctx, span := tracing.Start(ctx, "process CID", attribute.String("cid", cid))
+	ctx = logging.With(ctx, logging.CID, cid)
+	metrics.ActiveWorkers.Inc()
+	s.progress.Started()
+	var notMetadata string
+	defer func() {
+		metrics.ActiveWorkers.Dec()
+		s.progress.Done(err != nil && !skipped(err))
+		switch {
+		case err == nil && notMetadata != "":
+			s.report.NotMetadata(notMetadata)
+			metrics.CIDs.WithLabelValues("not_metadata").Inc()
+		case err == nil:
+			s.report.Succeeded()
+			metrics.CIDs.WithLabelValues("fetched").Inc()
+		case skipped(err):
+			s.report.Skipped()
+			metrics.CIDs.WithLabelValues("skipped").Inc()
+		default:
+			s.report.Failed(classify(err))
+			metrics.CIDs.WithLabelValues("failed").Inc()
+		}
+		tracing.End(span, err)
+	}()
+
+	start := time.Now()
+	src, err := s.source(cid)
+	if err != nil {
+		logging.From(ctx).Error("Error resolving CID", "error", err)
+		return nil, err
+	}
+	span.SetAttributes(attribute.String("scheme", src.Scheme))
+	body, err := s.fetch(ctx, src)
+	if err != nil {
+		logging.From(ctx).Error("Error fetching CID", logging.Duration, time.Since(start), "error", err)
+		return nil, err
+	}
+
+	metadata, err := parseMetadata(ctx, cid, body)
+	if errors.Is(err, errNotMetadata) && s.storeNonMetadata {
+		logging.From(ctx).Warn("CID is not metadata", "media_type", metadata.MediaType)
+		notMetadata, err = metadata.MediaType, nil
+	}
+	if err != nil {
+		metrics.ParseFailures.Inc()
+		logging.From(ctx).Error("Error parsing CID", "error", err)
+		return nil, err
+	}
+	var mt *mapping.Mapping
+	if s.mapper != nil {
+		// An unmapped document is still stored; remap can fix it later.
+		var merr error
+		if mt, merr = s.mapper.apply(ctx, metadata); merr != nil {
+			logging.From(ctx).Error("Error mapping metadata", "error", merr)
+		}
+	}
+	// A token_uri field in the document itself isn't trusted.
+	metadata.TokenURI = ""
+	if uri, ok := s.tokenURIs.Load(cid); ok {
+		metadata.TokenURI = uri.(string)
+	}
+	metadata.SourceScheme, metadata.SourceNetwork = src.Scheme, src.Network()
+
+	storeStart := time.Now()
+	if notMetadata != "" {
+		err = storeMediaType(ctx, s.db, metadata)
+	} else {
+		err = storeMetadata(ctx, s.db, metadata)
+	}
+	metrics.StoreDuration.Observe(time.Since(storeStart).Seconds())
+	if err != nil {
+		logging.From(ctx).Error("Error storing CID", "error", err)
+		return nil, fmt.Errorf("%w for CID %s: %w", errStore, cid, err)
+	}
+
+	logging.From(ctx).Info("Stored metadata", logging.Duration, time.Since(start))
+
+	if s.validator != nil && rawJSON(metadata.Raw) == nil {
+		// Neither a body that isn't metadata nor a document too odd to
+		// store has a raw document to validate.
+		if err := s.validator.forget(ctx, cid); err != nil {
+			logging.From(ctx).Error("Error deleting validation", "error", err)
+		}
+	} else if s.validator != nil {
+		// An invalid document is still stored; the result is kept in the
+		// validations table.
+		doc, err := mappedDocument(metadata, mt)
+		var r schema.Result
+		if err == nil {
+			r, err = s.validator.validate(ctx, cid, doc)
+		}
+		if err != nil {
+			logging.From(ctx).Error("Error validating metadata", "error", err)
+		} else if !r.Valid {
+			logging.From(ctx).Warn("Metadata is invalid", "errors", r.Errors)
+		}
+	}
+
+	if notMetadata == "" {
+		s.queueAssets(ctx, metadata)
+	}
+
+	return metadata, nil
+}
+
+func parseMetadata(ctx context.Context, cid string, body []byte) (_ *metadata.Metadata, err error) {
+	_, span := tracing.Start(ctx, "parse", attribute.Int("bytes", len(body)))
+	defer func() { tracing.End(span, err) }()
+
+	var metadata metadata.Metadata
+	// The body is decoded once: sniffing decodes IPLD documents, and plain
+	// JSON is only checked by decoding it into metadata.
+	mediaType, doc := sniff.Decode(body)
+	span.SetAttributes(attribute.String("media_type", mediaType))
+	switch {
+	case mediaType == sniff.JSON:
+		if err := json.Unmarshal(body, &metadata); err != nil {
+			// Report where the JSON breaks rather than the body itself.
+			var se *json.SyntaxError
+			if errors.As(err, &se) {
+				return nil, fmt.Errorf("%w for CID %s: %w%s", errInvalidJSON, cid, err, excerpt(body, err))
+			}
+			return nil, fmt.Errorf("%w for CID %s: %w%s", errParse, cid, err, excerpt(body, err))
+		}
+		// Only IPLD documents have links.
+		metadata.Links = nil
+		metadata.Raw = body
+	case doc != nil:
+		if err := parseIPLD(doc, &metadata); err != nil {
+			return nil, fmt.Errorf("%w for CID %s: %w", errParse, cid, err)
+		}
+	default:
+		// The returned document carries the media type, for callers that
+		// store non-metadata anyway.
+		err = fmt.Errorf("%w for CID %s: %s", errNotMetadata, cid, mediaType)
+	}
+
+	metadata.Cid, metadata.MediaType = cid, mediaType
+	return &metadata, err
+}
+
+// excerptLen caps how much of a body an error quotes.
+const excerptLen = 64
+
+// excerpt quotes the part of body around where err, a JSON decoding error,
+// happened, so the error shows what went wrong without carrying the whole
+// body. It returns "" for errors without a position.
+func excerpt(body []byte, err error) string {
+	var offset int64
+	var se *json.SyntaxError
+	var te *json.UnmarshalTypeError
+	switch {
+	case errors.As(err, &se):
+		offset = se.Offset
+	case errors.As(err, &te):
+		offset = te.Offset
+	default:
+		return ""
+	}
+	start := max(0, int(offset)-excerptLen/2)
+	end := min(len(body), start+excerptLen)
+	s := strconv.Quote(string(body[start:end]))
+	if start > 0 {
+		s = "..." + s
+	}
+	if end < len(body) {
+		s += "..."
+	}
+	return " near " + s
+}
+
+// parseIPLD fills m from v, a decoded dag-json or dag-cbor document. Its
+// links become ipfs:// URIs in the fields and are listed in m.Links.
+func parseIPLD(v any, m *metadata.Metadata) error {
+	doc, links, err := ipld.ToJSON(v)
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(doc, m); err != nil {
+		return err
+	}
+	m.Raw = doc
+	m.Links = nil
+	for _, l := range links {
+		m.Links = append(m.Links, metadata.Link{Path: l.Path, Cid: l.Cid})
+	}
+	return nil
+}
+
+// source resolves cid, the key of a document, to where it is fetched
+// from: the token URI it was read with, or else the key itself.
+func (s *scraper) source(cid string) (*resolve.Source, error) {
+	uri, ok := s.tokenURIs.Load(cid)
+	if !ok {
+		if strings.HasPrefix(cid, resolve.SchemeData+":") {
+			return nil, fmt.Errorf("%w for CID %s: data URI not known", errResolve, cid)
+		}
+		uri = cid
+	}
+	src, err := resolve.Parse(uri.(string))
+	if err != nil {
+		return nil, fmt.Errorf("%w for CID %s: %w", errResolve, cid, err)
+	}
+	return src, nil
+}
+
+// fetch downloads src, retrying throttled and failed requests up to
+// s.retries times. Data URIs are already decoded and need no request.
+func (s *scraper) fetch(ctx context.Context, src *resolve.Source) (_ []byte, err error) {
+	if src.Scheme == resolve.SchemeData {
+		return src.Data, nil
+	}
+	ctx, span := tracing.Start(ctx, "fetch")
+	defer func() { tracing.End(span, err) }()
+
+	return s.retry(ctx, func(attempt int) ([]byte, error) {
+		switch src.Scheme {
+		case resolve.SchemeIPFS:
+			return s.fetchOnce(ctx, src.Path, "", attempt)
+		case resolve.SchemeHTTP, resolve.SchemeHTTPS:
+			return s.fetchURL(ctx, src.URL, attempt)
+		case resolve.SchemeIPNS:
+			name, sub, _ := strings.Cut(src.Path, "/")
+			p, err := s.resolveName(ctx, name)
+			if err != nil {
+				return nil, err
+			}
+			if sub != "" {
+				p += "/" + sub
+			}
+			return s.fetchOnce(ctx, p, "", attempt)
+		case resolve.SchemeAR:
+			u, err := s.arweave.URL(ctx, src.Path)
+			if err != nil {
+				return nil, err
+			}
+			return s.fetchURL(ctx, u, attempt)
+		}
+		return nil, fmt.Errorf("%w for %s: no fetcher for %s://", errResolve, src.URI, src.Scheme)
+	})
+}
+
+// retry calls fetch for attempt 0, 1 and so on, until it succeeds, fails
+// in a way that won't clear up, or s.retries retries have been made.
+func (s *scraper) retry(ctx context.Context, fetch func(attempt int) ([]byte, error)) ([]byte, error) {
+	for attempt := 0; ; attempt++ {
+		body, err := fetch(attempt)
+		if err == nil || attempt >= s.retries || !retryable(err) {
+			return body, err
+		}
+		metrics.Retries.Inc()
+		s.report.Retried()
+		logging.From(ctx).Warn("Retrying CID", logging.Attempt, attempt+1, "error", err)
+		// A 429 already paused the gateway in the limiter.
+		if !isThrottled(err) {
+			sleepContext(ctx, retryBackoff(attempt))
+		}
+	}
+}
+
+const (
+	retryBaseDelay = 500 * time.Millisecond
+	retryMaxDelay  = 10 * time.Second
+)
+
+// retryBackoff is the pause before retrying a server or network error for
+// the attempt+1th time: it doubles from retryBaseDelay up to retryMaxDelay,
+// with up to half of it random so failed workers don't retry in lockstep.
+func retryBackoff(attempt int) time.Duration {
+	d := retryMaxDelay
+	if attempt < 10 {
+		d = min(retryBaseDelay<<attempt, retryMaxDelay)
+	}
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+}
+
+// isThrottled reports whether err is a 429 from a gateway.
+func isThrottled(err error) bool {
+	var se *statusError
+	return errors.As(err, &se) && se.Status == http.StatusTooManyRequests
+}
+
+// fetchOnce downloads cid, an IPFS path, from whichever gateway has
+// capacity. accept, if set, asks for a particular response format.
+func (s *scraper) fetchOnce(ctx context.Context, cid, accept string, attempt int) ([]byte, error) {
+	gw, err := s.gateways.Acquire(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("error waiting for gateway for CID %s: %w", cid, err)
+	}
+	return s.request(ctx, gw, gw.URL+"/ipfs/"+escapePath(cid), cid, accept, attempt)
+}
+
+// escapePath escapes each segment of an IPFS path for use in a URL.
+func escapePath(p string) string {
+	segments := strings.Split(p, "/")
+	for i, seg := range segments {
+		segments[i] = url.PathEscape(seg)
+	}
+	return strings.Join(segments, "/")
+}
+
+// fetchURL downloads a token URI served over plain HTTP(S). Its host gets
+// a concurrency limit and rate limit of its own, as a gateway does.
+func (s *scraper) fetchURL(ctx context.Context, rawURL string, attempt int) ([]byte, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, fmt.Errorf("error building request for %s: %w", rawURL, err)
+	}
+	host, err := s.gateways.AcquireHost(ctx, u.Host)
+	if err != nil {
+		return nil, fmt.Errorf("error waiting for host for %s: %w", rawURL, err)
+	}
+	return s.request(ctx, host, rawURL, rawURL, "", attempt)
+}
+
+// request fetches url, the document of cid, on a slot of gw taken from the
+// gateway group. It waits for gw's rate limit and reports the result back
+// to the group.
+func (s *scraper) request(ctx context.Context, gw *concurrency.Gateway, url, cid, accept string, attempt int) (_ []byte, err error) {
+	ctx, span := tracing.Start(ctx, "gateway request", attribute.Int("attempt", attempt), attribute.String("gateway", gw.Host))
+	defer func() { tracing.End(span, err) }()
+
+	if err := s.limiter.Wait(ctx, gw.Host); err != nil {
+		s.gateways.Cancel(gw)
+		return nil, fmt.Errorf("error waiting for rate limit for CID %s: %w", cid, err)
+	}
+
+	start := time.Now()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
 	if err != nil {
+		s.gateways.Cancel(gw)
+		return nil, fmt.Errorf("error building request for CID %s: %w", cid, err)
+	}
+	if accept != "" {
+		req.Header.Set("Accept", accept)
+	}
+	tracing.Inject(ctx, req.Header)
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		// A cancelled run isn't the gateway's fault.
+		s.release(gw, concurrency.Outcome{Latency: time.Since(start), NoResponse: ctx.Err() == nil})
 		return nil, fmt.Errorf("error fetching metadata for CID %s: %w", cid, err)
 	}
 	defer resp.Body.Close()
 
-	body, err := io.ReadAll(resp.Body)
+	// Error pages aren't read, so that one over the size limit still fails
+	// as an HTTP error and is retried.
+	var body []byte
+	if resp.StatusCode == http.StatusOK {
+		body, err = s.readBody(resp, cid)
+	}
+	s.release(gw, concurrency.Outcome{Latency: time.Since(start), Status: resp.StatusCode})
+	s.report.Response(gw.Host, time.Since(start), int64(len(body)))
+	span.SetAttributes(semconv.HTTPStatusCode(resp.StatusCode))
+	logging.From(ctx).Debug("Gateway responded",
+		logging.Gateway, gw.Host,
+		logging.Attempt, attempt,
+		logging.Status, resp.StatusCode,
+		logging.Duration, time.Since(start))
 	if err != nil {
-		return nil, fmt.Errorf("error reading response for CID %s: %w", cid, err)
+		return nil, err
 	}
 
-	var metadata metadata.Metadata
-	if !json.Valid(body) {
-		return nil, fmt.Errorf("invalid JSON for CID %s: %s", cid, string(body))
+	if resp.StatusCode != http.StatusOK {
+		se := &statusError{Cid: cid, Host: gw.Host, Status: resp.StatusCode}
+		if resp.StatusCode == http.StatusTooManyRequests {
+			se.RetryAfter = ratelimit.ParseRetryAfter(resp.Header.Get("Retry-After"), time.Now())
+			s.limiter.Throttled(ctx, gw.Host, se.RetryAfter)
+		}
+		return nil, se
+	}
+	s.limiter.Succeeded(gw.Host)
+	return body, nil
+}
+
+// startArchiving starts the workers that archive assets in the
+// background, so that slow or large images don't hold up the metadata
+// workers. The returned function waits for the queued assets to be
+// archived. Nothing is started if assets aren't archived.
+func (s *scraper) startArchiving(ctx context.Context) (wait func()) {
+	if s.blobs == nil {
+		return func() {}
+	}
+	n := s.gateways.MaxConcurrency()
+	s.assetQueue = make(chan *metadata.Metadata, n)
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for m := range s.assetQueue {
+				s.archiveAssets(logging.With(ctx, logging.CID, m.Cid), m)
+			}
+		}()
+	}
+	return func() {
+		close(s.assetQueue)
+		wg.Wait()
+		s.assetQueue = nil
+	}
+}
+
+// queueAssets hands m to the archive workers, waiting while they are all
+// busy.
+func (s *scraper) queueAssets(ctx context.Context, m *metadata.Metadata) {
+	if s.assetQueue == nil {
+		return
+	}
+	select {
+	case s.assetQueue <- m:
+	case <-ctx.Done():
+	}
+}
+
+// archiveAssets fetches the image and animation of m into the blob
+// directory and records what was found. Failures are recorded rather than
+// returned: a broken image doesn't make the metadata wrong.
+func (s *scraper) archiveAssets(ctx context.Context, m *metadata.Metadata) {
+	ctx, span := tracing.Start(ctx, "archive assets")
+	defer span.End()
+
+	refs := []struct{ field, uri string }{
+		{assets.FieldImage, m.Image},
+		{assets.FieldAnimationURL, m.AnimationURL},
+	}
+	for _, ref := range refs {
+		if ref.uri == "" {
+			continue
+		}
+		a := s.archiveAsset(ctx, ref.uri)
+		if a == nil {
+			continue
+		}
+		rec := *a
+		rec.Cid, rec.Field = m.Cid, ref.field
+		if err := assets.Save(ctx, s.db, &rec); err != nil {
+			logging.From(ctx).Error("Error storing asset", "field", ref.field, "error", err)
+			continue
+		}
+		if rec.Status != assets.StatusOK {
+			logging.From(ctx).Warn("Asset is "+rec.Status, "field", ref.field, "uri", ref.uri, "error", rec.Error)
+		}
+	}
+}
+
+// archiveAsset fetches, inspects and stores the asset at uri, once per run.
+// It returns nil if the fetch was cut short by shutdown or the request
+// budget, so that nothing is recorded.
+func (s *scraper) archiveAsset(ctx context.Context, uri string) *assets.Asset {
+	if a, ok := s.archived.Load(uri); ok {
+		return a.(*assets.Asset)
+	}
+
+	a := &assets.Asset{URI: uri}
+	src, err := resolve.Parse(uri)
+	if err != nil {
+		a.Status, a.Error = assets.StatusBroken, err.Error()
+	} else if body, err := s.fetch(ctx, src); err != nil {
+		if skipped(err) {
+			return nil
+		}
+		a.Status, a.Error = assets.StatusUnreachable, err.Error()
+	} else {
+		a.Inspect(body)
+		if err := s.blobs.Put(a.Hash, body); err != nil {
+			logging.From(ctx).Error("Error archiving asset", "uri", uri, "error", err)
+			// Nothing is stored under the hash, so it mustn't be served.
+			a.Status, a.Hash, a.Error = assets.StatusUnstored, "", err.Error()
+		}
+	}
+	s.archived.Store(uri, a)
+	return a
+}
+
+// fetchNode downloads the IPLD node at an IPFS path in format, for
+// listing directories.
+func (s *scraper) fetchNode(ctx context.Context, path, format string) ([]byte, error) {
+	return s.retry(ctx, func(attempt int) ([]byte, error) {
+		return s.fetchOnce(ctx, path, unixfs.MediaType(format), attempt)
+	})
+}
+
+// resolveName returns the IPFS path an IPNS name or DNSLink domain points
+// at. Each name is resolved once per run, and recorded in ipns_names so that
+// the ipns refresh command can tell when it moves.
+func (s *scraper) resolveName(ctx context.Context, name string) (string, error) {
+	if p, ok := s.names.Load(name); ok {
+		return p.(string), nil
+	}
+	p, err := s.ipns.Resolve(ctx, name)
+	if err != nil {
+		return "", fmt.Errorf("%w for %s: %w", errResolve, name, err)
+	}
+	s.names.Store(name, p)
+	if _, err := ipns.Save(ctx, s.db, name, p); err != nil {
+		logging.From(ctx).Warn("Error saving IPNS name", "name", name, "error", err)
+	}
+	return p, nil
+}
+
+// readBody reads the body of resp, fetched for cid, up to s.maxBodySize.
+// A body over the limit isn't read any further than needed to tell.
+func (s *scraper) readBody(resp *http.Response, cid string) ([]byte, error) {
+	if s.maxBodySize <= 0 {
+		body, err := io.ReadAll(resp.Body)
+		if err != nil {
+			return nil, fmt.Errorf("error reading response for CID %s: %w", cid, err)
+		}
+		return body, nil
+	}
+	if resp.ContentLength > s.maxBodySize {
+		return nil, fmt.Errorf("%w for CID %s: %d bytes, limit is %d", errTooLarge, cid, resp.ContentLength, s.maxBodySize)
+	}
+	body, err := io.ReadAll(io.LimitReader(resp.Body, s.maxBodySize+1))
+	if err != nil {
+		return nil, fmt.Errorf("error reading response for CID %s: %w", cid, err)
 	}
-	if err := json.Unmarshal(body, &metadata); err != nil {
-		return nil, fmt.Errorf("error parsing metadata for CID %s: %w", cid, err)
+	if int64(len(body)) > s.maxBodySize {
+		return nil, fmt.Errorf("%w for CID %s: over the limit of %d bytes", errTooLarge, cid, s.maxBodySize)
 	}
+	return body, nil
+}
 
-	metadata.Cid = cid
-	if err := storeMetadata(db, &metadata); err != nil {
-		return nil, fmt.Errorf("error storing metadata for CID %s: %w", cid, err)
+// release hands gw back to the gateway group and records the request.
+func (s *scraper) release(gw *concurrency.Gateway, o concurrency.Outcome) {
+	status := "error"
+	if o.Status != 0 {
+		status = strconv.Itoa(o.Status)
 	}
+	metrics.FetchDuration.WithLabelValues(gw.Host, status).Observe(o.Latency.Seconds())
+
+	s.gateways.Release(gw, o)
+	metrics.GatewayConcurrency.WithLabelValues(gw.Host).Set(float64(s.gateways.Limit(gw)))
+}
 
-	return &metadata, nil
+func storeMetadata(ctx context.Context, db *sql.DB, metadata *metadata.Metadata) error {
+	return upsertMetadata(ctx, db, metadata, false)
 }
 
-func storeMetadata(db *sql.DB, metadata *metadata.Metadata) error {
+// upsertMetadata stores metadata. The raw document stored before is kept
+// if keepRaw is set, for rows whose raw document isn't what was fetched,
+// and otherwise only when metadata has none.
+func upsertMetadata(ctx context.Context, db *sql.DB, metadata *metadata.Metadata, keepRaw bool) (err error) {
+	ctx, span := tracing.Start(ctx, "db.upsert metadata", tracing.DBAttributes("INSERT", "metadata")...)
+	defer func() { tracing.End(span, err) }()
+
 	sqlStatement := `
-        INSERT INTO metadata (cid, image, description, name)
-        VALUES ($1, $2, $3, $4)
+        INSERT INTO metadata (cid, image, description, name, attributes, token_uri, source_scheme, source_network, animation_url, media_type, linked_cids, raw)
+        VALUES ($1, $2, $3, $4, $5, NULLIF($6, ''), NULLIF($7, ''), NULLIF($8, ''), $9, NULLIF($10, ''), $11, $12)
 		ON CONFLICT (cid) DO UPDATE SET
         image = EXCLUDED.image,
         description = EXCLUDED.description,
-        name = EXCLUDED.name`
-	_, err := db.Exec(sqlStatement, metadata.Cid, metadata.Image, metadata.Description, metadata.Name)
+        name = EXCLUDED.name,
+        attributes = EXCLUDED.attributes,
+        animation_url = EXCLUDED.animation_url,
+        linked_cids = EXCLUDED.linked_cids,
+        raw = CASE WHEN $13 THEN COALESCE(metadata.raw, EXCLUDED.raw) ELSE COALESCE(EXCLUDED.raw, metadata.raw) END,
+        token_uri = COALESCE(EXCLUDED.token_uri, metadata.token_uri),
+        source_scheme = COALESCE(EXCLUDED.source_scheme, metadata.source_scheme),
+        source_network = COALESCE(EXCLUDED.source_network, metadata.source_network),
+        media_type = COALESCE(EXCLUDED.media_type, metadata.media_type)`
+	_, err = db.ExecContext(ctx, sqlStatement, metadata.Cid, metadata.Image, metadata.Description, metadata.Name,
+		metadata.AttributesJSON(), metadata.TokenURI, metadata.SourceScheme, metadata.SourceNetwork, metadata.AnimationURL, metadata.MediaType, metadata.LinksJSON(), rawJSON(metadata.Raw), keepRaw)
 	if err != nil {
 		return fmt.Errorf("error storing metadata: %w", err)
 	}
 	return nil
 }
 
+// storeMediaType records m, a body that isn't metadata, by its media type.
+// A CID that already has a row only gets its media type updated, so that
+// metadata fetched before isn't blanked by whatever the CID serves now.
+func storeMediaType(ctx context.Context, db *sql.DB, m *metadata.Metadata) (err error) {
+	ctx, span := tracing.Start(ctx, "db.upsert media type", tracing.DBAttributes("INSERT", "metadata")...)
+	defer func() { tracing.End(span, err) }()
+
+	_, err = db.ExecContext(ctx, `
+        INSERT INTO metadata (cid, token_uri, source_scheme, source_network, media_type)
+        VALUES ($1, NULLIF($2, ''), NULLIF($3, ''), NULLIF($4, ''), $5)
+        ON CONFLICT (cid) DO UPDATE SET media_type = EXCLUDED.media_type`,
+		m.Cid, m.TokenURI, m.SourceScheme, m.SourceNetwork, m.MediaType)
+	if err != nil {
+		return fmt.Errorf("error storing media type: %w", err)
+	}
+	return nil
+}
+
+// rawJSON returns a document for the raw column, or nil to leave it NULL:
+// Postgres can't store the NUL character in JSONB, even escaped.
+func rawJSON(raw json.RawMessage) []byte {
+	if len(raw) == 0 || bytes.Contains(raw, []byte(`\u0000`)) {
+		return nil
+	}
+	return raw
+}
+
 func printMetadata(db *sql.DB) error {
-	rows, err := db.Query("SELECT * FROM metadata")
+	rows, err := db.Query("SELECT " + metadata.Columns + " FROM metadata")
 	if err != nil {
 		return fmt.Errorf("error querying metadata: %w", err)
 	}
 	defer rows.Close()
 
 	for rows.Next() {
-		var cid, image, description, name string
-		if err := rows.Scan(&cid, &image, &description, &name); err != nil {
+		m, err := metadata.Scan(rows)
+		if err != nil {
 			return fmt.Errorf("error scanning row: %w", err)
 		}
-		fmt.Printf("Cid: %s,Image: %s, Description: %s, Name: %s\n", cid, image, description, name)
+		// Rows are output, not events, so they go to stdout rather than
+		// the log.
+		fmt.Printf("Cid: %s, Image: %s, Description: %s, Name: %s, Attributes: %d\n", m.Cid, m.Image, m.Description, m.Name, len(m.Attributes))
 	}
 
 	if err := rows.Err(); err != nil {
@@ -2,9 +2,24 @@ package main
 
 import (
 	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
 	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
 	"sync"
 	"testing"
+	"time"
+
+	"github.com/coffeendude/ipfs-cids-go-scraper/collection"
+	"github.com/coffeendude/ipfs-cids-go-scraper/concurrency"
+	"github.com/coffeendude/ipfs-cids-go-scraper/export"
+	"github.com/coffeendude/ipfs-cids-go-scraper/input"
+	"github.com/coffeendude/ipfs-cids-go-scraper/metadata"
 )
 
 func BenchmarkWorkerPool(b *testing.B) {
@@ -30,6 +45,7 @@ func BenchmarkWorkerPool(b *testing.B) {
 
 	const numWorkers = 10 // adjust as needed
 	var wg sync.WaitGroup
+	s := newScraper(db, concurrency.NewGroup([]string{DefaultGateway}, numWorkers, numWorkers, 0))
 
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
@@ -39,7 +55,7 @@ func BenchmarkWorkerPool(b *testing.B) {
 		cidChan := make(chan string)
 		// Start workers
 		for i := 0; i < numWorkers; i++ {
-			go worker(ctx, db, cidChan, &wg)
+			go s.worker(ctx, cidChan, &wg)
 		}
 
 		// Send CIDs to workers
@@ -82,6 +98,8 @@ func BenchmarkFetchAndStoreMetadata(b *testing.B) {
 		b.Fatalf("Error reading CSV: %v", err)
 	}
 
+	s := newScraper(db, concurrency.NewGroup([]string{DefaultGateway}, 1, NumWorkers, 2*time.Second))
+
 	// Create a context for the operation
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
@@ -91,9 +109,222 @@ func BenchmarkFetchAndStoreMetadata(b *testing.B) {
 
 	// Run the operation b.N times
 	for i := 0; i < b.N; i++ {
-		if err := fetchAndStoreMetadata(ctx, db, cids); err != nil {
+		if err := s.fetchAndStoreMetadata(ctx, cids); err != nil {
 			b.Fatalf("Error fetching and storing metadata: %v", err)
 		}
 	}
 
 }
+
+func TestPlanImport(t *testing.T) {
+	stored := &metadata.Metadata{Cid: "QmA", Name: "Ape", Description: "old", Image: "ipfs://a"}
+	incoming := &metadata.Metadata{Cid: "QmA", Description: "new"}
+
+	if action, _, _ := planImport(nil, incoming, modeSkip); action != actionInsert {
+		t.Errorf("new row: action = %s, want insert", action)
+	}
+	if action, row, _ := planImport(stored, incoming, modeSkip); action != actionSkip || row != stored {
+		t.Errorf("skip: action = %s, row = %+v", action, row)
+	}
+
+	action, row, changes := planImport(stored, incoming, modeUpsert)
+	want := metadata.Metadata{Cid: "QmA", Name: "Ape", Description: "new", Image: "ipfs://a"}
+	if action != actionUpdate || !reflect.DeepEqual(*row, want) || len(changes) != 1 || changes[0].Field != "description" {
+		t.Errorf("upsert: action = %s, row = %+v, changes = %+v", action, row, changes)
+	}
+
+	action, row, changes = planImport(stored, incoming, modeOverwrite)
+	if action != actionUpdate || !reflect.DeepEqual(row, incoming) || len(changes) != 3 {
+		t.Errorf("overwrite: action = %s, row = %+v, changes = %+v", action, row, changes)
+	}
+
+	if action, _, _ := planImport(stored, stored, modeOverwrite); action != actionUnchanged {
+		t.Errorf("same row: action = %s, want unchanged", action)
+	}
+}
+
+func TestImportDryRun(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "schema.json")
+	if err := os.WriteFile(path, []byte(`{"required": ["name"]}`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	v, err := validatorFor(nil, path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mp, err := mapperFor(nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, err := export.NewReader("jsonl", strings.NewReader(`{"cid": "QmA", "name": "Ape"}`+"\n"+`{"cid": "QmB", "image": "ipfs://b"}`+"\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Without a metadata table every record is an insert.
+	var out strings.Builder
+	im := &importer{mapper: mp, validator: v, mode: modeUpsert, dryRun: true, out: &out}
+	counts, err := im.run(context.Background(), r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if counts[actionInsert] != 2 || counts[countSchemaInvalid] != 1 {
+		t.Errorf("counts = %v", counts)
+	}
+	if got := out.String(); !strings.Contains(got, "insert QmA\n    valid against") ||
+		!strings.Contains(got, "insert QmB\n    invalid against") {
+		t.Errorf("output = %q", got)
+	}
+}
+
+func TestParseMetadataErrors(t *testing.T) {
+	ctx := context.Background()
+	huge := `{"name": "` + strings.Repeat("x", 10000) + `", "description": 5}`
+	_, err := parseMetadata(ctx, "cid", []byte(huge))
+	if !errors.Is(err, errParse) || len(err.Error()) > 300 || !strings.Contains(err.Error(), `description\": 5}`) {
+		t.Errorf("type error should quote a short excerpt: %v", err)
+	}
+
+	_, err = parseMetadata(ctx, "cid", []byte(`{"name": "`+strings.Repeat("x", 10000)+`" oops}`))
+	if !errors.Is(err, errInvalidJSON) || len(err.Error()) > 300 || !strings.Contains(err.Error(), "oops") {
+		t.Errorf("syntax error should quote a short excerpt: %v", err)
+	}
+
+	m, err := parseMetadata(ctx, "cid", []byte("<html>Not found</html>"))
+	if !errors.Is(err, errNotMetadata) || m.MediaType != "text/html" {
+		t.Errorf("html: %+v, %v", m, err)
+	}
+}
+
+func TestReadBody(t *testing.T) {
+	s := &scraper{maxBodySize: 10}
+	read := func(body string, length int64) ([]byte, error) {
+		return s.readBody(&http.Response{Body: io.NopCloser(strings.NewReader(body)), ContentLength: length}, "cid")
+	}
+	if b, err := read("0123456789", -1); err != nil || string(b) != "0123456789" {
+		t.Errorf("at the limit: %q, %v", b, err)
+	}
+	if _, err := read("0123456789a", -1); !errors.Is(err, errTooLarge) || classify(err) != classTooLarge {
+		t.Errorf("over the limit: %v", err)
+	}
+	if _, err := read("", 1<<30); !errors.Is(err, errTooLarge) {
+		t.Errorf("Content-Length over the limit: %v", err)
+	}
+}
+
+func TestRetryBackoff(t *testing.T) {
+	for attempt, want := range []time.Duration{retryBaseDelay, 2 * retryBaseDelay, 4 * retryBaseDelay} {
+		if d := retryBackoff(attempt); d < want/2 || d > want {
+			t.Errorf("retryBackoff(%d) = %s, want between %s and %s", attempt, d, want/2, want)
+		}
+	}
+	if d := retryBackoff(40); d < retryMaxDelay/2 || d > retryMaxDelay {
+		t.Errorf("retryBackoff(40) = %s, want at most %s", d, retryMaxDelay)
+	}
+}
+
+func TestJobIDs(t *testing.T) {
+	a := inputJobID([]input.Row{{Cid: "QmA"}, {Cid: "QmB"}})
+	b := inputJobID([]input.Row{{Cid: "QmB"}, {Cid: "QmA"}})
+	if a != b {
+		t.Errorf("inputJobID depends on row order: %q, %q", a, b)
+	}
+	if c := inputJobID([]input.Row{{Cid: "QmA"}}); c == a {
+		t.Errorf("inputJobID(QmA) = %q, same as for QmA and QmB", c)
+	}
+	if newJobID() == newJobID() {
+		t.Error("newJobID returned the same ID twice")
+	}
+}
+
+func TestNewScraperNeedsGateway(t *testing.T) {
+	for _, gateways := range []string{"", " , ,"} {
+		c := scrapeConfig{gateways: gateways}
+		if _, err := c.newScraper(nil); err == nil {
+			t.Errorf("newScraper with -gateways=%q: no error", gateways)
+		}
+	}
+}
+
+// testDB connects to the database in TEST_DATABASE_URL, in a schema of
+// its own that is dropped afterwards. The test is skipped without one.
+func testDB(t *testing.T) *sql.DB {
+	t.Helper()
+	dsn := os.Getenv("TEST_DATABASE_URL")
+	if dsn == "" {
+		t.Skip("TEST_DATABASE_URL not set")
+	}
+	db, err := sql.Open("postgres", dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// One connection, so the search_path applies to every query.
+	db.SetMaxOpenConns(1)
+	schema := fmt.Sprintf("main_test_%d", time.Now().UnixNano())
+	if _, err := db.Exec("CREATE SCHEMA " + schema + "; SET search_path TO " + schema); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		db.Exec("DROP SCHEMA " + schema + " CASCADE")
+		db.Close()
+	})
+	if err := ensureMetadataTable(db); err != nil {
+		t.Fatal(err)
+	}
+	if err := collection.CreateTables(db); err != nil {
+		t.Fatal(err)
+	}
+	return db
+}
+
+func TestImportUpsertKeepsRaw(t *testing.T) {
+	db := testDB(t)
+	ctx := context.Background()
+	if err := collection.Save(ctx, db, &collection.Collection{ID: "apes", Mapping: `{"name": "title"}`}); err != nil {
+		t.Fatal(err)
+	}
+	if err := collection.Link(ctx, db, "apes", "1", "QmA"); err != nil {
+		t.Fatal(err)
+	}
+	mp, err := newMapper(ctx, db)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fetched, err := parseMetadata(ctx, "QmA", []byte(`{"title": "Ape", "image": "ipfs://QmImage"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := mp.apply(ctx, fetched); err != nil {
+		t.Fatal(err)
+	}
+	if err := storeMetadata(ctx, db, fetched); err != nil {
+		t.Fatal(err)
+	}
+
+	r, err := export.NewReader("jsonl", strings.NewReader(`{"cid": "QmA", "description": "Imported"}`+"\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	im := &importer{db: db, mapper: mp, mode: modeUpsert, out: io.Discard}
+	if _, err := im.run(ctx, r); err != nil {
+		t.Fatal(err)
+	}
+
+	var raw []byte
+	stored, err := metadata.Scan(db.QueryRowContext(ctx, "SELECT "+metadata.Columns+", raw FROM metadata WHERE cid = $1", "QmA"), &raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stored.Name != "Ape" || stored.Description != "Imported" {
+		t.Errorf("imported row = %+v", stored)
+	}
+	// Remapping works from the fetched document, not the partial record.
+	m, err := mp.remapped(ctx, stored, raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.Name != "Ape" || m.Image != "ipfs://QmImage" {
+		t.Errorf("remapped name, image = %q, %q; want Ape, ipfs://QmImage", m.Name, m.Image)
+	}
+}
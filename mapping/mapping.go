@@ -0,0 +1,455 @@
+// Package mapping fills metadata fields from documents that don't follow
+// the ERC-721 layout, such as a "title" instead of a "name" or an image
+// nested under "media.uri", as a collection's mapping file directs.
+//
+// A mapping file is a JSON object from field to a rule or a list of rules,
+// tried in order until one yields a value:
+//
+//	{
+//	  "name": ["title", "properties.name.value"],
+//	  "image": "media.uri | ipfs",
+//	  "description": "properties.description | trim",
+//	  "attributes": "traits | pairs:label,val"
+//	}
+//
+// A rule is a path followed by transforms, separated by "|". A path is
+// keys joined by ".", with [n] for array indexes (negative ones count from
+// the end) and ['key'] for keys containing dots; a leading "$." is
+// allowed. A rule in single quotes, such as 'Untitled', is a literal. Fields
+// no rule yields a value for keep what the standard layout gives them.
+package mapping
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/coffeendude/ipfs-cids-go-scraper/metadata"
+	"github.com/coffeendude/ipfs-cids-go-scraper/resolve"
+)
+
+// Fields are the metadata fields a mapping can fill.
+var Fields = []string{"name", "description", "image", "animation_url", "attributes"}
+
+// Mapping is a compiled mapping file.
+type Mapping struct {
+	// Name is the file the mapping was loaded from, or the name it was
+	// given by LoadStored.
+	Name string
+
+	fields map[string][]rule
+}
+
+type rule struct {
+	// literal is set for a quoted rule, which has no path.
+	literal    *string
+	path       []step
+	transforms []transform
+}
+
+// step is one key or array index of a path.
+type step struct {
+	key   string
+	index int
+	isKey bool
+}
+
+type transform struct {
+	name string
+	arg  string
+}
+
+// Load reads and compiles the mapping file at path.
+func Load(path string) (*Mapping, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("error reading mapping %s: %w", path, err)
+	}
+	m, err := Parse(data)
+	if err != nil {
+		return nil, fmt.Errorf("error in mapping %s: %w", path, err)
+	}
+	m.Name = path
+	return m, nil
+}
+
+// LoadStored compiles a mapping as a collection stores it: the mapping
+// document itself, which is called name.
+func LoadStored(stored, name string) (*Mapping, error) {
+	m, err := Parse([]byte(stored))
+	if err != nil {
+		return nil, fmt.Errorf("error in mapping %s: %w", name, err)
+	}
+	m.Name = name
+	return m, nil
+}
+
+// Parse compiles a mapping document.
+func Parse(data []byte) (*Mapping, error) {
+	var raw map[string]json.RawMessage
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return nil, err
+	}
+	m := &Mapping{fields: map[string][]rule{}}
+	for field, r := range raw {
+		if !isField(field) {
+			return nil, fmt.Errorf("unknown field %q: want one of %s", field, strings.Join(Fields, ", "))
+		}
+		var exprs []string
+		var one string
+		if err := json.Unmarshal(r, &one); err == nil {
+			exprs = []string{one}
+		} else if err := json.Unmarshal(r, &exprs); err != nil {
+			return nil, fmt.Errorf("field %q: want a rule or a list of rules", field)
+		}
+		if len(exprs) == 0 {
+			return nil, fmt.Errorf("field %q: no rules", field)
+		}
+		for _, expr := range exprs {
+			rl, err := parseRule(expr)
+			if err != nil {
+				return nil, fmt.Errorf("field %q: rule %q: %w", field, expr, err)
+			}
+			m.fields[field] = append(m.fields[field], rl)
+		}
+	}
+	return m, nil
+}
+
+func isField(name string) bool {
+	for _, f := range Fields {
+		if f == name {
+			return true
+		}
+	}
+	return false
+}
+
+func parseRule(expr string) (rule, error) {
+	parts := strings.Split(expr, "|")
+	var r rule
+	head := strings.TrimSpace(parts[0])
+	if len(head) >= 2 && head[0] == '\'' && head[len(head)-1] == '\'' {
+		lit := head[1 : len(head)-1]
+		r.literal = &lit
+	} else {
+		var err error
+		if r.path, err = parsePath(head); err != nil {
+			return rule{}, err
+		}
+	}
+	for _, p := range parts[1:] {
+		name, arg, _ := strings.Cut(strings.TrimSpace(p), ":")
+		t := transform{name: name, arg: arg}
+		switch name {
+		case "trim", "lower", "upper", "string", "first", "ipfs":
+		case "prefix":
+			if arg == "" {
+				return rule{}, errors.New("prefix needs an argument, e.g. prefix:ipfs://")
+			}
+		case "join":
+			if t.arg == "" {
+				t.arg = ", "
+			}
+		case "pairs":
+			if k, v, ok := strings.Cut(arg, ","); !ok || k == "" || v == "" {
+				return rule{}, errors.New("pairs needs the trait and value keys, e.g. pairs:label,val")
+			}
+		default:
+			return rule{}, fmt.Errorf("unknown transform %q", name)
+		}
+		r.transforms = append(r.transforms, t)
+	}
+	return r, nil
+}
+
+func parsePath(p string) ([]step, error) {
+	p = strings.TrimPrefix(strings.TrimPrefix(p, "$"), ".")
+	if p == "" {
+		return nil, errors.New("empty path")
+	}
+	var steps []step
+	for p != "" {
+		switch {
+		case strings.HasPrefix(p, "['"):
+			end := strings.Index(p, "']")
+			if end < 0 {
+				return nil, errors.New("unterminated ['key']")
+			}
+			steps = append(steps, step{key: p[2:end], isKey: true})
+			p = p[end+2:]
+		case p[0] == '[':
+			end := strings.IndexByte(p, ']')
+			if end < 0 {
+				return nil, errors.New("unterminated [index]")
+			}
+			i, err := strconv.Atoi(p[1:end])
+			if err != nil {
+				return nil, fmt.Errorf("invalid index %q", p[1:end])
+			}
+			steps = append(steps, step{index: i})
+			p = p[end+1:]
+		default:
+			end := strings.IndexAny(p, ".[")
+			if end < 0 {
+				end = len(p)
+			}
+			if end == 0 {
+				return nil, fmt.Errorf("empty key before %q", p)
+			}
+			steps = append(steps, step{key: p[:end], isKey: true})
+			p = p[end:]
+		}
+		if strings.HasPrefix(p, ".") {
+			p = p[1:]
+			if p == "" {
+				return nil, errors.New("path ends with .")
+			}
+		}
+	}
+	return steps, nil
+}
+
+// Apply sets the fields of m that the mapping yields a value for from doc,
+// the document as JSON.
+func (mp *Mapping) Apply(doc []byte, m *metadata.Metadata) error {
+	var v any
+	dec := json.NewDecoder(bytes.NewReader(doc))
+	dec.UseNumber()
+	if err := dec.Decode(&v); err != nil {
+		return fmt.Errorf("error decoding document: %w", err)
+	}
+
+	fields := make([]string, 0, len(mp.fields))
+	for f := range mp.fields {
+		fields = append(fields, f)
+	}
+	sort.Strings(fields)
+	for _, field := range fields {
+		for _, r := range mp.fields[field] {
+			value := r.eval(v)
+			if field == "attributes" {
+				b, err := json.Marshal(value)
+				if err != nil {
+					continue
+				}
+				var attrs metadata.Attributes
+				if err := json.Unmarshal(b, &attrs); err != nil || len(attrs) == 0 {
+					continue
+				}
+				m.Attributes = attrs
+				break
+			}
+			s, ok := text(value)
+			if !ok || s == "" {
+				continue
+			}
+			switch field {
+			case "name":
+				m.Name = s
+			case "description":
+				m.Description = s
+			case "image":
+				m.Image = s
+			case "animation_url":
+				m.AnimationURL = s
+			}
+			break
+		}
+	}
+	return nil
+}
+
+// Overlay returns doc, the document m was filled from, with the fields the
+// mapping fills replaced by those of m, so that it reads as the document
+// would in the standard layout. Empty fields, which the mapping found no
+// value for, are left as they are, as is a document that isn't an object.
+func (mp *Mapping) Overlay(doc []byte, m *metadata.Metadata) ([]byte, error) {
+	var v map[string]any
+	dec := json.NewDecoder(bytes.NewReader(doc))
+	dec.UseNumber()
+	if err := dec.Decode(&v); err != nil || v == nil {
+		return doc, nil
+	}
+	for field := range mp.fields {
+		var value any
+		switch field {
+		case "name":
+			value = m.Name
+		case "description":
+			value = m.Description
+		case "image":
+			value = m.Image
+		case "animation_url":
+			value = m.AnimationURL
+		case "attributes":
+			if len(m.Attributes) > 0 {
+				value = json.RawMessage(m.AttributesJSON())
+			}
+		}
+		if value != nil && value != "" {
+			v[field] = value
+		}
+	}
+	b, err := json.Marshal(v)
+	if err != nil {
+		return nil, fmt.Errorf("error encoding document: %w", err)
+	}
+	return b, nil
+}
+
+// eval returns what r yields for the document v, or nil.
+func (r rule) eval(v any) any {
+	if r.literal != nil {
+		v = *r.literal
+	} else {
+		v = lookup(v, r.path)
+	}
+	for _, t := range r.transforms {
+		if isEmpty(v) {
+			return nil
+		}
+		v = t.apply(v)
+	}
+	if isEmpty(v) {
+		return nil
+	}
+	return v
+}
+
+func lookup(v any, path []step) any {
+	for _, s := range path {
+		switch node := v.(type) {
+		case map[string]any:
+			if !s.isKey {
+				return nil
+			}
+			v = node[s.key]
+		case []any:
+			if s.isKey {
+				return nil
+			}
+			i := s.index
+			if i < 0 {
+				i += len(node)
+			}
+			if i < 0 || i >= len(node) {
+				return nil
+			}
+			v = node[i]
+		default:
+			return nil
+		}
+	}
+	return v
+}
+
+func (t transform) apply(v any) any {
+	switch t.name {
+	case "first":
+		if list, ok := v.([]any); ok {
+			return list[0]
+		}
+		return v
+	case "join":
+		list, ok := v.([]any)
+		if !ok {
+			return v
+		}
+		var parts []string
+		for _, e := range list {
+			if s, ok := text(e); ok && s != "" {
+				parts = append(parts, s)
+			}
+		}
+		return strings.Join(parts, t.arg)
+	case "pairs":
+		return pairs(v, t.arg)
+	}
+
+	s, ok := text(v)
+	if !ok {
+		return nil
+	}
+	switch t.name {
+	case "trim":
+		return strings.TrimSpace(s)
+	case "lower":
+		return strings.ToLower(s)
+	case "upper":
+		return strings.ToUpper(s)
+	case "prefix":
+		if strings.HasPrefix(s, t.arg) {
+			return s
+		}
+		return t.arg + s
+	case "ipfs":
+		return ipfsURI(s)
+	}
+	return s
+}
+
+// pairs turns a list of objects keyed arg, "<trait key>,<value key>", into
+// standard attributes.
+func pairs(v any, arg string) any {
+	list, ok := v.([]any)
+	if !ok {
+		return nil
+	}
+	traitKey, valueKey, _ := strings.Cut(arg, ",")
+	var out []any
+	for _, e := range list {
+		entry, ok := e.(map[string]any)
+		if !ok {
+			continue
+		}
+		value, ok := entry[valueKey]
+		if !ok {
+			continue
+		}
+		out = append(out, map[string]any{"trait_type": entry[traitKey], "value": value})
+	}
+	return out
+}
+
+// ipfsURI rewrites a bare CID or IPFS gateway URL as an ipfs:// URI, and
+// returns anything else unchanged.
+func ipfsURI(s string) string {
+	src, err := resolve.Parse(s)
+	if err != nil || src.Scheme != resolve.SchemeIPFS || !resolve.IsCID(strings.Split(src.Path, "/")[0]) {
+		return s
+	}
+	return "ipfs://" + src.Path
+}
+
+// text returns v as a string if it is a scalar.
+func text(v any) (string, bool) {
+	switch v := v.(type) {
+	case string:
+		return v, true
+	case json.Number:
+		return v.String(), true
+	case bool:
+		return strconv.FormatBool(v), true
+	}
+	return "", false
+}
+
+func isEmpty(v any) bool {
+	switch v := v.(type) {
+	case nil:
+		return true
+	case string:
+		return strings.TrimSpace(v) == ""
+	case []any:
+		return len(v) == 0
+	case map[string]any:
+		return len(v) == 0
+	}
+	return false
+}
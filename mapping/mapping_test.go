@@ -0,0 +1,163 @@
+package mapping
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/coffeendude/ipfs-cids-go-scraper/metadata"
+)
+
+const doc = `{
+	"title": "  Laser Ape #7 ",
+	"media": {"uri": "https://gateway.example/ipfs/QmYwAPJzv5CZsnA625s3Xf2nemtYgPpHdWEz79ojWnPbdG/7.png", "type": "image/png"},
+	"properties": {"description": "An ape with lasers", "tags": ["ape", "laser", 7]},
+	"animation": "",
+	"traits": [{"label": "Hat", "val": "Cap"}, {"label": "Eyes", "val": "Laser"}, {"label": "Broken"}],
+	"a.b": "dotted",
+	"image": "ipfs://QmOld"
+}`
+
+func TestApply(t *testing.T) {
+	mp, err := Parse([]byte(`{
+		"name": ["name", "title | trim"],
+		"image": "media.uri | ipfs",
+		"description": ["$.properties.description | upper", "'none'"],
+		"animation_url": ["animation", "properties.tags[-1] | string | prefix:https://example.com/"],
+		"attributes": "traits | pairs:label,val"
+	}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := metadata.Metadata{Name: "kept", Image: "ipfs://QmOld"}
+	if err := mp.Apply([]byte(doc), &m); err != nil {
+		t.Fatal(err)
+	}
+	want := metadata.Metadata{
+		Name:         "Laser Ape #7",
+		Image:        "ipfs://QmYwAPJzv5CZsnA625s3Xf2nemtYgPpHdWEz79ojWnPbdG/7.png",
+		Description:  "AN APE WITH LASERS",
+		AnimationURL: "https://example.com/7",
+		Attributes: metadata.Attributes{
+			{TraitType: "Hat", Value: "Cap"},
+			{TraitType: "Eyes", Value: "Laser"},
+		},
+	}
+	if !reflect.DeepEqual(m, want) {
+		t.Errorf("Apply = %+v, want %+v", m, want)
+	}
+}
+
+func TestRules(t *testing.T) {
+	tests := []struct {
+		rule string
+		want string
+	}{
+		{"title", "  Laser Ape #7 "},
+		{"$.title | trim | lower", "laser ape #7"},
+		{"['a.b']", "dotted"},
+		{"properties.tags[0]", "ape"},
+		{"properties.tags | join", "ape, laser, 7"},
+		{"properties.tags | join:/", "ape/laser/7"},
+		{"properties.tags | first | upper", "APE"},
+		{"properties.tags[9]", ""},
+		{"media.missing", ""},
+		{"media[0]", ""},
+		{"animation", ""},
+		{"media | trim", ""},
+		{"'Untitled'", "Untitled"},
+		{"image | ipfs", "ipfs://QmOld"},
+		{"properties.description | ipfs", "An ape with lasers"},
+		{"media.type | prefix:image/", "image/png"},
+	}
+	for _, tt := range tests {
+		mp, err := Parse([]byte(`{"name": "` + tt.rule + `"}`))
+		if err != nil {
+			t.Errorf("Parse(%q): %v", tt.rule, err)
+			continue
+		}
+		var m metadata.Metadata
+		if err := mp.Apply([]byte(doc), &m); err != nil {
+			t.Fatal(err)
+		}
+		if m.Name != tt.want {
+			t.Errorf("%q = %q, want %q", tt.rule, m.Name, tt.want)
+		}
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	for _, bad := range []string{
+		`{"title": "name"}`,
+		`{"name": 5}`,
+		`{"name": []}`,
+		`{"name": "a..b"}`,
+		`{"name": "a[x]"}`,
+		`{"name": "a['b"}`,
+		`{"name": "a | shout"}`,
+		`{"name": "a | prefix"}`,
+		`{"attributes": "a | pairs:label"}`,
+		`[]`,
+	} {
+		if _, err := Parse([]byte(bad)); err == nil {
+			t.Errorf("Parse(%s) succeeded", bad)
+		}
+	}
+}
+
+func TestLoad(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "apes.json")
+	if err := os.WriteFile(path, []byte(`{"name": "title"}`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	mp, err := Load(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mp.Name != path {
+		t.Errorf("Name = %q, want %q", mp.Name, path)
+	}
+	if err := mp.Apply([]byte(`{"title": 1`), &metadata.Metadata{}); err == nil {
+		t.Error("Apply of broken JSON succeeded")
+	}
+	if _, err := Load(filepath.Join(t.TempDir(), "missing.json")); err == nil {
+		t.Error("Load of a missing file succeeded")
+	}
+}
+
+func TestLoadStored(t *testing.T) {
+	mp, err := LoadStored(`{"name": "title"}`, "collection apes")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mp.Name != "collection apes" {
+		t.Errorf("Name = %q", mp.Name)
+	}
+	if _, err := LoadStored(`{"colour": "title"}`, "collection apes"); err == nil {
+		t.Error("LoadStored of a bad mapping succeeded")
+	}
+	if _, err := LoadStored("mappings/apes.json", "collection apes"); err == nil {
+		t.Error("LoadStored of a path succeeded")
+	}
+}
+
+func TestOverlay(t *testing.T) {
+	mp, err := Parse([]byte(`{"name": "title", "image": "media.uri"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	raw := []byte(`{"title": "Ape", "image": 5, "n": 1}`)
+	m := &metadata.Metadata{}
+	if err := mp.Apply(raw, m); err != nil {
+		t.Fatal(err)
+	}
+	// The image rule found nothing, so the document's own is kept.
+	got, err := mp.Overlay(raw, m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := `{"image":5,"n":1,"name":"Ape","title":"Ape"}`; string(got) != want {
+		t.Errorf("Overlay = %s, want %s", got, want)
+	}
+}
@@ -1,8 +1,191 @@
 package metadata
 
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
 type Metadata struct {
-	Cid         string `json:"cid"`
-	Image       string `json:"image"`
-	Description string `json:"description"`
-	Name        string `json:"name"`
+	Cid         string     `json:"cid"`
+	Image       string     `json:"image"`
+	Description string     `json:"description"`
+	Name        string     `json:"name"`
+	Attributes  Attributes `json:"attributes,omitempty"`
+	// AnimationURL is the ERC-721 animation_url: a video, audio or HTML
+	// version of the token.
+	AnimationURL string `json:"animation_url,omitempty"`
+	// TokenURI is the URI the input file gave for the token, if any.
+	TokenURI string `json:"token_uri,omitempty"`
+	// SourceScheme is how the document was fetched: ipfs, ar, https, http
+	// or data for metadata embedded in the token URI.
+	SourceScheme string `json:"source_scheme,omitempty"`
+	// SourceNetwork is where the document lives: ipfs, arweave, web or
+	// onchain.
+	SourceNetwork string `json:"source_network,omitempty"`
+	// MediaType is what the fetched body was sniffed to be. Bodies that
+	// aren't metadata, such as an image or a web page, are stored with
+	// only this set.
+	MediaType string `json:"media_type,omitempty"`
+	// Links are the CID links of a dag-cbor or dag-json document. In the
+	// fields above they appear as ipfs:// URIs.
+	Links []Link `json:"linked_cids,omitempty"`
+	// Raw is the document as fetched, as JSON, kept so it can be checked
+	// again later without refetching. It isn't part of Columns.
+	Raw json.RawMessage `json:"-"`
+	// Collection and TokenID are set when the document was looked up
+	// through a collection.
+	Collection string `json:"collection,omitempty"`
+	TokenID    string `json:"token_id,omitempty"`
+}
+
+// Link is a CID link found at Path, the keys and array indexes leading to
+// it joined by "/", such as "image" or "properties/files/0".
+type Link struct {
+	Path string `json:"path"`
+	Cid  string `json:"cid"`
+}
+
+// Attribute is one entry of an ERC-721 style "attributes" array. Value is
+// usually a string or a number.
+type Attribute struct {
+	TraitType   string `json:"trait_type,omitempty"`
+	Value       any    `json:"value"`
+	DisplayType string `json:"display_type,omitempty"`
+}
+
+// Attributes is decoded leniently, since real-world metadata is not always
+// well formed: an object of trait/value pairs is accepted as well as the
+// standard array, non-string trait types are stringified, and any other
+// shape is ignored rather than failing the whole document.
+type Attributes []Attribute
+
+func (a *Attributes) UnmarshalJSON(b []byte) error {
+	var list []map[string]any
+	if err := json.Unmarshal(b, &list); err == nil {
+		*a = nil
+		for _, entry := range list {
+			if entry == nil {
+				continue
+			}
+			*a = append(*a, Attribute{
+				TraitType:   stringify(entry["trait_type"]),
+				Value:       entry["value"],
+				DisplayType: stringify(entry["display_type"]),
+			})
+		}
+		return nil
+	}
+
+	var traits map[string]any
+	if err := json.Unmarshal(b, &traits); err == nil {
+		*a = nil
+		for trait, value := range traits {
+			*a = append(*a, Attribute{TraitType: trait, Value: value})
+		}
+		sort.Slice(*a, func(i, j int) bool { return (*a)[i].TraitType < (*a)[j].TraitType })
+		return nil
+	}
+
+	*a = nil
+	return nil
+}
+
+// Values returns each attribute value as text.
+func (a Attributes) Values() []string {
+	values := make([]string, 0, len(a))
+	for _, attr := range a {
+		if v := attr.ValueString(); v != "" {
+			values = append(values, v)
+		}
+	}
+	return values
+}
+
+// ValueString returns the attribute value as text, the way Postgres's ->>
+// operator renders it, so values compare the same in Go and in SQL.
+func (a Attribute) ValueString() string {
+	return stringify(a.Value)
+}
+
+func stringify(v any) string {
+	switch v := v.(type) {
+	case nil:
+		return ""
+	case string:
+		return v
+	case float64:
+		// Postgres writes numbers out in full, never with an exponent.
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	}
+	b, _ := json.Marshal(v)
+	return string(b)
+}
+
+// Columns lists the metadata table columns in the order Scan expects.
+const Columns = "cid, image, description, name, attributes, token_uri, source_scheme, source_network, animation_url, media_type, linked_cids"
+
+// QualifiedColumns is Columns with each column prefixed by table, for
+// queries that join the metadata table.
+func QualifiedColumns(table string) string {
+	cols := strings.Split(Columns, ", ")
+	for i, c := range cols {
+		cols[i] = table + "." + c
+	}
+	return strings.Join(cols, ", ")
+}
+
+// Scanner is implemented by *sql.Row and *sql.Rows.
+type Scanner interface {
+	Scan(dest ...any) error
+}
+
+// Scan reads a row selected with Columns. Any columns selected after them
+// are scanned into extra.
+func Scan(s Scanner, extra ...any) (*Metadata, error) {
+	var m Metadata
+	var image, description, name, tokenURI, scheme, network, animation, mediaType sql.NullString
+	var attributes, links []byte
+	dest := append([]any{&m.Cid, &image, &description, &name, &attributes, &tokenURI, &scheme, &network, &animation, &mediaType, &links}, extra...)
+	if err := s.Scan(dest...); err != nil {
+		return nil, err
+	}
+	m.Image, m.Description, m.Name = image.String, description.String, name.String
+	m.TokenURI, m.SourceScheme, m.SourceNetwork = tokenURI.String, scheme.String, network.String
+	m.AnimationURL, m.MediaType = animation.String, mediaType.String
+	if len(attributes) > 0 {
+		if err := json.Unmarshal(attributes, &m.Attributes); err != nil {
+			return nil, fmt.Errorf("error decoding attributes of CID %s: %w", m.Cid, err)
+		}
+	}
+	if len(links) > 0 {
+		if err := json.Unmarshal(links, &m.Links); err != nil {
+			return nil, fmt.Errorf("error decoding links of CID %s: %w", m.Cid, err)
+		}
+	}
+	return &m, nil
+}
+
+// LinksJSON returns Links as JSON, or nil if there are none.
+func (m *Metadata) LinksJSON() []byte {
+	if len(m.Links) == 0 {
+		return nil
+	}
+	b, _ := json.Marshal(m.Links)
+	return b
+}
+
+// AttributesJSON encodes m's attributes for the attributes column.
+func (m *Metadata) AttributesJSON() []byte {
+	if len(m.Attributes) == 0 {
+		return []byte("[]")
+	}
+	b, err := json.Marshal(m.Attributes)
+	if err != nil {
+		return []byte("[]")
+	}
+	return b
 }
@@ -0,0 +1,51 @@
+package metadata
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func TestAttributesUnmarshal(t *testing.T) {
+	tests := []struct {
+		in   string
+		want Attributes
+	}{
+		{`[{"trait_type": "Eyes", "value": "Laser"}, {"trait_type": 7, "value": 3, "display_type": "number"}]`,
+			Attributes{{TraitType: "Eyes", Value: "Laser"}, {TraitType: "7", Value: float64(3), DisplayType: "number"}}},
+		{`{"Mouth": "Grin", "Eyes": "Laser"}`, Attributes{{TraitType: "Eyes", Value: "Laser"}, {TraitType: "Mouth", Value: "Grin"}}},
+		{`"not attributes"`, nil},
+		{`[null]`, nil},
+	}
+	for _, tt := range tests {
+		var m Metadata
+		if err := json.Unmarshal([]byte(`{"name": "x", "attributes": `+tt.in+`}`), &m); err != nil {
+			t.Errorf("%s: %v", tt.in, err)
+			continue
+		}
+		if !reflect.DeepEqual(m.Attributes, tt.want) {
+			t.Errorf("%s: got %+v, want %+v", tt.in, m.Attributes, tt.want)
+		}
+	}
+}
+
+func TestAttributeValues(t *testing.T) {
+	a := Attributes{{Value: "Laser"}, {Value: float64(3)}, {Value: nil}, {Value: true}}
+	if got, want := a.Values(), []string{"Laser", "3", "true"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestValueStringNumbers(t *testing.T) {
+	for v, want := range map[float64]string{
+		1e6:     "1000000",
+		1.5:     "1.5",
+		-42:     "-42",
+		1e21:    "1000000000000000000000",
+		0.00001: "0.00001",
+	} {
+		if got := (Attribute{Value: v}).ValueString(); got != want {
+			t.Errorf("ValueString(%v) = %q, want %q", v, got, want)
+		}
+	}
+}
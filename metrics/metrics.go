@@ -0,0 +1,104 @@
+package metrics
+
+import (
+	"log/slog"
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const namespace = "ipfs_scraper"
+
+var latencyBuckets = prometheus.ExponentialBuckets(0.01, 2, 12) // 10ms .. ~20s
+
+var (
+	// FetchDuration times gateway requests by gateway host and HTTP status.
+	// The status is "error" when no response was received.
+	FetchDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "fetch_duration_seconds",
+		Help:      "Gateway request latency by gateway and status.",
+		Buckets:   latencyBuckets,
+	}, []string{"gateway", "status"})
+
+	// CIDs counts processed CIDs by result: "fetched", "not_metadata",
+	// "skipped" or "failed".
+	CIDs = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "cids_total",
+		Help:      "CIDs processed by result: fetched, not_metadata, skipped or failed.",
+	}, []string{"result"})
+
+	Retries = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "retries_total",
+		Help:      "Gateway requests retried after a 429, 5xx or connection error.",
+	})
+
+	ParseFailures = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "parse_failures_total",
+		Help:      "Fetched documents that could not be parsed as metadata.",
+	})
+
+	StoreDuration = promauto.NewHistogram(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "store_duration_seconds",
+		Help:      "Latency of writing metadata to the database.",
+		Buckets:   latencyBuckets,
+	})
+
+	QueueDepth = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "queue_depth",
+		Help:      "CIDs waiting to be fetched.",
+	})
+
+	ActiveWorkers = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "active_workers",
+		Help:      "Workers currently processing a CID.",
+	})
+
+	GatewayConcurrency = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "gateway_concurrency",
+		Help:      "Current adaptive concurrency limit by gateway.",
+	}, []string{"gateway"})
+
+	// APIRequestDuration times API requests by route pattern, method and
+	// response code.
+	APIRequestDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "api_request_duration_seconds",
+		Help:      "API request latency by route.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"route", "method", "code"})
+)
+
+// Handler serves the registered metrics in the Prometheus text format.
+func Handler() http.Handler {
+	return promhttp.Handler()
+}
+
+// InstrumentRoute wraps h so its latency is recorded under route.
+func InstrumentRoute(route string, h http.Handler) http.Handler {
+	return promhttp.InstrumentHandlerDuration(
+		APIRequestDuration.MustCurryWith(prometheus.Labels{"route": route}), h)
+}
+
+// Serve exposes /metrics on addr in the background, for processes that
+// don't run the API server.
+func Serve(addr string) {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", Handler())
+
+	go func() {
+		slog.Info("Serving metrics", "addr", addr)
+		if err := http.ListenAndServe(addr, mux); err != nil {
+			slog.Error("Error serving metrics", "error", err)
+		}
+	}()
+}
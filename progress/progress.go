@@ -0,0 +1,308 @@
+package progress
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/coffeendude/ipfs-cids-go-scraper/logging"
+)
+
+const (
+	StateRunning  = "running"
+	StateFinished = "finished"
+
+	barWidth = 30
+)
+
+// Snapshot is the progress of a job at one point in time.
+type Snapshot struct {
+	JobID     string
+	State     string
+	Total     int
+	Completed int
+	Failed    int
+	InFlight  int
+	Rate      float64 // completed CIDs per second
+	Elapsed   time.Duration
+	UpdatedAt time.Time
+}
+
+// ETA estimates the time left at the current rate. It is zero when the
+// total or rate is unknown.
+func (s Snapshot) ETA() time.Duration {
+	left := s.Total - s.Completed
+	if s.Rate <= 0 || left <= 0 {
+		return 0
+	}
+	return time.Duration(float64(left) / s.Rate * float64(time.Second))
+}
+
+// ErrorRate is the share of completed CIDs that failed.
+func (s Snapshot) ErrorRate() float64 {
+	if s.Completed == 0 {
+		return 0
+	}
+	return float64(s.Failed) / float64(s.Completed)
+}
+
+// Percent is how much of the total has completed, or zero if the total is
+// unknown.
+func (s Snapshot) Percent() float64 {
+	if s.Total <= 0 {
+		return 0
+	}
+	return float64(s.Completed) / float64(s.Total) * 100
+}
+
+// Bar renders s as a single terminal line.
+func (s Snapshot) Bar() string {
+	filled := 0
+	if s.Total > 0 {
+		filled = s.Completed * barWidth / s.Total
+	}
+	if filled > barWidth {
+		filled = barWidth
+	}
+	bar := strings.Repeat("=", filled) + strings.Repeat(" ", barWidth-filled)
+	return fmt.Sprintf("[%s] %d/%d %5.1f%%  %.2f/s  ETA %s  errors %.1f%%",
+		bar, s.Completed, s.Total, s.Percent(), s.Rate, formatETA(s.ETA()), s.ErrorRate()*100)
+}
+
+// WriteText writes s in the multi-line form used by the status command.
+func (s Snapshot) WriteText(w io.Writer) error {
+	_, err := fmt.Fprintf(w, `Job %s (%s)
+  Completed  %d/%d (%.1f%%)
+  Failed     %d (%.1f%%)
+  In flight  %d
+  Rate       %.2f CIDs/s
+  ETA        %s
+  Updated    %s
+`,
+		s.JobID, s.State,
+		s.Completed, s.Total, s.Percent(),
+		s.Failed, s.ErrorRate()*100,
+		s.InFlight,
+		s.Rate,
+		formatETA(s.ETA()),
+		s.UpdatedAt.Format(time.RFC3339))
+	return err
+}
+
+func formatETA(d time.Duration) string {
+	if d <= 0 {
+		return "-"
+	}
+	return d.Round(time.Second).String()
+}
+
+// Tracker counts finished CIDs as workers report them. It is safe for
+// concurrent use.
+type Tracker struct {
+	mu        sync.Mutex
+	start     time.Time
+	total     int
+	completed int
+	failed    int
+	inFlight  int
+}
+
+func NewTracker() *Tracker {
+	return &Tracker{start: time.Now()}
+}
+
+// AddTotal adds n CIDs to the expected total.
+func (t *Tracker) AddTotal(n int) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.total += n
+}
+
+// Started marks a CID as being worked on.
+func (t *Tracker) Started() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.inFlight++
+}
+
+// Done marks a started CID as finished.
+func (t *Tracker) Done(failed bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.inFlight--
+	t.completed++
+	if failed {
+		t.failed++
+	}
+}
+
+func (t *Tracker) Snapshot() Snapshot {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	s := Snapshot{
+		State:     StateRunning,
+		Total:     t.total,
+		Completed: t.completed,
+		Failed:    t.failed,
+		InFlight:  t.inFlight,
+		Elapsed:   time.Since(t.start),
+		UpdatedAt: time.Now(),
+	}
+	if secs := s.Elapsed.Seconds(); secs > 0 {
+		s.Rate = float64(s.Completed) / secs
+	}
+	return s
+}
+
+// Reporter shows a tracker's progress while a job runs: a progress bar
+// redrawn in place when Out is a terminal, and a log line every Interval
+// otherwise. If DB is set, progress is also saved to scrape_jobs every
+// Interval so the status command can read it from another process.
+type Reporter struct {
+	JobID    string
+	Tracker  *Tracker
+	Out      *os.File
+	Interval time.Duration
+	DB       *sql.DB
+}
+
+// Run reports progress until ctx is done, then writes a final update
+// marked finished.
+func (r *Reporter) Run(ctx context.Context) {
+	if r.Interval <= 0 {
+		r.Interval = 10 * time.Second
+	}
+	tty := isTerminal(r.Out)
+	interval := r.Interval
+	if tty {
+		interval = 500 * time.Millisecond
+	}
+	lastSaved := time.Time{}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			s := r.snapshot()
+			s.State = StateFinished
+			if tty {
+				fmt.Fprintf(r.Out, "\r%s\n", s.Bar())
+			}
+			r.save(s)
+			return
+		case <-ticker.C:
+			s := r.snapshot()
+			if tty {
+				fmt.Fprintf(r.Out, "\r%s", s.Bar())
+			} else {
+				logger := slog.Default()
+				if s.JobID != "" {
+					logger = logger.With(logging.JobID, s.JobID)
+				}
+				logger.Info("Progress",
+					"completed", s.Completed,
+					"total", s.Total,
+					"failed", s.Failed,
+					"rate", fmt.Sprintf("%.2f/s", s.Rate),
+					"eta", formatETA(s.ETA()))
+			}
+			if time.Since(lastSaved) >= r.Interval {
+				r.save(s)
+				lastSaved = time.Now()
+			}
+		}
+	}
+}
+
+func (r *Reporter) snapshot() Snapshot {
+	s := r.Tracker.Snapshot()
+	s.JobID = r.JobID
+	return s
+}
+
+func (r *Reporter) save(s Snapshot) {
+	if r.DB == nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := Save(ctx, r.DB, s); err != nil {
+		slog.Error("Error saving progress", logging.JobID, s.JobID, "error", err)
+	}
+}
+
+func isTerminal(f *os.File) bool {
+	if f == nil {
+		return false
+	}
+	info, err := f.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
+
+func CreateTable(db *sql.DB) error {
+	_, err := db.Exec(`
+        CREATE TABLE IF NOT EXISTS scrape_jobs (
+            job_id TEXT PRIMARY KEY,
+            state TEXT NOT NULL,
+            total INT NOT NULL,
+            completed INT NOT NULL,
+            failed INT NOT NULL,
+            in_flight INT NOT NULL,
+            rate DOUBLE PRECISION NOT NULL,
+            started_at TIMESTAMPTZ NOT NULL,
+            updated_at TIMESTAMPTZ NOT NULL
+        )
+    `)
+	if err != nil {
+		return fmt.Errorf("error creating jobs table: %w", err)
+	}
+	return nil
+}
+
+// Save records s as the latest progress of its job.
+func Save(ctx context.Context, db *sql.DB, s Snapshot) error {
+	_, err := db.ExecContext(ctx, `
+        INSERT INTO scrape_jobs (job_id, state, total, completed, failed, in_flight, rate, started_at, updated_at)
+        VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)
+        ON CONFLICT (job_id) DO UPDATE SET
+        state = EXCLUDED.state,
+        total = EXCLUDED.total,
+        completed = EXCLUDED.completed,
+        failed = EXCLUDED.failed,
+        in_flight = EXCLUDED.in_flight,
+        rate = EXCLUDED.rate,
+        started_at = EXCLUDED.started_at,
+        updated_at = EXCLUDED.updated_at`,
+		s.JobID, s.State, s.Total, s.Completed, s.Failed, s.InFlight, s.Rate,
+		s.UpdatedAt.Add(-s.Elapsed), s.UpdatedAt)
+	if err != nil {
+		return fmt.Errorf("error saving progress: %w", err)
+	}
+	return nil
+}
+
+// Load returns the last saved progress of jobID, or nil if there is none.
+func Load(ctx context.Context, db *sql.DB, jobID string) (*Snapshot, error) {
+	var s Snapshot
+	var started time.Time
+	err := db.QueryRowContext(ctx, `
+        SELECT job_id, state, total, completed, failed, in_flight, rate, started_at, updated_at
+        FROM scrape_jobs WHERE job_id = $1`, jobID).
+		Scan(&s.JobID, &s.State, &s.Total, &s.Completed, &s.Failed, &s.InFlight, &s.Rate, &started, &s.UpdatedAt)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("error loading progress: %w", err)
+	}
+	s.Elapsed = s.UpdatedAt.Sub(started)
+	return &s, nil
+}
@@ -0,0 +1,92 @@
+package progress
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSnapshot(t *testing.T) {
+	s := Snapshot{Total: 100, Completed: 40, Failed: 10, Rate: 2}
+	if got := s.Percent(); got != 40 {
+		t.Errorf("Percent = %v, want 40", got)
+	}
+	if got := s.ErrorRate(); got != 0.25 {
+		t.Errorf("ErrorRate = %v, want 0.25", got)
+	}
+	if got := s.ETA(); got != 30*time.Second {
+		t.Errorf("ETA = %v, want 30s", got)
+	}
+	bar := s.Bar()
+	if !strings.HasPrefix(bar, "[============                  ] 40/100") {
+		t.Errorf("Bar = %q", bar)
+	}
+	if !strings.Contains(bar, "ETA 30s") || !strings.Contains(bar, "errors 25.0%") {
+		t.Errorf("Bar = %q", bar)
+	}
+}
+
+func TestSnapshotUnknown(t *testing.T) {
+	var s Snapshot
+	if s.Percent() != 0 || s.ErrorRate() != 0 || s.ETA() != 0 {
+		t.Errorf("empty snapshot = %v%%, %v, %v, want zeros", s.Percent(), s.ErrorRate(), s.ETA())
+	}
+	if !strings.Contains(s.Bar(), "ETA -") {
+		t.Errorf("Bar = %q", s.Bar())
+	}
+
+	// More completed than expected, e.g. after the total was undercounted.
+	s = Snapshot{Total: 2, Completed: 5, Rate: 1}
+	if s.ETA() != 0 {
+		t.Errorf("ETA = %v, want 0", s.ETA())
+	}
+	if !strings.HasPrefix(s.Bar(), "["+strings.Repeat("=", barWidth)+"]") {
+		t.Errorf("Bar = %q", s.Bar())
+	}
+}
+
+func TestTracker(t *testing.T) {
+	tr := NewTracker()
+	tr.AddTotal(3)
+	tr.AddTotal(2)
+	for i := 0; i < 3; i++ {
+		tr.Started()
+	}
+	tr.Done(false)
+	tr.Done(true)
+
+	s := tr.Snapshot()
+	if s.State != StateRunning || s.Total != 5 || s.Completed != 2 || s.Failed != 1 || s.InFlight != 1 {
+		t.Fatalf("Snapshot = %+v", s)
+	}
+	if s.Rate <= 0 {
+		t.Errorf("Rate = %v, want > 0", s.Rate)
+	}
+}
+
+func TestWriteText(t *testing.T) {
+	s := Snapshot{
+		JobID:     "crawl-1",
+		State:     StateFinished,
+		Total:     4,
+		Completed: 4,
+		Failed:    1,
+		Rate:      0.5,
+		UpdatedAt: time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC),
+	}
+	var b strings.Builder
+	if err := s.WriteText(&b); err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{
+		"Job crawl-1 (finished)",
+		"Completed  4/4 (100.0%)",
+		"Failed     1 (25.0%)",
+		"ETA        -",
+		"Updated    2024-01-02T03:04:05Z",
+	} {
+		if !strings.Contains(b.String(), want) {
+			t.Errorf("WriteText missing %q:\n%s", want, b.String())
+		}
+	}
+}
@@ -0,0 +1,317 @@
+package queue
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"time"
+)
+
+const (
+	StatusPending = "pending"
+	StatusLeased  = "leased"
+	StatusDone    = "done"
+	StatusFailed  = "failed"
+)
+
+// Item is a single CID leased from the queue by a worker.
+type Item struct {
+	ID       int64
+	JobID    string
+	Cid      string
+	TokenURI string
+	Attempts int
+}
+
+// Entry is a CID to enqueue. Entries with a higher Priority are leased
+// first.
+type Entry struct {
+	Cid      string
+	TokenURI string
+	Priority int
+}
+
+// Queue is a durable work queue stored in Postgres. Several scraper
+// processes can lease from the same table; rows are claimed with
+// FOR UPDATE SKIP LOCKED so no two workers hold the same CID at once.
+type Queue struct {
+	db          *sql.DB
+	owner       string
+	lease       time.Duration
+	maxAttempts int
+}
+
+func New(db *sql.DB, owner string, lease time.Duration, maxAttempts int) *Queue {
+	return &Queue{db: db, owner: owner, lease: lease, maxAttempts: maxAttempts}
+}
+
+func CreateTable(db *sql.DB) error {
+	_, err := db.Exec(`
+        CREATE TABLE IF NOT EXISTS scrape_queue (
+            id BIGSERIAL PRIMARY KEY,
+            job_id TEXT NOT NULL,
+            cid TEXT NOT NULL,
+            token_uri TEXT NOT NULL DEFAULT '',
+            priority INT NOT NULL DEFAULT 0,
+            status TEXT NOT NULL DEFAULT 'pending',
+            attempts INT NOT NULL DEFAULT 0,
+            lease_owner TEXT,
+            lease_expires_at TIMESTAMPTZ,
+            last_error TEXT,
+            error_class TEXT,
+            created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+            updated_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+            UNIQUE (job_id, cid)
+        )
+    `)
+	if err != nil {
+		return fmt.Errorf("error creating queue table: %w", err)
+	}
+
+	_, err = db.Exec(`CREATE INDEX IF NOT EXISTS scrape_queue_status_idx ON scrape_queue (status, priority DESC, id)`)
+	if err != nil {
+		return fmt.Errorf("error creating queue index: %w", err)
+	}
+	return nil
+}
+
+// Enqueue adds entries to the queue under jobID. CIDs already queued for
+// the same job are left untouched. It returns the number of rows inserted.
+func (q *Queue) Enqueue(ctx context.Context, jobID string, entries []Entry) (int, error) {
+	tx, err := q.db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, fmt.Errorf("error starting transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	stmt, err := tx.PrepareContext(ctx, `
+        INSERT INTO scrape_queue (job_id, cid, token_uri, priority)
+        VALUES ($1, $2, $3, $4)
+        ON CONFLICT (job_id, cid) DO NOTHING`)
+	if err != nil {
+		return 0, fmt.Errorf("error preparing enqueue: %w", err)
+	}
+	defer stmt.Close()
+
+	inserted := 0
+	for _, e := range entries {
+		res, err := stmt.ExecContext(ctx, jobID, e.Cid, e.TokenURI, e.Priority)
+		if err != nil {
+			return 0, fmt.Errorf("error enqueueing CID %s: %w", e.Cid, err)
+		}
+		n, err := res.RowsAffected()
+		if err != nil {
+			return 0, fmt.Errorf("error enqueueing CID %s: %w", e.Cid, err)
+		}
+		inserted += int(n)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return 0, fmt.Errorf("error committing enqueue: %w", err)
+	}
+	return inserted, nil
+}
+
+// Depth counts items waiting to be leased, including those whose lease
+// has expired.
+func (q *Queue) Depth(ctx context.Context) (int, error) {
+	var n int
+	err := q.db.QueryRowContext(ctx, `
+        SELECT count(*) FROM scrape_queue
+        WHERE (status = 'pending' OR (status = 'leased' AND lease_expires_at < now()))
+          AND attempts < $1`,
+		q.maxAttempts).Scan(&n)
+	if err != nil {
+		return 0, fmt.Errorf("error counting queue: %w", err)
+	}
+	return n, nil
+}
+
+// ErrorLeaseExpired is the error class of items whose worker went away
+// on their last attempt.
+const ErrorLeaseExpired = "lease_expired"
+
+// Reap fails the items whose lease expired on their last attempt, so a
+// worker dying mid-item can't leave it leased forever. It returns the
+// number of items failed.
+func (q *Queue) Reap(ctx context.Context) (int, error) {
+	res, err := q.db.ExecContext(ctx, `
+        UPDATE scrape_queue SET
+            status = 'failed',
+            lease_owner = NULL,
+            lease_expires_at = NULL,
+            last_error = 'lease expired on the last attempt',
+            error_class = $2,
+            updated_at = now()
+        WHERE status = 'leased' AND lease_expires_at < now() AND attempts >= $1`,
+		q.maxAttempts, ErrorLeaseExpired)
+	if err != nil {
+		return 0, fmt.Errorf("error reaping expired leases: %w", err)
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return 0, fmt.Errorf("error reaping expired leases: %w", err)
+	}
+	return int(n), nil
+}
+
+// Lease claims the highest priority pending item, or an item whose lease
+// has expired, for this queue's owner. Expired items out of attempts are
+// reaped first. It returns nil, nil when there is nothing to do.
+func (q *Queue) Lease(ctx context.Context) (*Item, error) {
+	if _, err := q.Reap(ctx); err != nil {
+		return nil, err
+	}
+	row := q.db.QueryRowContext(ctx, `
+        UPDATE scrape_queue SET
+            status = 'leased',
+            attempts = attempts + 1,
+            lease_owner = $1,
+            lease_expires_at = now() + $2::float8 * interval '1 millisecond',
+            updated_at = now()
+        WHERE id = (
+            SELECT id FROM scrape_queue
+            WHERE (status = 'pending' OR (status = 'leased' AND lease_expires_at < now()))
+              AND attempts < $3
+            ORDER BY priority DESC, id
+            FOR UPDATE SKIP LOCKED
+            LIMIT 1
+        )
+        RETURNING id, job_id, cid, token_uri, attempts`,
+		q.owner, q.lease.Milliseconds(), q.maxAttempts)
+
+	var item Item
+	if err := row.Scan(&item.ID, &item.JobID, &item.Cid, &item.TokenURI, &item.Attempts); err != nil {
+		if err == sql.ErrNoRows {
+			return nil, nil // nothing left to lease
+		}
+		return nil, fmt.Errorf("error leasing item: %w", err)
+	}
+	return &item, nil
+}
+
+// Heartbeat extends the lease on id. It fails if the lease has been lost
+// to another worker.
+func (q *Queue) Heartbeat(ctx context.Context, id int64) error {
+	res, err := q.db.ExecContext(ctx, `
+        UPDATE scrape_queue SET
+            lease_expires_at = now() + $3::float8 * interval '1 millisecond',
+            updated_at = now()
+        WHERE id = $1 AND lease_owner = $2 AND status = 'leased'`,
+		id, q.owner, q.lease.Milliseconds())
+	if err != nil {
+		return fmt.Errorf("error extending lease %d: %w", id, err)
+	}
+	if n, err := res.RowsAffected(); err == nil && n == 0 {
+		return fmt.Errorf("lease %d no longer held by %s", id, q.owner)
+	}
+	return nil
+}
+
+// KeepAlive sends a heartbeat for id every interval until ctx is done.
+func (q *Queue) KeepAlive(ctx context.Context, id int64, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := q.Heartbeat(ctx, id); err != nil && ctx.Err() == nil {
+				return
+			}
+		}
+	}
+}
+
+// Complete marks id as done.
+func (q *Queue) Complete(ctx context.Context, id int64) error {
+	_, err := q.db.ExecContext(ctx, `
+        UPDATE scrape_queue SET
+            status = 'done',
+            lease_owner = NULL,
+            lease_expires_at = NULL,
+            last_error = NULL,
+            error_class = NULL,
+            updated_at = now()
+        WHERE id = $1 AND lease_owner = $2`,
+		id, q.owner)
+	if err != nil {
+		return fmt.Errorf("error completing item %d: %w", id, err)
+	}
+	return nil
+}
+
+// Release hands id back to the queue without counting the attempt, for
+// work this worker gave up on before trying it.
+func (q *Queue) Release(ctx context.Context, id int64) error {
+	_, err := q.db.ExecContext(ctx, `
+        UPDATE scrape_queue SET
+            status = 'pending',
+            attempts = GREATEST(attempts - 1, 0),
+            lease_owner = NULL,
+            lease_expires_at = NULL,
+            updated_at = now()
+        WHERE id = $1 AND lease_owner = $2`,
+		id, q.owner)
+	if err != nil {
+		return fmt.Errorf("error releasing item %d: %w", id, err)
+	}
+	return nil
+}
+
+// Fail records cause and its error class against id. The item goes back
+// to pending so another worker can retry it, unless it has used up its
+// attempts or final is set because a retry would fail the same way.
+func (q *Queue) Fail(ctx context.Context, id int64, class string, cause error, final bool) error {
+	_, err := q.db.ExecContext(ctx, `
+        UPDATE scrape_queue SET
+            status = CASE WHEN attempts >= $3 OR $6 THEN 'failed' ELSE 'pending' END,
+            lease_owner = NULL,
+            lease_expires_at = NULL,
+            last_error = $4,
+            error_class = $5,
+            updated_at = now()
+        WHERE id = $1 AND lease_owner = $2`,
+		id, q.owner, q.maxAttempts, cause.Error(), class, final)
+	if err != nil {
+		return fmt.Errorf("error failing item %d: %w", id, err)
+	}
+	return nil
+}
+
+// Stats counts a job's items by status.
+type Stats struct {
+	Pending, Leased, Done, Failed int
+	// Recent is the number of items finished in the last minute.
+	Recent    int
+	FirstSeen time.Time
+	LastSeen  time.Time
+}
+
+func (s Stats) Total() int {
+	return s.Pending + s.Leased + s.Done + s.Failed
+}
+
+// JobStats summarises the queue items of jobID.
+func JobStats(ctx context.Context, db *sql.DB, jobID string) (Stats, error) {
+	var s Stats
+	var first, last sql.NullTime
+	err := db.QueryRowContext(ctx, `
+        SELECT
+            count(*) FILTER (WHERE status = 'pending'),
+            count(*) FILTER (WHERE status = 'leased'),
+            count(*) FILTER (WHERE status = 'done'),
+            count(*) FILTER (WHERE status = 'failed'),
+            count(*) FILTER (WHERE status IN ('done', 'failed') AND updated_at > now() - interval '1 minute'),
+            min(created_at),
+            max(updated_at)
+        FROM scrape_queue WHERE job_id = $1`, jobID).
+		Scan(&s.Pending, &s.Leased, &s.Done, &s.Failed, &s.Recent, &first, &last)
+	if err != nil {
+		return Stats{}, fmt.Errorf("error reading queue stats: %w", err)
+	}
+	s.FirstSeen, s.LastSeen = first.Time, last.Time
+	return s, nil
+}
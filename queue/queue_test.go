@@ -0,0 +1,122 @@
+package queue
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"os"
+	"testing"
+	"time"
+
+	_ "github.com/lib/pq"
+)
+
+// testDB connects to the database in TEST_DATABASE_URL, in a schema of
+// its own that is dropped afterwards. The test is skipped without one.
+func testDB(t *testing.T) *sql.DB {
+	t.Helper()
+	dsn := os.Getenv("TEST_DATABASE_URL")
+	if dsn == "" {
+		t.Skip("TEST_DATABASE_URL not set")
+	}
+	db, err := sql.Open("postgres", dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// One connection, so the search_path applies to every query.
+	db.SetMaxOpenConns(1)
+	schema := fmt.Sprintf("queue_test_%d", time.Now().UnixNano())
+	if _, err := db.Exec("CREATE SCHEMA " + schema + "; SET search_path TO " + schema); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		db.Exec("DROP SCHEMA " + schema + " CASCADE")
+		db.Close()
+	})
+	if err := CreateTable(db); err != nil {
+		t.Fatal(err)
+	}
+	return db
+}
+
+func TestLeaseReapsExpiredLastAttempt(t *testing.T) {
+	db := testDB(t)
+	ctx := context.Background()
+	q := New(db, "worker-1", time.Millisecond, 1)
+	if _, err := q.Enqueue(ctx, "job", []Entry{{Cid: "QmA"}}); err != nil {
+		t.Fatal(err)
+	}
+
+	item, err := q.Lease(ctx)
+	if err != nil || item == nil {
+		t.Fatalf("Lease = %v, %v", item, err)
+	}
+	// The worker dies without completing or failing the item.
+	time.Sleep(20 * time.Millisecond)
+
+	other := New(db, "worker-2", time.Minute, 1)
+	if item, err := other.Lease(ctx); err != nil || item != nil {
+		t.Fatalf("Lease after expiry = %v, %v, want nothing", item, err)
+	}
+	stats, err := JobStats(ctx, db, "job")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Failed != 1 || stats.Leased != 0 {
+		t.Errorf("stats = %+v, want the item failed", stats)
+	}
+	var class string
+	if err := db.QueryRow("SELECT error_class FROM scrape_queue").Scan(&class); err != nil || class != ErrorLeaseExpired {
+		t.Errorf("error_class = %q, %v", class, err)
+	}
+}
+
+func TestLeaseRetriesExpiredEarlierAttempt(t *testing.T) {
+	db := testDB(t)
+	ctx := context.Background()
+	q := New(db, "worker-1", time.Millisecond, 2)
+	if _, err := q.Enqueue(ctx, "job", []Entry{{Cid: "QmA"}}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := q.Lease(ctx); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(20 * time.Millisecond)
+
+	item, err := New(db, "worker-2", time.Minute, 2).Lease(ctx)
+	if err != nil || item == nil || item.Attempts != 2 {
+		t.Fatalf("Lease after expiry = %+v, %v, want the second attempt", item, err)
+	}
+}
+
+func TestReleaseAfterCancel(t *testing.T) {
+	db := testDB(t)
+	q := New(db, "worker-1", time.Minute, 1)
+	if _, err := q.Enqueue(context.Background(), "job", []Entry{{Cid: "QmA"}}); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	item, err := q.Lease(ctx)
+	if err != nil || item == nil {
+		t.Fatalf("Lease = %v, %v", item, err)
+	}
+
+	// The worker is shut down mid-fetch and gives the item back on a
+	// context that outlives the cancelled one.
+	cancel()
+	if err := q.Release(context.WithoutCancel(ctx), item.ID); err != nil {
+		t.Fatal(err)
+	}
+	stats, err := JobStats(context.Background(), db, "job")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Pending != 1 || stats.Leased != 0 || stats.Failed != 0 {
+		t.Errorf("stats = %+v, want the item pending", stats)
+	}
+	// The attempt wasn't counted, so the last one is still available.
+	item, err = New(db, "worker-2", time.Minute, 1).Lease(context.Background())
+	if err != nil || item == nil || item.Attempts != 1 {
+		t.Fatalf("Lease after release = %+v, %v, want the first attempt", item, err)
+	}
+}
@@ -0,0 +1,294 @@
+package ratelimit
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/coffeendude/ipfs-cids-go-scraper/logging"
+	"golang.org/x/time/rate"
+)
+
+const (
+	// DefaultHost is the key in a rate spec that applies to every gateway
+	// without its own entry.
+	DefaultHost = "*"
+
+	minBackoff = time.Second
+	maxBackoff = time.Minute
+
+	// syncInterval is how often a host's pause is read from the store
+	// again, so that a pause set by another process is noticed.
+	syncInterval = time.Second
+)
+
+// ErrBudgetExhausted is returned by Wait once the daily request budget has
+// been used up.
+var ErrBudgetExhausted = errors.New("daily request budget exhausted")
+
+// Rate is a token bucket setting for one gateway host.
+type Rate struct {
+	PerSecond float64
+	Burst     int
+}
+
+// ParseRates parses a comma-separated list of host=rps[:burst] entries,
+// e.g. "*=10,ipfs.io=2:5". The burst defaults to the rate rounded up, and
+// at least 1.
+func ParseRates(spec string) (map[string]Rate, error) {
+	rates := map[string]Rate{}
+	for _, entry := range strings.Split(spec, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		host, value, ok := strings.Cut(entry, "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid rate limit %q: want host=rps[:burst]", entry)
+		}
+		rps, burst, hasBurst := strings.Cut(value, ":")
+
+		var r Rate
+		var err error
+		if r.PerSecond, err = strconv.ParseFloat(rps, 64); err != nil || r.PerSecond <= 0 {
+			return nil, fmt.Errorf("invalid rate in %q", entry)
+		}
+		if hasBurst {
+			if r.Burst, err = strconv.Atoi(burst); err != nil || r.Burst < 1 {
+				return nil, fmt.Errorf("invalid burst in %q", entry)
+			}
+		} else {
+			r.Burst = int(r.PerSecond + 0.999)
+			if r.Burst < 1 {
+				r.Burst = 1
+			}
+		}
+		rates[strings.TrimSpace(host)] = r
+	}
+	return rates, nil
+}
+
+// Limiter paces requests to each gateway host with a token bucket, enforces
+// a daily request budget, and pauses every caller for a host as soon as any
+// one of them is told to slow down. The budget and pauses are kept in
+// memory unless the limiter shares a Store.
+type Limiter struct {
+	mu          sync.Mutex
+	rates       map[string]Rate
+	buckets     map[string]*rate.Limiter
+	pausedUntil map[string]time.Time
+	backoff     map[string]time.Duration
+	// synced is when each host's pause was last read from the store.
+	synced map[string]time.Time
+	store  Store
+
+	budget int
+	used   int
+	day    string
+	now    func() time.Time
+}
+
+// New creates a limiter. Hosts missing from rates fall back to the
+// DefaultHost entry, or are unlimited if there is none. A budget of 0
+// means no daily cap.
+func New(rates map[string]Rate, budget int) *Limiter {
+	return &Limiter{
+		rates:       rates,
+		buckets:     map[string]*rate.Limiter{},
+		pausedUntil: map[string]time.Time{},
+		backoff:     map[string]time.Duration{},
+		synced:      map[string]time.Time{},
+		budget:      budget,
+		now:         time.Now,
+	}
+}
+
+// Share keeps the budget and pauses in store from now on, so they
+// survive restarts and apply to every process using the same store.
+func (l *Limiter) Share(store Store) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.store = store
+}
+
+// Wait blocks until a request to host is allowed: any back-off for host
+// has passed and its token bucket has a token. Only then is the request
+// counted against the daily budget, so a wait that is given up costs
+// nothing.
+func (l *Limiter) Wait(ctx context.Context, host string) error {
+	if err := l.waitPause(ctx, host); err != nil {
+		return err
+	}
+	if bucket := l.bucket(host); bucket != nil {
+		if err := bucket.Wait(ctx); err != nil {
+			return err
+		}
+	}
+	return l.spend(ctx)
+}
+
+// waitPause blocks while host is paused.
+func (l *Limiter) waitPause(ctx context.Context, host string) error {
+	for {
+		until, err := l.pause(ctx, host)
+		if err != nil {
+			return err
+		}
+		pause := until.Sub(l.now())
+		if pause <= 0 {
+			return nil
+		}
+		t := time.NewTimer(min(pause, syncInterval))
+		select {
+		case <-ctx.Done():
+			t.Stop()
+			return ctx.Err()
+		case <-t.C:
+		}
+	}
+}
+
+// pause returns when host's pause ends, reading the store at most once
+// per syncInterval.
+func (l *Limiter) pause(ctx context.Context, host string) (time.Time, error) {
+	l.mu.Lock()
+	until, store := l.pausedUntil[host], l.store
+	stale := store != nil && l.now().Sub(l.synced[host]) >= syncInterval
+	l.mu.Unlock()
+	if !stale {
+		return until, nil
+	}
+
+	shared, err := store.PausedUntil(ctx, host)
+	if err != nil {
+		return time.Time{}, err
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.synced[host] = l.now()
+	if shared.After(l.pausedUntil[host]) {
+		l.pausedUntil[host] = shared
+	}
+	return l.pausedUntil[host], nil
+}
+
+func (l *Limiter) spend(ctx context.Context) error {
+	l.mu.Lock()
+	if l.budget <= 0 {
+		l.mu.Unlock()
+		return nil
+	}
+	today := l.now().UTC().Format(time.DateOnly)
+	if today != l.day {
+		l.day, l.used = today, 0
+	}
+	if store := l.store; store != nil {
+		l.mu.Unlock()
+		used, ok, err := store.Spend(ctx, today, l.budget)
+		if err != nil {
+			return err
+		}
+		l.mu.Lock()
+		defer l.mu.Unlock()
+		l.used = used
+		if !ok {
+			return ErrBudgetExhausted
+		}
+		return nil
+	}
+	defer l.mu.Unlock()
+
+	if l.used >= l.budget {
+		return ErrBudgetExhausted
+	}
+	l.used++
+	return nil
+}
+
+func (l *Limiter) bucket(host string) *rate.Limiter {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if b, ok := l.buckets[host]; ok {
+		return b
+	}
+	r, ok := l.rates[host]
+	if !ok {
+		r, ok = l.rates[DefaultHost]
+	}
+	var b *rate.Limiter
+	if ok {
+		b = rate.NewLimiter(rate.Limit(r.PerSecond), r.Burst)
+	}
+	l.buckets[host] = b
+	return b
+}
+
+// Throttled pauses all requests to host after it answered 429. retryAfter
+// is the server's Retry-After hint; when it is zero the pause doubles with
+// each consecutive 429, from one second up to a minute.
+func (l *Limiter) Throttled(ctx context.Context, host string, retryAfter time.Duration) {
+	l.mu.Lock()
+	wait := retryAfter
+	if wait <= 0 {
+		wait = l.backoff[host] * 2
+		if wait < minBackoff {
+			wait = minBackoff
+		}
+		if wait > maxBackoff {
+			wait = maxBackoff
+		}
+		l.backoff[host] = wait
+	}
+
+	until := l.now().Add(wait)
+	if !until.After(l.pausedUntil[host]) {
+		l.mu.Unlock()
+		return
+	}
+	l.pausedUntil[host] = until
+	store := l.store
+	l.mu.Unlock()
+
+	slog.Warn("Gateway is throttling, pausing all workers", logging.Gateway, host, logging.Duration, wait)
+	if store != nil {
+		if err := store.Pause(ctx, host, until); err != nil {
+			slog.Error("Error sharing gateway pause", logging.Gateway, host, "error", err)
+		}
+	}
+}
+
+// Succeeded resets host's back-off after a successful request.
+func (l *Limiter) Succeeded(host string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	delete(l.backoff, host)
+}
+
+// Used reports how many requests have been spent from today's budget.
+func (l *Limiter) Used() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.used
+}
+
+// ParseRetryAfter reads a Retry-After header given either as seconds or as
+// an HTTP date. It returns zero if the header is missing or malformed.
+func ParseRetryAfter(h string, now time.Time) time.Duration {
+	if h == "" {
+		return 0
+	}
+	if secs, err := strconv.Atoi(h); err == nil {
+		return time.Duration(secs) * time.Second
+	}
+	if t, err := http.ParseTime(h); err == nil {
+		return t.Sub(now)
+	}
+	return 0
+}
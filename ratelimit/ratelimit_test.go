@@ -0,0 +1,162 @@
+package ratelimit
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestParseRates(t *testing.T) {
+	rates, err := ParseRates("*=10, ipfs.io=2:5,dweb.link=0.5")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]Rate{
+		"*":         {PerSecond: 10, Burst: 10},
+		"ipfs.io":   {PerSecond: 2, Burst: 5},
+		"dweb.link": {PerSecond: 0.5, Burst: 1},
+	}
+	for host, r := range want {
+		if rates[host] != r {
+			t.Errorf("rates[%q] = %+v, want %+v", host, rates[host], r)
+		}
+	}
+
+	for _, bad := range []string{"ipfs.io", "ipfs.io=x", "ipfs.io=1:0", "ipfs.io=-1"} {
+		if _, err := ParseRates(bad); err == nil {
+			t.Errorf("ParseRates(%q) succeeded, want error", bad)
+		}
+	}
+}
+
+func TestDailyBudget(t *testing.T) {
+	l := New(nil, 2)
+	now := time.Date(2023, 11, 26, 23, 59, 0, 0, time.UTC)
+	l.now = func() time.Time { return now }
+	ctx := context.Background()
+
+	for i := 0; i < 2; i++ {
+		if err := l.Wait(ctx, "ipfs.io"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := l.Wait(ctx, "ipfs.io"); !errors.Is(err, ErrBudgetExhausted) {
+		t.Fatalf("third request: got %v, want ErrBudgetExhausted", err)
+	}
+
+	now = now.Add(2 * time.Minute)
+	if err := l.Wait(ctx, "ipfs.io"); err != nil {
+		t.Fatalf("budget should reset at midnight UTC: %v", err)
+	}
+}
+
+func TestThrottledBackoff(t *testing.T) {
+	l := New(nil, 0)
+	now := time.Now()
+	l.now = func() time.Time { return now }
+
+	l.Throttled(context.Background(), "ipfs.io", 0)
+	l.Throttled(context.Background(), "ipfs.io", 0)
+	if got := l.pausedUntil["ipfs.io"].Sub(now); got != 2*time.Second {
+		t.Fatalf("pause after two 429s = %s, want 2s", got)
+	}
+
+	l.Throttled(context.Background(), "ipfs.io", 30*time.Second)
+	if got := l.pausedUntil["ipfs.io"].Sub(now); got != 30*time.Second {
+		t.Fatalf("pause with Retry-After = %s, want 30s", got)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := l.Wait(ctx, "ipfs.io"); err == nil {
+		t.Fatal("Wait should block while the host is paused")
+	}
+	if err := l.Wait(context.Background(), "dweb.link"); err != nil {
+		t.Fatalf("other hosts should not be paused: %v", err)
+	}
+}
+
+// memStore is a Store shared by limiters in one test, standing in for the
+// database replicas share.
+type memStore struct {
+	mu     sync.Mutex
+	used   map[string]int
+	paused map[string]time.Time
+}
+
+func newMemStore() *memStore {
+	return &memStore{used: map[string]int{}, paused: map[string]time.Time{}}
+}
+
+func (s *memStore) Spend(_ context.Context, day string, budget int) (int, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.used[day] >= budget {
+		return s.used[day], false, nil
+	}
+	s.used[day]++
+	return s.used[day], true, nil
+}
+
+func (s *memStore) Pause(_ context.Context, host string, until time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if until.After(s.paused[host]) {
+		s.paused[host] = until
+	}
+	return nil
+}
+
+func (s *memStore) PausedUntil(_ context.Context, host string) (time.Time, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.paused[host], nil
+}
+
+func TestSharedStore(t *testing.T) {
+	store := newMemStore()
+	a, b := New(nil, 3), New(nil, 3)
+	a.Share(store)
+	b.Share(store)
+	ctx := context.Background()
+
+	for _, l := range []*Limiter{a, b, a} {
+		if err := l.Wait(ctx, "ipfs.io"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := b.Wait(ctx, "ipfs.io"); !errors.Is(err, ErrBudgetExhausted) {
+		t.Fatalf("fourth request across replicas: got %v, want ErrBudgetExhausted", err)
+	}
+	if b.Used() != 3 {
+		t.Errorf("Used = %d, want 3", b.Used())
+	}
+
+	// A 429 seen by one replica pauses the other.
+	a.Throttled(ctx, "dweb.link", time.Minute)
+	waitCtx, cancel := context.WithTimeout(ctx, 10*time.Millisecond)
+	defer cancel()
+	if err := b.Wait(waitCtx, "dweb.link"); err == nil {
+		t.Fatal("Wait should block while another replica has paused the host")
+	}
+}
+
+func TestCancelledWaitSpendsNothing(t *testing.T) {
+	l := New(map[string]Rate{DefaultHost: {PerSecond: 0.001, Burst: 1}}, 10)
+	ctx := context.Background()
+	if err := l.Wait(ctx, "ipfs.io"); err != nil {
+		t.Fatal(err)
+	}
+
+	// The bucket is empty for the next 1000s.
+	waitCtx, cancel := context.WithTimeout(ctx, 10*time.Millisecond)
+	defer cancel()
+	if err := l.Wait(waitCtx, "ipfs.io"); err == nil {
+		t.Fatal("Wait should give up when the context ends")
+	}
+	if l.Used() != 1 {
+		t.Errorf("Used = %d after a cancelled wait, want 1", l.Used())
+	}
+}
@@ -0,0 +1,93 @@
+package ratelimit
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"time"
+)
+
+// Store keeps the daily budget and the throttling pauses where every
+// process scraping with the same database sees them, so that replicas
+// share one budget and all back off together.
+type Store interface {
+	// Spend takes one request from the budget of day. It returns how many
+	// requests that day has used, and false if the budget was already
+	// used up.
+	Spend(ctx context.Context, day string, budget int) (used int, ok bool, err error)
+	// Pause makes host wait until until, unless it is already paused for
+	// longer.
+	Pause(ctx context.Context, host string, until time.Time) error
+	// PausedUntil returns when the pause of host ends; the zero time if it
+	// was never paused.
+	PausedUntil(ctx context.Context, host string) (time.Time, error)
+}
+
+// DB is a Store in Postgres.
+type DB struct {
+	db *sql.DB
+}
+
+func NewDB(db *sql.DB) *DB {
+	return &DB{db: db}
+}
+
+func CreateTable(db *sql.DB) error {
+	_, err := db.Exec(`
+        CREATE TABLE IF NOT EXISTS rate_budget (
+            day DATE PRIMARY KEY,
+            used INT NOT NULL DEFAULT 0
+        );
+        CREATE TABLE IF NOT EXISTS rate_pauses (
+            host TEXT PRIMARY KEY,
+            paused_until TIMESTAMPTZ NOT NULL
+        )
+    `)
+	if err != nil {
+		return fmt.Errorf("error creating rate limit tables: %w", err)
+	}
+	return nil
+}
+
+func (s *DB) Spend(ctx context.Context, day string, budget int) (int, bool, error) {
+	// The conditional update leaves the row alone once the budget is used
+	// up, and then returns no row.
+	var used int
+	err := s.db.QueryRowContext(ctx, `
+        INSERT INTO rate_budget (day, used) VALUES ($1, 1)
+        ON CONFLICT (day) DO UPDATE SET used = rate_budget.used + 1
+        WHERE rate_budget.used < $2
+        RETURNING used`,
+		day, budget).Scan(&used)
+	if err == sql.ErrNoRows {
+		return budget, false, nil
+	}
+	if err != nil {
+		return 0, false, fmt.Errorf("error spending request budget: %w", err)
+	}
+	return used, true, nil
+}
+
+func (s *DB) Pause(ctx context.Context, host string, until time.Time) error {
+	_, err := s.db.ExecContext(ctx, `
+        INSERT INTO rate_pauses (host, paused_until) VALUES ($1, $2)
+        ON CONFLICT (host) DO UPDATE SET
+        paused_until = GREATEST(rate_pauses.paused_until, EXCLUDED.paused_until)`,
+		host, until)
+	if err != nil {
+		return fmt.Errorf("error pausing gateway %s: %w", host, err)
+	}
+	return nil
+}
+
+func (s *DB) PausedUntil(ctx context.Context, host string) (time.Time, error) {
+	var until time.Time
+	err := s.db.QueryRowContext(ctx, `SELECT paused_until FROM rate_pauses WHERE host = $1`, host).Scan(&until)
+	if err == sql.ErrNoRows {
+		return time.Time{}, nil
+	}
+	if err != nil {
+		return time.Time{}, fmt.Errorf("error reading pause of gateway %s: %w", host, err)
+	}
+	return until, nil
+}
@@ -0,0 +1,259 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log/slog"
+	"strings"
+
+	"github.com/coffeendude/ipfs-cids-go-scraper/collection"
+	"github.com/coffeendude/ipfs-cids-go-scraper/logging"
+	"github.com/coffeendude/ipfs-cids-go-scraper/mapping"
+	"github.com/coffeendude/ipfs-cids-go-scraper/metadata"
+	"github.com/coffeendude/ipfs-cids-go-scraper/sniff"
+)
+
+// mapper fills the fields of documents whose collection has a mapping.
+type mapper struct {
+	db           *sql.DB
+	byCollection map[string]*mapping.Mapping
+}
+
+// newMapper loads the mapping of every collection that names one.
+func newMapper(ctx context.Context, db *sql.DB) (*mapper, error) {
+	if err := collection.CreateTables(db); err != nil {
+		return nil, err
+	}
+	collections, err := collection.List(ctx, db)
+	if err != nil {
+		return nil, err
+	}
+	return mapperFor(db, collections)
+}
+
+// mapperFor returns a mapper for the mappings of collections, for callers
+// that list them themselves.
+func mapperFor(db *sql.DB, collections []collection.Collection) (*mapper, error) {
+	mp := &mapper{db: db, byCollection: map[string]*mapping.Mapping{}}
+	for _, c := range collections {
+		if c.Mapping == "" {
+			continue
+		}
+		var err error
+		if mp.byCollection[c.ID], err = mapping.LoadStored(c.Mapping, "collection "+c.ID); err != nil {
+			return nil, fmt.Errorf("error loading mapping of collection %s: %w", c.ID, err)
+		}
+	}
+	return mp, nil
+}
+
+// mappingFor returns the mapping of the collection of cid, or nil if it
+// has none.
+func (mp *mapper) mappingFor(ctx context.Context, cid string) (*mapping.Mapping, error) {
+	if len(mp.byCollection) == 0 {
+		return nil, nil
+	}
+	ids, err := collection.Of(ctx, mp.db, cid)
+	if err != nil {
+		return nil, err
+	}
+	for _, id := range ids {
+		if mt, ok := mp.byCollection[id]; ok {
+			return mt, nil
+		}
+	}
+	return nil, nil
+}
+
+// apply fills the fields of m from its raw document, as the mapping of its
+// collection directs, and returns that mapping. Documents outside any
+// collection with a mapping are left alone.
+func (mp *mapper) apply(ctx context.Context, m *metadata.Metadata) (*mapping.Mapping, error) {
+	if len(m.Raw) == 0 {
+		return nil, nil
+	}
+	mt, err := mp.mappingFor(ctx, m.Cid)
+	if mt == nil || err != nil {
+		return nil, err
+	}
+	if err := mt.Apply(m.Raw, m); err != nil {
+		return nil, err
+	}
+	return mt, nil
+}
+
+// mappedDocument returns the document m is validated as: its raw document
+// with the fields mt, its mapping if any, filled overlaid. A document is
+// then judged by the fields stored rather than by where it keeps them.
+func mappedDocument(m *metadata.Metadata, mt *mapping.Mapping) ([]byte, error) {
+	if mt == nil {
+		return m.Raw, nil
+	}
+	return mt.Overlay(m.Raw, m)
+}
+
+// documentRows is a condition on the metadata table, aliased m, that
+// leaves out rows stored for bodies that weren't metadata, which have no
+// raw document by design.
+var documentRows = fmt.Sprintf("(m.media_type IS NULL OR m.media_type IN ('%s', '%s', '%s'))", sniff.JSON, sniff.DAGJSON, sniff.DAGCBOR)
+
+// remapped returns the fields of a stored document as parsing raw, its
+// document, and applying the current mappings gives them.
+func (mp *mapper) remapped(ctx context.Context, stored *metadata.Metadata, raw []byte) (*metadata.Metadata, error) {
+	var m metadata.Metadata
+	if err := json.Unmarshal(raw, &m); err != nil {
+		return nil, fmt.Errorf("error decoding raw document of CID %s: %w", stored.Cid, err)
+	}
+	m.Cid, m.Raw = stored.Cid, raw
+	if _, err := mp.apply(ctx, &m); err != nil {
+		return nil, err
+	}
+	return &m, nil
+}
+
+// changedFields lists the mappable fields that differ between a and b.
+func changedFields(a, b *metadata.Metadata) []string {
+	var changed []string
+	if a.Name != b.Name {
+		changed = append(changed, "name")
+	}
+	if a.Description != b.Description {
+		changed = append(changed, "description")
+	}
+	if a.Image != b.Image {
+		changed = append(changed, "image")
+	}
+	if a.AnimationURL != b.AnimationURL {
+		changed = append(changed, "animation_url")
+	}
+	if !bytes.Equal(a.AttributesJSON(), b.AttributesJSON()) {
+		changed = append(changed, "attributes")
+	}
+	return changed
+}
+
+func updateFields(ctx context.Context, db *sql.DB, m *metadata.Metadata) error {
+	_, err := db.ExecContext(ctx, `
+        UPDATE metadata SET name = $2, description = $3, image = $4, animation_url = $5, attributes = $6
+        WHERE cid = $1`,
+		m.Cid, m.Name, m.Description, m.Image, m.AnimationURL, m.AttributesJSON())
+	if err != nil {
+		return fmt.Errorf("error updating metadata of CID %s: %w", m.Cid, err)
+	}
+	return nil
+}
+
+// runRemap implements the remap subcommand, which fills the metadata
+// fields again from the stored documents, e.g. after a collection's
+// mapping changed, without refetching them.
+func runRemap(args []string) error {
+	fs := flag.NewFlagSet("remap", flag.ExitOnError)
+	var dbc dbConfig
+	var lc logConfig
+	dbc.register(fs)
+	lc.register(fs)
+	coll := fs.String("collection", "", "Only remap the tokens of this collection")
+	cids := fs.String("cids", "", "Only remap these comma-separated CIDs")
+	dryRun := fs.Bool("dry-run", false, "Print what would change without updating the database")
+	fs.Parse(args)
+
+	lc.setup()
+	db, err := dbc.connect()
+	if err != nil {
+		return fail("Error connecting to database", err)
+	}
+	defer db.Close()
+	if err := ensureMetadataTable(db); err != nil {
+		return fail("Error creating metadata table", err)
+	}
+
+	ctx := context.Background()
+	mp, err := newMapper(ctx, db)
+	if err != nil {
+		return fail("Error loading mappings", err)
+	}
+
+	q := "SELECT " + metadata.QualifiedColumns("m") + ", m.raw FROM metadata m"
+	where := []string{documentRows}
+	var qargs []any
+	if *coll != "" {
+		qargs = append(qargs, *coll)
+		where = append(where, "EXISTS (SELECT 1 FROM collection_tokens t WHERE t.cid = m.cid AND t.collection_id = $1)")
+	}
+	if list := splitList(*cids); len(list) > 0 {
+		var ph []string
+		for _, cid := range list {
+			qargs = append(qargs, cid)
+			ph = append(ph, fmt.Sprintf("$%d", len(qargs)))
+		}
+		where = append(where, "m.cid IN ("+strings.Join(ph, ", ")+")")
+	}
+	q += " WHERE " + strings.Join(where, " AND ") + " ORDER BY m.cid"
+
+	rows, err := db.QueryContext(ctx, q, qargs...)
+	if err != nil {
+		return fail("Error querying metadata", err)
+	}
+	defer rows.Close()
+
+	var total, changed, failed int
+	var noRaw []string
+	for rows.Next() {
+		var raw []byte
+		stored, err := metadata.Scan(rows, &raw)
+		if err != nil {
+			return fail("Error scanning row", err)
+		}
+		if raw == nil {
+			noRaw = append(noRaw, stored.Cid)
+			continue
+		}
+		total++
+		m, err := mp.remapped(ctx, stored, raw)
+		if err != nil {
+			slog.Warn("Error remapping metadata", logging.CID, stored.Cid, "error", err)
+			failed++
+			continue
+		}
+		fields := changedFields(stored, m)
+		if len(fields) == 0 {
+			continue
+		}
+		changed++
+		fmt.Printf("%s: %s\n", m.Cid, strings.Join(fields, ", "))
+		if *dryRun {
+			continue
+		}
+		if err := updateFields(ctx, db, m); err != nil {
+			return fail("Error updating metadata", err)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return fail("Error reading rows", err)
+	}
+	note := ""
+	if *dryRun {
+		note = " (dry run, nothing updated)"
+	}
+	fmt.Printf("Remapped %d documents: %d changed, %d failed%s\n", total, changed, failed, note)
+	printNoRaw(noRaw)
+	if changed > 0 && !*dryRun {
+		fmt.Println("Run validate to check the remapped documents against their schemas")
+	}
+	return nil
+}
+
+// printNoRaw lists the CIDs that have no raw document to work from.
+func printNoRaw(cids []string) {
+	if len(cids) == 0 {
+		return
+	}
+	fmt.Printf("%d documents have no raw document and need scraping again:\n", len(cids))
+	for _, cid := range cids {
+		fmt.Printf("  %s\n", cid)
+	}
+}
@@ -0,0 +1,246 @@
+package report
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"sync"
+	"text/tabwriter"
+	"time"
+)
+
+// Recorder collects the outcome of every CID in a scrape run. It is safe
+// for concurrent use by workers.
+type Recorder struct {
+	mu        sync.Mutex
+	start     time.Time
+	total     int
+	succeeded int
+	// notMetadata counts, by media type, the CIDs that were stored but
+	// turned out not to be metadata.
+	notMetadata map[string]int
+	failed      map[string]int
+	retried     int
+	skipped     int
+	duplicates  int
+	bytes       int64
+	latencies   map[string][]time.Duration
+}
+
+func NewRecorder() *Recorder {
+	return &Recorder{
+		start:       time.Now(),
+		failed:      map[string]int{},
+		notMetadata: map[string]int{},
+		latencies:   map[string][]time.Duration{},
+	}
+}
+
+// Start marks the start of the run, from which Duration is measured.
+// Without it, Duration runs from NewRecorder.
+func (r *Recorder) Start() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.start = time.Now()
+}
+
+// Queued adds n CIDs to the run's total.
+func (r *Recorder) Queued(n int) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.total += n
+}
+
+// Duplicate records an input CID that was dropped because it was already
+// queued in this run.
+func (r *Recorder) Duplicate() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.duplicates++
+}
+
+func (r *Recorder) Succeeded() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.succeeded++
+}
+
+// NotMetadata records a CID whose body was stored by its media type
+// because it wasn't metadata. It is stored instead of treated as a
+// failure, but isn't counted as succeeded either.
+func (r *Recorder) NotMetadata(mediaType string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.notMetadata[mediaType]++
+}
+
+// Failed records a CID that failed with an error of the given class.
+func (r *Recorder) Failed(class string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.failed[class]++
+}
+
+// Skipped records a CID that was never attempted, e.g. because the run was
+// cancelled or the request budget ran out.
+func (r *Recorder) Skipped() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.skipped++
+}
+
+func (r *Recorder) Retried() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.retried++
+}
+
+// Response records a gateway response of n bytes that took d.
+func (r *Recorder) Response(gateway string, d time.Duration, n int64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.latencies[gateway] = append(r.latencies[gateway], d)
+	r.bytes += n
+}
+
+// Summary is the end-of-run report.
+type Summary struct {
+	Total     int `json:"total"`
+	Succeeded int `json:"succeeded"`
+	// NotMetadataTotal is the sum of NotMetadata, which breaks it down by
+	// media type.
+	NotMetadataTotal int                       `json:"not_metadata_total"`
+	NotMetadata      map[string]int            `json:"not_metadata,omitempty"`
+	Failed           int                       `json:"failed"`
+	FailedByClass    map[string]int            `json:"failed_by_class"`
+	Retried          int                       `json:"retried"`
+	Skipped          int                       `json:"skipped"`
+	Duplicates       int                       `json:"duplicates"`
+	BytesDownloaded  int64                     `json:"bytes_downloaded"`
+	Gateways         map[string]GatewayLatency `json:"gateways"`
+	Duration         time.Duration             `json:"duration_ns"`
+	PerSecond        float64                   `json:"cids_per_second"`
+	FailureRatio     float64                   `json:"failure_ratio"`
+}
+
+// GatewayLatency summarises the responses received from one gateway.
+type GatewayLatency struct {
+	Requests int           `json:"requests"`
+	P50      time.Duration `json:"p50_ns"`
+	P95      time.Duration `json:"p95_ns"`
+}
+
+// Summary returns the report as of now.
+func (r *Recorder) Summary() Summary {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	s := Summary{
+		Total:           r.total,
+		Succeeded:       r.succeeded,
+		NotMetadata:     map[string]int{},
+		FailedByClass:   map[string]int{},
+		Retried:         r.retried,
+		Skipped:         r.skipped,
+		Duplicates:      r.duplicates,
+		BytesDownloaded: r.bytes,
+		Gateways:        map[string]GatewayLatency{},
+		Duration:        time.Since(r.start),
+	}
+	for mediaType, n := range r.notMetadata {
+		s.NotMetadata[mediaType] = n
+		s.NotMetadataTotal += n
+	}
+	for class, n := range r.failed {
+		s.FailedByClass[class] = n
+		s.Failed += n
+	}
+	for gw, ds := range r.latencies {
+		sorted := append([]time.Duration(nil), ds...)
+		sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+		s.Gateways[gw] = GatewayLatency{
+			Requests: len(sorted),
+			P50:      percentile(sorted, 0.50),
+			P95:      percentile(sorted, 0.95),
+		}
+	}
+
+	processed := s.Succeeded + s.NotMetadataTotal + s.Failed
+	if secs := s.Duration.Seconds(); secs > 0 {
+		s.PerSecond = float64(processed) / secs
+	}
+	if processed > 0 {
+		s.FailureRatio = float64(s.Failed) / float64(processed)
+	}
+	return s
+}
+
+// percentile returns the p-th percentile of sorted using the nearest-rank
+// method.
+func percentile(sorted []time.Duration, p float64) time.Duration {
+	if len(sorted) == 0 {
+		return 0
+	}
+	i := int(p*float64(len(sorted))+0.5) - 1
+	if i < 0 {
+		i = 0
+	}
+	if i >= len(sorted) {
+		i = len(sorted) - 1
+	}
+	return sorted[i]
+}
+
+// WriteText writes the summary in human-readable form.
+func (s Summary) WriteText(w io.Writer) error {
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "Scrape summary")
+	fmt.Fprintf(tw, "  Total\t%d\n", s.Total)
+	fmt.Fprintf(tw, "  Succeeded\t%d\n", s.Succeeded)
+	fmt.Fprintf(tw, "  Not metadata\t%d\n", s.NotMetadataTotal)
+	for _, mediaType := range sortedKeys(s.NotMetadata) {
+		fmt.Fprintf(tw, "    %s\t%d\n", mediaType, s.NotMetadata[mediaType])
+	}
+	fmt.Fprintf(tw, "  Failed\t%d (%.1f%%)\n", s.Failed, s.FailureRatio*100)
+	for _, class := range sortedKeys(s.FailedByClass) {
+		fmt.Fprintf(tw, "    %s\t%d\n", class, s.FailedByClass[class])
+	}
+	fmt.Fprintf(tw, "  Retried\t%d\n", s.Retried)
+	fmt.Fprintf(tw, "  Skipped\t%d\n", s.Skipped)
+	fmt.Fprintf(tw, "  Duplicates\t%d\n", s.Duplicates)
+	fmt.Fprintf(tw, "  Downloaded\t%d bytes\n", s.BytesDownloaded)
+	fmt.Fprintf(tw, "  Duration\t%s\n", s.Duration.Round(time.Millisecond))
+	fmt.Fprintf(tw, "  Throughput\t%.2f CIDs/s\n", s.PerSecond)
+	if len(s.Gateways) > 0 {
+		fmt.Fprintln(tw, "  Gateway\tRequests\tp50\tp95")
+		for _, gw := range sortedKeys(s.Gateways) {
+			l := s.Gateways[gw]
+			fmt.Fprintf(tw, "    %s\t%d\t%s\t%s\n", gw, l.Requests,
+				l.P50.Round(time.Millisecond), l.P95.Round(time.Millisecond))
+		}
+	}
+	return tw.Flush()
+}
+
+// WriteJSONFile writes the summary as indented JSON to path.
+func (s Summary) WriteJSONFile(path string) error {
+	b, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return fmt.Errorf("error encoding report: %w", err)
+	}
+	if err := os.WriteFile(path, append(b, '\n'), 0o644); err != nil {
+		return fmt.Errorf("error writing report: %w", err)
+	}
+	return nil
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,54 @@
+package report
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSummary(t *testing.T) {
+	r := NewRecorder()
+	r.Queued(6)
+	r.Duplicate()
+	r.Succeeded()
+	r.Succeeded()
+	r.NotMetadata("text/html")
+	r.Failed("http_5xx")
+	r.Skipped()
+	r.Retried()
+	for i := 1; i <= 20; i++ {
+		r.Response("ipfs.io", time.Duration(i)*time.Millisecond, 100)
+	}
+
+	s := r.Summary()
+	if s.Total != 6 || s.Succeeded != 2 || s.Failed != 1 || s.Skipped != 1 || s.Duplicates != 1 || s.Retried != 1 {
+		t.Fatalf("unexpected counts: %+v", s)
+	}
+	if s.NotMetadataTotal != 1 || s.NotMetadata["text/html"] != 1 {
+		t.Errorf("NotMetadata = %v", s.NotMetadata)
+	}
+	if s.FailedByClass["http_5xx"] != 1 {
+		t.Errorf("FailedByClass = %v", s.FailedByClass)
+	}
+	// The document that isn't metadata counts as processed, not failed.
+	if s.FailureRatio != 0.25 {
+		t.Errorf("FailureRatio = %v, want 0.25", s.FailureRatio)
+	}
+	if s.BytesDownloaded != 2000 {
+		t.Errorf("BytesDownloaded = %d, want 2000", s.BytesDownloaded)
+	}
+	gw := s.Gateways["ipfs.io"]
+	if gw.Requests != 20 || gw.P50 != 10*time.Millisecond || gw.P95 != 19*time.Millisecond {
+		t.Errorf("gateway latency = %+v", gw)
+	}
+
+	var b strings.Builder
+	if err := s.WriteText(&b); err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{"Succeeded", "Not metadata", "text/html", "http_5xx", "ipfs.io"} {
+		if !strings.Contains(b.String(), want) {
+			t.Errorf("text report missing %q:\n%s", want, b.String())
+		}
+	}
+}
@@ -0,0 +1,232 @@
+// Package resolve turns token URIs into the source a document is fetched
+// from. IPFS gateway URLs are normalised back to the CID they serve, so the
+// scraper can fetch them through its own gateways, and data: URIs are
+// decoded in place.
+package resolve
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+// Schemes a Source can have.
+const (
+	SchemeIPFS  = "ipfs"
+	SchemeIPNS  = "ipns"
+	SchemeAR    = "ar"
+	SchemeHTTPS = "https"
+	SchemeHTTP  = "http"
+	SchemeData  = "data"
+)
+
+// ErrUnsupported is returned for a URI whose scheme can't be fetched.
+var ErrUnsupported = errors.New("unsupported URI scheme")
+
+// Source is where a token's metadata comes from.
+type Source struct {
+	// URI is the URI as given.
+	URI    string
+	Scheme string
+	// Path is the IPFS path for SchemeIPFS, e.g. "<CID>/42.json", the name
+	// and path for SchemeIPNS, e.g. "<key or domain>/42.json", or the
+	// transaction ID and path for SchemeAR.
+	Path string
+	// URL is the address to fetch for SchemeHTTP and SchemeHTTPS.
+	URL string
+	// MediaType and Data hold a decoded data: URI.
+	MediaType string
+	Data      []byte
+}
+
+// Networks a document can come from.
+const (
+	NetworkIPFS    = "ipfs"
+	NetworkArweave = "arweave"
+	NetworkWeb     = "web"
+	NetworkOnChain = "onchain"
+)
+
+// Network names where the document lives. Data URIs count as on-chain,
+// since that is where token URIs embedding their metadata come from.
+func (s *Source) Network() string {
+	switch s.Scheme {
+	case SchemeIPFS, SchemeIPNS:
+		return NetworkIPFS
+	case SchemeAR:
+		return NetworkArweave
+	case SchemeData:
+		return NetworkOnChain
+	}
+	return NetworkWeb
+}
+
+// Immutable reports whether what s points at can never change: IPFS paths,
+// Arweave transactions and data: URIs are content addressed, while IPNS
+// names and web URLs can point at something else tomorrow.
+func (s *Source) Immutable() bool {
+	switch s.Scheme {
+	case SchemeIPFS, SchemeAR, SchemeData:
+		return true
+	}
+	return false
+}
+
+// Key identifies the document in storage: the IPFS path for IPFS sources,
+// a content hash for data: URIs, and the normalised URI otherwise. IPNS
+// documents are keyed by name, since what the name points at changes.
+func (s *Source) Key() string {
+	switch s.Scheme {
+	case SchemeIPFS:
+		return s.Path
+	case SchemeIPNS:
+		return "ipns://" + s.Path
+	case SchemeAR:
+		return "ar://" + s.Path
+	case SchemeData:
+		sum := sha256.Sum256(s.Data)
+		return "data:sha256," + hex.EncodeToString(sum[:])
+	}
+	return s.URL
+}
+
+// Parse resolves uri. A string without a scheme is taken to be an IPFS
+// path, so bare CIDs keep working.
+func Parse(uri string) (*Source, error) {
+	uri = strings.TrimSpace(uri)
+	if uri == "" {
+		return nil, errors.New("empty URI")
+	}
+	src := &Source{URI: uri}
+
+	scheme, rest, ok := strings.Cut(uri, ":")
+	if !ok || strings.ContainsAny(scheme, "/.") {
+		if name, ok := strings.CutPrefix(strings.TrimPrefix(uri, "/"), "ipns/"); ok && name != "" {
+			src.Scheme, src.Path = SchemeIPNS, name
+			return src, nil
+		}
+		src.Scheme, src.Path = SchemeIPFS, ipfsPath(uri)
+		return src, nil
+	}
+
+	switch strings.ToLower(scheme) {
+	case SchemeIPFS:
+		path := ipfsPath(strings.TrimPrefix(rest, "//"))
+		if path == "" {
+			return nil, fmt.Errorf("invalid IPFS URI %q", uri)
+		}
+		// Path is unescaped, and escaped again when it is requested.
+		if p, err := url.PathUnescape(path); err == nil {
+			path = p
+		}
+		src.Scheme, src.Path = SchemeIPFS, path
+	case SchemeIPNS:
+		name := strings.TrimPrefix(strings.TrimPrefix(rest, "//"), "ipns/")
+		if name == "" {
+			return nil, fmt.Errorf("invalid IPNS URI %q", uri)
+		}
+		src.Scheme, src.Path = SchemeIPNS, name
+	case SchemeAR:
+		path := strings.TrimPrefix(rest, "//")
+		if path == "" {
+			return nil, fmt.Errorf("invalid Arweave URI %q", uri)
+		}
+		src.Scheme, src.Path = SchemeAR, path
+	case SchemeData:
+		mediaType, data, err := decodeData(rest)
+		if err != nil {
+			return nil, fmt.Errorf("error decoding data URI: %w", err)
+		}
+		src.Scheme, src.MediaType, src.Data = SchemeData, mediaType, data
+	case SchemeHTTP, SchemeHTTPS:
+		u, err := url.Parse(uri)
+		if err != nil || u.Host == "" {
+			return nil, fmt.Errorf("invalid URL %q", uri)
+		}
+		if path := gatewayPath(u); path != "" {
+			src.Scheme, src.Path = SchemeIPFS, path
+			return src, nil
+		}
+		if _, name, ok := strings.Cut(u.Path, "/ipns/"); ok && name != "" {
+			src.Scheme, src.Path = SchemeIPNS, name
+			return src, nil
+		}
+		src.Scheme, src.URL = strings.ToLower(scheme), uri
+	default:
+		return nil, fmt.Errorf("%w: %s", ErrUnsupported, scheme)
+	}
+	return src, nil
+}
+
+// ipfsPath strips a leading /ipfs/ or ipfs/ from p.
+func ipfsPath(p string) string {
+	p = strings.TrimPrefix(p, "/")
+	p = strings.TrimPrefix(p, "ipfs/")
+	return strings.TrimPrefix(p, "/")
+}
+
+// gatewayPath returns the IPFS path served by a gateway URL, either in path
+// form (https://host/ipfs/<CID>/...) or subdomain form
+// (https://<CID>.ipfs.host/...), or "" if u isn't a gateway URL.
+func gatewayPath(u *url.URL) string {
+	if _, path, ok := strings.Cut(u.Path, "/ipfs/"); ok && IsCID(strings.Split(path, "/")[0]) {
+		return path
+	}
+	if cid, _, ok := strings.Cut(u.Hostname(), ".ipfs."); ok && IsCID(cid) {
+		return strings.TrimSuffix(cid+u.Path, "/")
+	}
+	return ""
+}
+
+// IsCID reports whether s looks like a CID: a base58 CIDv0 or a base32
+// CIDv1. It doesn't check the multihash.
+func IsCID(s string) bool {
+	if len(s) == 46 && strings.HasPrefix(s, "Qm") {
+		return strings.IndexFunc(s, func(r rune) bool {
+			return !strings.ContainsRune("123456789ABCDEFGHJKLMNPQRSTUVWXYZabcdefghijkmnopqrstuvwxyz", r)
+		}) < 0
+	}
+	if len(s) >= 50 && s[0] == 'b' {
+		return strings.IndexFunc(strings.ToLower(s[1:]), func(r rune) bool {
+			return !strings.ContainsRune("abcdefghijklmnopqrstuvwxyz234567", r)
+		}) < 0
+	}
+	return false
+}
+
+// decodeData decodes the part of a data: URI after the colon.
+func decodeData(rest string) (string, []byte, error) {
+	meta, payload, ok := strings.Cut(rest, ",")
+	if !ok {
+		return "", nil, errors.New("missing comma")
+	}
+	params := strings.Split(meta, ";")
+	mediaType := strings.TrimSpace(params[0])
+	if mediaType == "" {
+		mediaType = "text/plain"
+	}
+	if params[len(params)-1] == "base64" {
+		if unescaped, err := url.PathUnescape(payload); err == nil {
+			payload = unescaped
+		}
+		payload = strings.TrimRight(strings.Join(strings.Fields(payload), ""), "=")
+		data, err := base64.RawStdEncoding.DecodeString(payload)
+		if err != nil {
+			data, err = base64.RawURLEncoding.DecodeString(payload)
+		}
+		if err != nil {
+			return "", nil, fmt.Errorf("invalid base64: %w", err)
+		}
+		return mediaType, data, nil
+	}
+	data, err := url.PathUnescape(payload)
+	if err != nil {
+		// On-chain JSON is often embedded without escaping a stray %.
+		data = payload
+	}
+	return mediaType, []byte(data), nil
+}
@@ -0,0 +1,95 @@
+package resolve
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+const (
+	cidV0 = "QmYwAPJzv5CZsnA625s3Xf2nemtYgPpHdWEz79ojWnPbdG"
+	cidV1 = "bafybeia67q6eabx2rzu6datbh3rnsoj7cpupudckijgc5vtxf46zpnk2t4"
+)
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		uri, scheme, key string
+	}{
+		{cidV0, SchemeIPFS, cidV0},
+		{cidV1 + "/3885", SchemeIPFS, cidV1 + "/3885"},
+		{"/ipfs/" + cidV0 + "/1.json", SchemeIPFS, cidV0 + "/1.json"},
+		{"ipfs://" + cidV0 + "/1", SchemeIPFS, cidV0 + "/1"},
+		{"ipfs://ipfs/" + cidV0, SchemeIPFS, cidV0},
+		{"ipfs://" + cidV0 + "/My%20Token.json", SchemeIPFS, cidV0 + "/My Token.json"},
+		{"https://ipfs.io/ipfs/" + cidV1 + "/7", SchemeIPFS, cidV1 + "/7"},
+		{"https://" + cidV1 + ".ipfs.dweb.link/7", SchemeIPFS, cidV1 + "/7"},
+		{"https://example.com/ipfs/not-a-cid/1", SchemeHTTPS, "https://example.com/ipfs/not-a-cid/1"},
+		{"http://api.example.com/token/1", SchemeHTTP, "http://api.example.com/token/1"},
+		{"ipns://k51qzi5uqu5dlvj2baxnqndepeb86cbk3ng7n3i46uzyxzyqj2xjonzllnv0v8/1", SchemeIPNS, "ipns://k51qzi5uqu5dlvj2baxnqndepeb86cbk3ng7n3i46uzyxzyqj2xjonzllnv0v8/1"},
+		{"/ipns/apes.example/1.json", SchemeIPNS, "ipns://apes.example/1.json"},
+		{"https://ipfs.io/ipns/apes.example/2", SchemeIPNS, "ipns://apes.example/2"},
+		{"ar://bNbA3TEQVL60xlgCcqdz4ZPHFZ711cZ3hmkpGttDt_U/1", SchemeAR, "ar://bNbA3TEQVL60xlgCcqdz4ZPHFZ711cZ3hmkpGttDt_U/1"},
+	}
+	for _, tt := range tests {
+		src, err := Parse(tt.uri)
+		if err != nil {
+			t.Errorf("Parse(%q): %v", tt.uri, err)
+			continue
+		}
+		if src.Scheme != tt.scheme || src.Key() != tt.key || src.Network() == "" {
+			t.Errorf("Parse(%q) = %s %q, want %s %q", tt.uri, src.Scheme, src.Key(), tt.scheme, tt.key)
+		}
+	}
+
+	for _, uri := range []string{"", "ipfs://", "ipns://", "ar://", "https:///x", "data:application/json;base64"} {
+		if _, err := Parse(uri); err == nil {
+			t.Errorf("Parse(%q): expected an error", uri)
+		}
+	}
+	if _, err := Parse("ftp://example.com/1"); !errors.Is(err, ErrUnsupported) {
+		t.Errorf("ftp: got %v, want ErrUnsupported", err)
+	}
+}
+
+func TestParseData(t *testing.T) {
+	const doc = `{"name":"Ape #1","description":"100% on-chain"}`
+	for _, uri := range []string{
+		"data:application/json;base64,eyJuYW1lIjoiQXBlICMxIiwiZGVzY3JpcHRpb24iOiIxMDAlIG9uLWNoYWluIn0=",
+		"data:application/json;base64,eyJuYW1lIjoiQXBlICMxIiwiZGVzY3JpcHRpb24iOiIxMDAlIG9uLWNoYWluIn0",
+		"data:application/json;charset=utf-8," + `{"name":"Ape #1","description":"100%25 on-chain"}`,
+		"data:application/json," + doc,
+	} {
+		src, err := Parse(uri)
+		if err != nil {
+			t.Errorf("Parse(%q): %v", uri, err)
+			continue
+		}
+		if src.Scheme != SchemeData || src.MediaType != "application/json" || string(src.Data) != doc {
+			t.Errorf("Parse(%q) = %s %s %q", uri, src.Scheme, src.MediaType, src.Data)
+		}
+		if !strings.HasPrefix(src.Key(), "data:sha256,") {
+			t.Errorf("Parse(%q) key = %q", uri, src.Key())
+		}
+	}
+}
+
+func TestImmutable(t *testing.T) {
+	for uri, want := range map[string]bool{
+		"QmA/1":                true,
+		"ipfs://QmA/image.png": true,
+		"https://ipfs.io/ipfs/bafybeia67q6eabx2rzu6datbh3rnsoj7cpupudckijgc5vtxf46zpnk2t4/1": true,
+		"ar://tx/1":                 true,
+		"data:sha256,0123abcd":      true,
+		"ipns://apes.example/1":     false,
+		"https://example.com/1.png": false,
+	} {
+		src, err := Parse(uri)
+		if err != nil {
+			t.Errorf("Parse(%q): %v", uri, err)
+			continue
+		}
+		if got := src.Immutable(); got != want {
+			t.Errorf("Parse(%q).Immutable() = %v, want %v", uri, got, want)
+		}
+	}
+}
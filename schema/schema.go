@@ -0,0 +1,452 @@
+// Package schema validates metadata documents against JSON Schemas: the
+// built-in ERC-721 and ERC-1155 schemas or a schema file per collection.
+//
+// The keywords supported are type, enum, const, required, properties,
+// additionalProperties, items, minItems, maxItems, minLength, maxLength,
+// pattern, format (uri), minimum, maximum, allOf, anyOf and oneOf, along
+// with annotations such as title and description. A schema using any other
+// keyword, such as $ref, is rejected rather than half checked. One
+// extension, "x-recommended", lists properties whose absence is a warning
+// rather than an error.
+package schema
+
+import (
+	"bytes"
+	"embed"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net/url"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"unicode/utf8"
+)
+
+// Built-in schemas.
+const (
+	ERC721  = "erc721"
+	ERC1155 = "erc1155"
+)
+
+//go:embed erc721.json erc1155.json
+var builtin embed.FS
+
+// Schema is a compiled JSON Schema.
+type Schema struct {
+	// Name is the built-in name or file the schema was loaded from, or the
+	// name it was given by LoadStored.
+	Name string
+
+	types       []string
+	enum        []any
+	constant    *any
+	required    []string
+	recommended []string
+	properties  map[string]*Schema
+	// additional is nil when additional properties are allowed, or the
+	// schema they must match; noAdditional forbids them.
+	additional   *Schema
+	noAdditional bool
+	items        *Schema
+	minItems     *int
+	maxItems     *int
+	minLength    *int
+	maxLength    *int
+	pattern      *regexp.Regexp
+	format       string
+	minimum      *float64
+	maximum      *float64
+	allOf        []*Schema
+	anyOf        []*Schema
+	oneOf        []*Schema
+}
+
+// Load returns the built-in schema called ref, or else the schema in the
+// file at path ref.
+func Load(ref string) (*Schema, error) {
+	data, err := builtin.ReadFile(ref + ".json")
+	if err != nil {
+		if data, err = os.ReadFile(ref); err != nil {
+			return nil, fmt.Errorf("error reading schema %s: %w", ref, err)
+		}
+	}
+	s, err := Parse(data)
+	if err != nil {
+		return nil, fmt.Errorf("error in schema %s: %w", ref, err)
+	}
+	s.Name = ref
+	return s, nil
+}
+
+// keywords are the keys a schema may have: those of rawSchema, and
+// annotations that don't affect validation.
+var keywords = map[string]bool{
+	"type": true, "enum": true, "const": true, "required": true, "x-recommended": true,
+	"properties": true, "additionalProperties": true, "items": true,
+	"minItems": true, "maxItems": true, "minLength": true, "maxLength": true,
+	"pattern": true, "format": true, "minimum": true, "maximum": true,
+	"allOf": true, "anyOf": true, "oneOf": true,
+
+	"$schema": true, "$id": true, "$comment": true, "title": true, "description": true,
+	"default": true, "examples": true, "deprecated": true, "readOnly": true, "writeOnly": true,
+}
+
+// IsBuiltin reports whether name is the name of a built-in schema.
+func IsBuiltin(name string) bool {
+	_, err := builtin.ReadFile(name + ".json")
+	return err == nil
+}
+
+// LoadStored compiles a schema as a collection stores it: a built-in
+// schema's name, or the schema document itself, which is called name.
+func LoadStored(stored, name string) (*Schema, error) {
+	if IsBuiltin(stored) {
+		return Load(stored)
+	}
+	s, err := Parse([]byte(stored))
+	if err != nil {
+		return nil, fmt.Errorf("error in schema %s: %w", name, err)
+	}
+	s.Name = name
+	return s, nil
+}
+
+// rawSchema is a schema as written, before compiling.
+type rawSchema struct {
+	Type                 json.RawMessage            `json:"type"`
+	Enum                 []any                      `json:"enum"`
+	Const                json.RawMessage            `json:"const"`
+	Required             []string                   `json:"required"`
+	Recommended          []string                   `json:"x-recommended"`
+	Properties           map[string]json.RawMessage `json:"properties"`
+	AdditionalProperties json.RawMessage            `json:"additionalProperties"`
+	Items                json.RawMessage            `json:"items"`
+	MinItems             *int                       `json:"minItems"`
+	MaxItems             *int                       `json:"maxItems"`
+	MinLength            *int                       `json:"minLength"`
+	MaxLength            *int                       `json:"maxLength"`
+	Pattern              *string                    `json:"pattern"`
+	Format               string                     `json:"format"`
+	Minimum              *float64                   `json:"minimum"`
+	Maximum              *float64                   `json:"maximum"`
+	AllOf                []json.RawMessage          `json:"allOf"`
+	AnyOf                []json.RawMessage          `json:"anyOf"`
+	OneOf                []json.RawMessage          `json:"oneOf"`
+}
+
+// Parse compiles a JSON Schema document.
+func Parse(data []byte) (*Schema, error) {
+	data = bytes.TrimSpace(data)
+	if string(data) == "true" {
+		return &Schema{}, nil
+	}
+	var keys map[string]json.RawMessage
+	if err := json.Unmarshal(data, &keys); err != nil {
+		return nil, err
+	}
+	var unsupported []string
+	for k := range keys {
+		if !keywords[k] {
+			unsupported = append(unsupported, k)
+		}
+	}
+	if len(unsupported) > 0 {
+		sort.Strings(unsupported)
+		return nil, fmt.Errorf("unsupported keywords %s", strings.Join(unsupported, ", "))
+	}
+
+	var raw rawSchema
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	if err := dec.Decode(&raw); err != nil {
+		return nil, err
+	}
+
+	s := &Schema{
+		enum:        raw.Enum,
+		required:    raw.Required,
+		recommended: raw.Recommended,
+		minItems:    raw.MinItems,
+		maxItems:    raw.MaxItems,
+		minLength:   raw.MinLength,
+		maxLength:   raw.MaxLength,
+		format:      raw.Format,
+		minimum:     raw.Minimum,
+		maximum:     raw.Maximum,
+	}
+	if len(raw.Type) > 0 {
+		var one string
+		if err := json.Unmarshal(raw.Type, &one); err == nil {
+			s.types = []string{one}
+		} else if err := json.Unmarshal(raw.Type, &s.types); err != nil {
+			return nil, errors.New("type must be a string or an array of strings")
+		}
+	}
+	if len(raw.Const) > 0 {
+		var c any
+		if err := decode(raw.Const, &c); err != nil {
+			return nil, err
+		}
+		s.constant = &c
+	}
+	if raw.Pattern != nil {
+		re, err := regexp.Compile(*raw.Pattern)
+		if err != nil {
+			return nil, fmt.Errorf("invalid pattern: %w", err)
+		}
+		s.pattern = re
+	}
+
+	var err error
+	if len(raw.Properties) > 0 {
+		s.properties = map[string]*Schema{}
+		for name, p := range raw.Properties {
+			if s.properties[name], err = Parse(p); err != nil {
+				return nil, fmt.Errorf("property %q: %w", name, err)
+			}
+		}
+	}
+	switch string(bytes.TrimSpace(raw.AdditionalProperties)) {
+	case "", "true":
+	case "false":
+		s.noAdditional = true
+	default:
+		if s.additional, err = Parse(raw.AdditionalProperties); err != nil {
+			return nil, fmt.Errorf("additionalProperties: %w", err)
+		}
+	}
+	if len(raw.Items) > 0 {
+		if s.items, err = Parse(raw.Items); err != nil {
+			return nil, fmt.Errorf("items: %w", err)
+		}
+	}
+	for _, sub := range []struct {
+		name string
+		raw  []json.RawMessage
+		dst  *[]*Schema
+	}{{"allOf", raw.AllOf, &s.allOf}, {"anyOf", raw.AnyOf, &s.anyOf}, {"oneOf", raw.OneOf, &s.oneOf}} {
+		for i, r := range sub.raw {
+			c, err := Parse(r)
+			if err != nil {
+				return nil, fmt.Errorf("%s[%d]: %w", sub.name, i, err)
+			}
+			*sub.dst = append(*sub.dst, c)
+		}
+	}
+	return s, nil
+}
+
+func decode(data []byte, v any) error {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	return dec.Decode(v)
+}
+
+// Result is the outcome of validating one document.
+type Result struct {
+	Valid    bool     `json:"valid"`
+	Errors   []string `json:"errors,omitempty"`
+	Warnings []string `json:"warnings,omitempty"`
+}
+
+// Validate checks the JSON document doc against s.
+func (s *Schema) Validate(doc []byte) Result {
+	var v any
+	if err := decode(doc, &v); err != nil {
+		return Result{Errors: []string{fmt.Sprintf("invalid JSON: %v", err)}}
+	}
+	var errs, warnings []string
+	s.check(v, "", &errs, &warnings)
+	return Result{Valid: len(errs) == 0, Errors: errs, Warnings: warnings}
+}
+
+// check appends what is wrong with v, found at the JSON Pointer path, to
+// errs, and missing recommended properties to warnings.
+func (s *Schema) check(v any, path string, errs, warnings *[]string) {
+	fail := func(format string, args ...any) {
+		at := path
+		if at == "" {
+			at = "/"
+		}
+		*errs = append(*errs, at+": "+fmt.Sprintf(format, args...))
+	}
+
+	if len(s.types) > 0 && !hasType(v, s.types) {
+		fail("expected %s, got %s", strings.Join(s.types, " or "), typeOf(v))
+		return
+	}
+	if len(s.enum) > 0 {
+		found := false
+		for _, e := range s.enum {
+			if equal(e, v) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			fail("value is not one of the allowed values")
+		}
+	}
+	if s.constant != nil && !equal(*s.constant, v) {
+		fail("value must be %v", *s.constant)
+	}
+
+	switch v := v.(type) {
+	case map[string]any:
+		for _, name := range s.required {
+			if _, ok := v[name]; !ok {
+				fail("missing required property %q", name)
+			}
+		}
+		for _, name := range s.recommended {
+			if _, ok := v[name]; !ok {
+				at := path
+				if at == "" {
+					at = "/"
+				}
+				*warnings = append(*warnings, fmt.Sprintf("%s: missing recommended property %q", at, name))
+			}
+		}
+		names := make([]string, 0, len(v))
+		for name := range v {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			child := path + "/" + escape(name)
+			if p, ok := s.properties[name]; ok {
+				p.check(v[name], child, errs, warnings)
+			} else if s.noAdditional {
+				fail("property %q is not allowed", name)
+			} else if s.additional != nil {
+				s.additional.check(v[name], child, errs, warnings)
+			}
+		}
+	case []any:
+		if s.minItems != nil && len(v) < *s.minItems {
+			fail("expected at least %d items, got %d", *s.minItems, len(v))
+		}
+		if s.maxItems != nil && len(v) > *s.maxItems {
+			fail("expected at most %d items, got %d", *s.maxItems, len(v))
+		}
+		if s.items != nil {
+			for i, e := range v {
+				s.items.check(e, fmt.Sprintf("%s/%d", path, i), errs, warnings)
+			}
+		}
+	case string:
+		n := utf8.RuneCountInString(v)
+		if s.minLength != nil && n < *s.minLength {
+			if *s.minLength == 1 {
+				fail("must not be empty")
+			} else {
+				fail("expected at least %d characters, got %d", *s.minLength, n)
+			}
+		}
+		if s.maxLength != nil && n > *s.maxLength {
+			fail("expected at most %d characters, got %d", *s.maxLength, n)
+		}
+		if s.pattern != nil && !s.pattern.MatchString(v) {
+			fail("does not match %s", s.pattern)
+		}
+		if s.format == "uri" && v != "" {
+			if u, err := url.Parse(v); err != nil || u.Scheme == "" {
+				fail("%q is not a URI", truncate(v))
+			}
+		}
+	case json.Number:
+		f, _ := v.Float64()
+		if s.minimum != nil && f < *s.minimum {
+			fail("must be at least %v", *s.minimum)
+		}
+		if s.maximum != nil && f > *s.maximum {
+			fail("must be at most %v", *s.maximum)
+		}
+	}
+
+	for _, sub := range s.allOf {
+		sub.check(v, path, errs, warnings)
+	}
+	if len(s.anyOf) > 0 && s.matches(v, s.anyOf) == 0 {
+		fail("does not match any of the allowed schemas")
+	}
+	if len(s.oneOf) > 0 {
+		if n := s.matches(v, s.oneOf); n != 1 {
+			fail("must match exactly one of the allowed schemas, matches %d", n)
+		}
+	}
+}
+
+// matches counts the schemas v is valid against.
+func (s *Schema) matches(v any, schemas []*Schema) int {
+	n := 0
+	for _, sub := range schemas {
+		var errs, warnings []string
+		sub.check(v, "", &errs, &warnings)
+		if len(errs) == 0 {
+			n++
+		}
+	}
+	return n
+}
+
+func hasType(v any, types []string) bool {
+	t := typeOf(v)
+	for _, want := range types {
+		if want == t || (want == "number" && t == "integer") {
+			return true
+		}
+	}
+	return false
+}
+
+func typeOf(v any) string {
+	switch v := v.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "boolean"
+	case string:
+		return "string"
+	case []any:
+		return "array"
+	case map[string]any:
+		return "object"
+	case json.Number:
+		// As in JSON Schema, 1.0 and 1e3 are integers too.
+		if f, err := v.Float64(); err == nil && f == math.Trunc(f) && !math.IsInf(f, 0) {
+			return "integer"
+		}
+		return "number"
+	}
+	return fmt.Sprintf("%T", v)
+}
+
+func equal(a, b any) bool {
+	an, aok := a.(json.Number)
+	bn, bok := b.(json.Number)
+	if aok && bok {
+		af, _ := an.Float64()
+		bf, _ := bn.Float64()
+		return af == bf
+	}
+	ab, _ := json.Marshal(a)
+	bb, _ := json.Marshal(b)
+	return bytes.Equal(ab, bb)
+}
+
+// escape escapes a property name for a JSON Pointer.
+func escape(name string) string {
+	return strings.ReplaceAll(strings.ReplaceAll(name, "~", "~0"), "/", "~1")
+}
+
+// truncate shortens long values quoted in errors, such as data URIs.
+func truncate(s string) string {
+	if len(s) > 64 {
+		return strings.ToValidUTF8(s[:61], "") + "..."
+	}
+	return s
+}
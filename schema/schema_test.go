@@ -0,0 +1,164 @@
+package schema
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestBuiltin(t *testing.T) {
+	s, err := Load(ERC721)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.Name != ERC721 {
+		t.Errorf("Name = %q", s.Name)
+	}
+
+	tests := []struct {
+		name     string
+		doc      string
+		errors   []string
+		warnings []string
+	}{
+		{
+			name: "valid",
+			doc:  `{"name": "Ape #1", "description": "An ape", "image": "ipfs://QmA/1.png", "attributes": [{"trait_type": "Hat", "value": "Cap"}, {"value": 7}]}`,
+		},
+		{
+			name:     "missing name",
+			doc:      `{"description": "An ape", "image": "ipfs://QmA/1.png"}`,
+			errors:   []string{`/: missing required property "name"`},
+			warnings: nil,
+		},
+		{
+			name:     "empty name and recommended missing",
+			doc:      `{"name": ""}`,
+			errors:   []string{"/name: must not be empty"},
+			warnings: []string{`/: missing recommended property "description"`, `/: missing recommended property "image"`},
+		},
+		{
+			name: "bad attributes",
+			doc:  `{"name": "Ape", "description": "", "image": "ape.png", "attributes": [{"trait_type": "Hat"}, {"value": {"x": 1}}]}`,
+			errors: []string{
+				`/attributes/0: missing required property "value"`,
+				"/attributes/1/value: expected string or number or boolean, got object",
+				`/image: "ape.png" is not a URI`,
+			},
+		},
+		{
+			name:   "not an object",
+			doc:    `["Ape"]`,
+			errors: []string{"/: expected object, got array"},
+		},
+		{
+			name:   "invalid JSON",
+			doc:    `{"name": `,
+			errors: []string{"invalid JSON: unexpected EOF"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := s.Validate([]byte(tt.doc))
+			if r.Valid != (len(tt.errors) == 0) {
+				t.Errorf("Valid = %v", r.Valid)
+			}
+			if !reflect.DeepEqual(r.Errors, tt.errors) {
+				t.Errorf("Errors = %q, want %q", r.Errors, tt.errors)
+			}
+			if !reflect.DeepEqual(r.Warnings, tt.warnings) {
+				t.Errorf("Warnings = %q, want %q", r.Warnings, tt.warnings)
+			}
+		})
+	}
+
+	if _, err := Load(ERC1155); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestCustom(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "apes.json")
+	err := os.WriteFile(path, []byte(`{
+		"type": "object",
+		"required": ["name", "edition"],
+		"additionalProperties": false,
+		"properties": {
+			"name": {"type": "string", "pattern": "^Ape #[0-9]+$"},
+			"edition": {"type": "integer", "minimum": 1, "maximum": 10000},
+			"tier": {"enum": ["common", "rare"]},
+			"image": {"anyOf": [{"type": "string", "format": "uri"}, {"type": "null"}]}
+		}
+	}`), 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := Load(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.Name != path {
+		t.Errorf("Name = %q, want %q", s.Name, path)
+	}
+
+	tests := []struct {
+		doc    string
+		errors []string
+	}{
+		{`{"name": "Ape #1", "edition": 1, "tier": "rare", "image": null}`, nil},
+		{`{"name": "Ape #1", "edition": 1.5}`, []string{"/edition: expected integer, got number"}},
+		{`{"name": "Ape #1", "edition": 2.0}`, nil},
+		{`{"name": "Ape #1", "edition": 1e3}`, nil},
+		{`{"name": "Ape #1", "edition": 0}`, []string{"/edition: must be at least 1"}},
+		{`{"name": "Monkey", "edition": 2}`, []string{"/name: does not match ^Ape #[0-9]+$"}},
+		{`{"name": "Ape #1", "edition": 2, "tier": "epic"}`, []string{"/tier: value is not one of the allowed values"}},
+		{`{"name": "Ape #1", "edition": 2, "image": 5}`, []string{"/image: does not match any of the allowed schemas"}},
+		{`{"name": "Ape #1", "edition": 2, "extra": true}`, []string{`/: property "extra" is not allowed`}},
+	}
+	for _, tt := range tests {
+		if r := s.Validate([]byte(tt.doc)); !reflect.DeepEqual(r.Errors, tt.errors) {
+			t.Errorf("Validate(%s) errors = %q, want %q", tt.doc, r.Errors, tt.errors)
+		}
+	}
+
+	for _, bad := range []string{
+		`{"type": 5}`,
+		`{"pattern": "("}`,
+		`{"properties": {"x": {"items": []}}}`,
+		`{"$ref": "#/$defs/name", "$defs": {"name": {"type": "string"}}}`,
+		`{"properties": {"x": {"patternProperties": {"^a": true}}}}`,
+		`{"items": {"prefixItems": [true]}}`,
+		`{"dependentRequired": {"a": ["b"]}}`,
+	} {
+		if _, err := Parse([]byte(bad)); err == nil {
+			t.Errorf("Parse(%s) succeeded", bad)
+		}
+	}
+	if _, err := Load(filepath.Join(t.TempDir(), "missing.json")); err == nil {
+		t.Error("Load of a missing file succeeded")
+	}
+}
+
+func TestLoadStored(t *testing.T) {
+	s, err := LoadStored(ERC1155, "ignored")
+	if err != nil || s.Name != ERC1155 {
+		t.Fatalf("built-in: %v, %v", s, err)
+	}
+	s, err = LoadStored(`{"required": ["edition"]}`, "collection apes")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.Name != "collection apes" {
+		t.Errorf("Name = %q", s.Name)
+	}
+	if r := s.Validate([]byte(`{}`)); r.Valid {
+		t.Error("stored schema wasn't applied")
+	}
+	if _, err := LoadStored("\n  {\"required\": [\"edition\"]}", "collection apes"); err != nil {
+		t.Errorf("LoadStored with leading whitespace: %v", err)
+	}
+	if _, err := LoadStored("schemas/apes.json", "collection apes"); err == nil {
+		t.Error("LoadStored of a path succeeded")
+	}
+}
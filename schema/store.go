@@ -0,0 +1,63 @@
+package schema
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+)
+
+func CreateTable(db *sql.DB) error {
+	_, err := db.Exec(`
+        CREATE TABLE IF NOT EXISTS validations (
+            cid TEXT PRIMARY KEY,
+            schema TEXT NOT NULL,
+            valid BOOLEAN NOT NULL,
+            errors JSONB NOT NULL DEFAULT '[]',
+            warnings JSONB NOT NULL DEFAULT '[]',
+            validated_at TIMESTAMPTZ NOT NULL DEFAULT now()
+        );
+        CREATE INDEX IF NOT EXISTS validations_invalid_idx ON validations (cid) WHERE NOT valid
+    `)
+	if err != nil {
+		return fmt.Errorf("error creating validations table: %w", err)
+	}
+	return nil
+}
+
+// Save records the result of validating cid against the schema called
+// name, replacing any earlier result.
+func Save(ctx context.Context, db *sql.DB, cid, name string, r Result) error {
+	errs, _ := json.Marshal(nonNil(r.Errors))
+	warnings, _ := json.Marshal(nonNil(r.Warnings))
+	_, err := db.ExecContext(ctx, `
+        INSERT INTO validations (cid, schema, valid, errors, warnings, validated_at)
+        VALUES ($1, $2, $3, $4, $5, now())
+        ON CONFLICT (cid) DO UPDATE SET
+        schema = EXCLUDED.schema,
+        valid = EXCLUDED.valid,
+        errors = EXCLUDED.errors,
+        warnings = EXCLUDED.warnings,
+        validated_at = EXCLUDED.validated_at`,
+		cid, name, r.Valid, errs, warnings)
+	if err != nil {
+		return fmt.Errorf("error saving validation of CID %s: %w", cid, err)
+	}
+	return nil
+}
+
+// Delete forgets the validation of cid, for a document that can no longer
+// be validated.
+func Delete(ctx context.Context, db *sql.DB, cid string) error {
+	if _, err := db.ExecContext(ctx, "DELETE FROM validations WHERE cid = $1", cid); err != nil {
+		return fmt.Errorf("error deleting validation of CID %s: %w", cid, err)
+	}
+	return nil
+}
+
+func nonNil(s []string) []string {
+	if s == nil {
+		return []string{}
+	}
+	return s
+}
@@ -0,0 +1,332 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/coffeendude/ipfs-cids-go-scraper/collection"
+	"github.com/coffeendude/ipfs-cids-go-scraper/input"
+	"github.com/coffeendude/ipfs-cids-go-scraper/ipns"
+	"github.com/coffeendude/ipfs-cids-go-scraper/logging"
+	"github.com/coffeendude/ipfs-cids-go-scraper/metrics"
+	"github.com/coffeendude/ipfs-cids-go-scraper/progress"
+	"github.com/coffeendude/ipfs-cids-go-scraper/queue"
+	"github.com/coffeendude/ipfs-cids-go-scraper/ratelimit"
+	"github.com/coffeendude/ipfs-cids-go-scraper/resolve"
+	"github.com/coffeendude/ipfs-cids-go-scraper/unixfs"
+)
+
+// queueWorkerConfig controls how a scrape --worker process drains the queue.
+type queueWorkerConfig struct {
+	heartbeat time.Duration
+	poll      time.Duration
+	wait      bool
+}
+
+// runScrape implements the scrape subcommand. Without flags it fetches the
+// CID file in-process like the default command, but keeps existing rows and
+// does not start the API server. With -enqueue it loads the CID file into the
+// durable queue, and with -worker it leases CIDs from the queue so several
+// replicas can share one crawl.
+func runScrape(args []string) error {
+	fs := flag.NewFlagSet("scrape", flag.ExitOnError)
+	var dbc dbConfig
+	var sc scrapeConfig
+	var ic inputConfig
+	var tc traceConfig
+	var lc logConfig
+	dbc.register(fs)
+	sc.register(fs)
+	ic.register(fs)
+	tc.register(fs)
+	lc.register(fs)
+	file := fs.String("file", CIDFilePath, "CSV file of CIDs to scrape or enqueue")
+	coll := fs.String("collection", "", "Scrape or enqueue the tokens linked to this collection instead of the CID file")
+	dir := fs.String("dir", "", "Scrape or enqueue every file under this UnixFS directory CID instead of the CID file")
+	dirFormat := fs.String("dir-format", unixfs.FormatDAGJSON, "How -dir directories are read from the gateway: dag-json, or raw for dag-pb blocks")
+	maxDepth := fs.Int("max-depth", 1, "Directory levels listed under -dir; 1 lists only the directory itself")
+	maxEntries := fs.Int("max-entries", 10000, "Maximum entries taken from each directory under -dir (0 means no limit)")
+	enqueue := fs.Bool("enqueue", false, "Add the CID file to the work queue and exit")
+	workerMode := fs.Bool("worker", false, "Lease CIDs from the work queue instead of reading the CID file")
+	job := fs.String("job", "", "Job ID to enqueue under or to report progress as (generated if empty)")
+	lease := fs.Duration("lease", 2*time.Minute, "How long a leased CID is held before another worker may take it")
+	heartbeat := fs.Duration("heartbeat", 30*time.Second, "How often a worker extends its lease while fetching")
+	maxAttempts := fs.Int("max-attempts", 3, "Attempts before a queued CID is marked failed")
+	wait := fs.Bool("wait", false, "Keep polling the queue when it is empty instead of exiting")
+	poll := fs.Duration("poll", 5*time.Second, "Queue poll interval when empty or after a lease error")
+	metricsAddr := fs.String("metrics-addr", "", "Address to serve /metrics on, e.g. :9090 (disabled if empty)")
+	fs.Parse(args)
+
+	lc.setup()
+	schema, err := ic.schema()
+	if err != nil {
+		return fail("Error reading flags", err)
+	}
+	if *dirFormat != unixfs.FormatDAGJSON && *dirFormat != unixfs.FormatRaw {
+		return fail("Error reading flags", fmt.Errorf("invalid -dir-format %q: want dag-json or raw", *dirFormat))
+	}
+	if *metricsAddr != "" {
+		metrics.Serve(*metricsAddr)
+	}
+	defer tc.setup()()
+
+	db, err := dbc.connect()
+	if err != nil {
+		return fail("Error connecting to database", err)
+	}
+	defer db.Close()
+
+	if err := ensureMetadataTable(db); err != nil {
+		return fail("Error creating table", err)
+	}
+	if err := queue.CreateTable(db); err != nil {
+		return fail("Error creating queue table", err)
+	}
+	if err := progress.CreateTable(db); err != nil {
+		return fail("Error creating jobs table", err)
+	}
+	if err := collection.CreateTables(db); err != nil {
+		return fail("Error creating collection tables", err)
+	}
+	if err := ipns.CreateTable(db); err != nil {
+		return fail("Error creating ipns table", err)
+	}
+
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer cancel()
+
+	q := queue.New(db, workerID(), *lease, *maxAttempts)
+	s, err := sc.newScraper(db)
+	if err != nil {
+		return fail("Error configuring scraper", err)
+	}
+
+	readInput := func() ([]input.Row, error) {
+		if *dir != "" {
+			c := &unixfs.Crawler{Format: *dirFormat, MaxDepth: *maxDepth, MaxEntries: *maxEntries}
+			return s.crawlInput(ctx, c, *dir)
+		}
+		return scrapeInput(ctx, db, *file, schema, *coll)
+	}
+
+	switch {
+	case *enqueue:
+		rows, err := readInput()
+		if err != nil {
+			return fail("Error reading CSV", err)
+		}
+		jobID := *job
+		if jobID == "" {
+			jobID = inputJobID(rows)
+		}
+		entries := make([]queue.Entry, 0, len(rows))
+		for _, row := range rows {
+			entries = append(entries, queue.Entry{Cid: row.Cid, TokenURI: row.TokenURI, Priority: row.Priority})
+		}
+		n, err := q.Enqueue(ctx, jobID, entries)
+		if err != nil {
+			return fail("Error enqueueing CIDs", err)
+		}
+		slog.Info("Enqueued CIDs", logging.JobID, jobID, "enqueued", n, "total", len(rows))
+
+	case *workerMode:
+		cfg := queueWorkerConfig{
+			heartbeat: *heartbeat,
+			poll:      *poll,
+			wait:      *wait,
+		}
+		// Job progress for the queue is read from the queue table itself,
+		// so this process only reports its own share.
+		stopProgress := s.startProgress("", nil)
+		s.runQueueWorkers(ctx, q, cfg)
+		stopProgress()
+		return s.finishRun()
+
+	default:
+		rows, err := readInput()
+		if err != nil {
+			return fail("Error reading CSV", err)
+		}
+		cids := s.inputCIDs(rows)
+		jobID := *job
+		if jobID == "" {
+			jobID = newJobID()
+		}
+		ctx = logging.With(ctx, logging.JobID, jobID)
+		stopProgress := s.startProgress(jobID, db)
+		err = s.fetchAndStoreMetadata(ctx, cids)
+		stopProgress()
+		if err != nil {
+			return fail("Error fetching and storing metadata", err)
+		}
+		return s.finishRun()
+	}
+	return nil
+}
+
+// scrapeInput returns the tokens of collection if it is set, or else the
+// rows of the CID file.
+func scrapeInput(ctx context.Context, db *sql.DB, file string, schema input.Schema, coll string) ([]input.Row, error) {
+	if coll == "" {
+		return loadInput(ctx, db, file, schema)
+	}
+	if _, err := collection.Get(ctx, db, coll); err != nil {
+		return nil, err
+	}
+	cids, err := collection.CIDs(ctx, db, coll)
+	if err != nil {
+		return nil, err
+	}
+	rows := make([]input.Row, 0, len(cids))
+	for _, cid := range cids {
+		rows = append(rows, input.Row{Cid: cid})
+	}
+	return rows, nil
+}
+
+// crawlInput lists the files under dir, which are stored under
+// "<dir>/<path>".
+func (s *scraper) crawlInput(ctx context.Context, c *unixfs.Crawler, dir string) ([]input.Row, error) {
+	src, err := resolve.Parse(dir)
+	if err != nil {
+		return nil, err
+	}
+	if src.Scheme != resolve.SchemeIPFS {
+		return nil, fmt.Errorf("-dir must be an IPFS directory, got %s", dir)
+	}
+
+	c.Fetch = s.fetchNode
+	res, err := c.Crawl(ctx, src.Path)
+	if err != nil {
+		return nil, fmt.Errorf("error crawling %s: %w", dir, err)
+	}
+	for _, d := range res.Truncated {
+		slog.Warn("Directory has more entries than -max-entries, skipping the rest", "dir", d, "max_entries", c.MaxEntries)
+	}
+	slog.Info("Crawled directory", "dir", src.Path, "files", len(res.Files))
+
+	rows := make([]input.Row, 0, len(res.Files))
+	for _, f := range res.Files {
+		rows = append(rows, input.Row{Cid: f})
+	}
+	return rows, nil
+}
+
+// workerID identifies this process as a lease owner.
+func workerID() string {
+	host, err := os.Hostname()
+	if err != nil {
+		host = "unknown"
+	}
+	return fmt.Sprintf("%s-%d", host, os.Getpid())
+}
+
+func (s *scraper) runQueueWorkers(ctx context.Context, q *queue.Queue, cfg queueWorkerConfig) {
+	s.report.Start()
+	depthCtx, stop := context.WithCancel(ctx)
+	defer stop()
+	go reportQueueDepth(depthCtx, q, cfg.poll)
+	waitAssets := s.startArchiving(ctx)
+	defer waitAssets()
+
+	var wg sync.WaitGroup
+	for i := 0; i < s.gateways.MaxConcurrency(); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			s.queueWorker(ctx, q, cfg)
+		}()
+	}
+	wg.Wait()
+}
+
+func (s *scraper) queueWorker(ctx context.Context, q *queue.Queue, cfg queueWorkerConfig) {
+	for ctx.Err() == nil {
+		item, err := q.Lease(ctx)
+		if err != nil {
+			slog.Error("Error leasing from queue", "error", err)
+			sleepContext(ctx, cfg.poll)
+			continue
+		}
+		if item == nil {
+			if !cfg.wait {
+				return
+			}
+			sleepContext(ctx, cfg.poll)
+			continue
+		}
+
+		s.report.Queued(1)
+		s.progress.AddTotal(1)
+		itemCtx := logging.With(ctx, logging.JobID, item.JobID, logging.QueueAttempt, item.Attempts)
+		logger := logging.From(itemCtx).With(logging.CID, item.Cid)
+
+		if item.TokenURI != "" {
+			s.tokenURIs.Store(item.Cid, item.TokenURI)
+		}
+		hbCtx, stop := context.WithCancel(itemCtx)
+		go q.KeepAlive(hbCtx, item.ID, cfg.heartbeat)
+		_, err = s.fetchAndParseMetadata(itemCtx, item.Cid)
+		stop()
+		s.tokenURIs.Delete(item.Cid)
+
+		// The queue is updated even when shutting down, so the item isn't
+		// left leased until its lease expires.
+		updateCtx := context.WithoutCancel(ctx)
+		if errors.Is(err, ratelimit.ErrBudgetExhausted) {
+			// Leave the CID for tomorrow's budget or another replica.
+			if err := q.Release(updateCtx, item.ID); err != nil {
+				logger.Error("Error updating queue", "error", err)
+			}
+			logger.Warn("Daily request budget exhausted, stopping worker")
+			return
+		}
+		if err != nil && (ctx.Err() != nil || errors.Is(err, context.Canceled)) {
+			// Shutting down isn't the CID's fault; give it back without
+			// counting the attempt.
+			if err := q.Release(updateCtx, item.ID); err != nil {
+				logger.Error("Error updating queue", "error", err)
+			}
+			return
+		}
+		if err != nil {
+			// An oversized body will be just as big next time.
+			if err := q.Fail(updateCtx, item.ID, classify(err), err, errors.Is(err, errTooLarge)); err != nil {
+				logger.Error("Error updating queue", "error", err)
+			}
+			continue
+		}
+		if err := q.Complete(updateCtx, item.ID); err != nil {
+			logger.Error("Error updating queue", "error", err)
+		}
+	}
+}
+
+// reportQueueDepth keeps the queue depth gauge up to date until ctx is done.
+func reportQueueDepth(ctx context.Context, q *queue.Queue, interval time.Duration) {
+	for ctx.Err() == nil {
+		if n, err := q.Depth(ctx); err == nil {
+			metrics.QueueDepth.Set(float64(n))
+		}
+		sleepContext(ctx, interval)
+	}
+}
+
+// sleepContext waits for d or until ctx is cancelled, whichever is first.
+func sleepContext(ctx context.Context, d time.Duration) {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-ctx.Done():
+	case <-t.C:
+	}
+}
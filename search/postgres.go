@@ -0,0 +1,119 @@
+package search
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/coffeendude/ipfs-cids-go-scraper/metadata"
+	"github.com/coffeendude/ipfs-cids-go-scraper/tracing"
+)
+
+// CreateIndex adds a generated tsvector column to the metadata table and a
+// GIN index over it. Names weigh most, then descriptions, then attribute
+// values. It needs PostgreSQL 12 or later.
+func CreateIndex(db *sql.DB) error {
+	_, err := db.Exec(`
+        ALTER TABLE metadata ADD COLUMN IF NOT EXISTS search_vector tsvector
+        GENERATED ALWAYS AS (
+            setweight(to_tsvector('english', coalesce(name, '')), 'A') ||
+            setweight(to_tsvector('english', coalesce(description, '')), 'B') ||
+            setweight(jsonb_to_tsvector('english', jsonb_path_query_array(attributes, '$[*].value'), '["string", "numeric"]'), 'C')
+        ) STORED;
+        CREATE INDEX IF NOT EXISTS metadata_search_idx ON metadata USING GIN (search_vector)
+    `)
+	if err != nil {
+		return fmt.Errorf("error creating search index: %w", err)
+	}
+	return nil
+}
+
+// Postgres searches with the full-text index made by CreateIndex. Queries
+// use web search syntax: quoted phrases, "or" and -excluded terms.
+type Postgres struct {
+	DB *sql.DB
+}
+
+const headlineOptions = "StartSel=" + startMarker + ", StopSel=" + stopMarker
+
+func (p *Postgres) Search(ctx context.Context, q Query) (_ *Results, err error) {
+	ctx, span := tracing.Start(ctx, "db.search metadata", tracing.DBAttributes("SELECT", "metadata")...)
+	defer func() { tracing.End(span, err) }()
+
+	q = q.normalize()
+	rows, err := p.DB.QueryContext(ctx, `
+        WITH q AS (SELECT websearch_to_tsquery('english', $1) AS query)
+        SELECT `+metadata.QualifiedColumns("m")+`,
+            ts_rank_cd(m.search_vector, q.query) AS rank,
+            ts_headline('english', coalesce(m.name, ''), q.query, $4),
+            ts_headline('english', coalesce(m.description, ''), q.query, $5),
+            ts_headline('english', jsonb_path_query_array(m.attributes, '$[*].value'), q.query, $4),
+            count(*) OVER () AS total
+        FROM metadata m, q
+        WHERE m.search_vector @@ q.query
+        ORDER BY rank DESC, m.cid
+        LIMIT $2 OFFSET $3`,
+		q.Text, q.Limit, q.Offset,
+		headlineOptions+", HighlightAll=true",
+		headlineOptions+", MaxFragments=2, MaxWords=20, MinWords=5, FragmentDelimiter=\" … \"")
+	if err != nil {
+		return nil, fmt.Errorf("error searching metadata: %w", err)
+	}
+	defer rows.Close()
+
+	res := &Results{Query: q.Text, Limit: q.Limit, Offset: q.Offset, Hits: []Hit{}}
+	for rows.Next() {
+		var hit Hit
+		var attrs []byte
+		m, err := metadata.Scan(rows, &hit.Rank, &hit.Highlights.Name, &hit.Highlights.Description, &attrs, &res.Total)
+		if err != nil {
+			return nil, fmt.Errorf("error scanning row: %w", err)
+		}
+		hit.Metadata = *m
+		hit.Highlights.Attributes = markedValues(attrs)
+		hit.Highlights.Name = marked(hit.Highlights.Name)
+		hit.Highlights.Description = marked(hit.Highlights.Description)
+		res.Hits = append(res.Hits, hit)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error reading rows: %w", err)
+	}
+	if len(res.Hits) == 0 && q.Offset > 0 {
+		// count(*) OVER () is only seen on returned rows, so a page past
+		// the end needs its own count.
+		err := p.DB.QueryRowContext(ctx, `
+            SELECT count(*) FROM metadata
+            WHERE search_vector @@ websearch_to_tsquery('english', $1)`, q.Text).Scan(&res.Total)
+		if err != nil {
+			return nil, fmt.Errorf("error counting search results: %w", err)
+		}
+	}
+	return res, nil
+}
+
+// marked returns a ts_headline'd snippet as HTML, or "" if nothing in it
+// was highlighted.
+func marked(s string) string {
+	if !strings.Contains(s, startMarker) {
+		return ""
+	}
+	return markup(s)
+}
+
+// markedValues returns the highlighted values from a ts_headline'd JSON
+// array of attribute values, as HTML.
+func markedValues(b []byte) []string {
+	var values []any
+	if json.Unmarshal(b, &values) != nil {
+		return nil
+	}
+	var marked []string
+	for _, v := range values {
+		if s, ok := v.(string); ok && strings.Contains(s, startMarker) {
+			marked = append(marked, markup(s))
+		}
+	}
+	return marked
+}
@@ -0,0 +1,246 @@
+package search
+
+import (
+	"context"
+	"html"
+	"slices"
+	"sort"
+	"strings"
+	"unicode"
+
+	"github.com/coffeendude/ipfs-cids-go-scraper/metadata"
+)
+
+// Field weights, matching the defaults ts_rank uses for weights A, B and C.
+const (
+	nameWeight        = 1.0
+	descriptionWeight = 0.4
+	attributeWeight   = 0.2
+
+	// snippetWords is how many words of a description are kept around
+	// the first match.
+	snippetWords = 20
+)
+
+// Scan searches by reading every document through Each, for stores
+// without a full-text index. It reads the same web search syntax as
+// Postgres: a document matches when every term appears in its name,
+// description or attribute values, ignoring case, quoted phrases appear
+// word for word, -excluded terms don't appear, and "or" separates
+// alternatives. Unlike Postgres there is no stemming and stop words are
+// not dropped; a term matches the words it is a prefix of instead, so
+// "ape" finds "apes" but "apes" doesn't find "ape".
+type Scan struct {
+	Each func(ctx context.Context, fn func(*metadata.Metadata) error) error
+}
+
+func (s *Scan) Search(ctx context.Context, q Query) (*Results, error) {
+	q = q.normalize()
+	groups := parseQuery(q.Text)
+	res := &Results{Query: q.Text, Limit: q.Limit, Offset: q.Offset, Hits: []Hit{}}
+	if len(groups) == 0 {
+		return res, nil
+	}
+
+	var hits []Hit
+	err := s.Each(ctx, func(m *metadata.Metadata) error {
+		if hit, ok := match(m, groups); ok {
+			hits = append(hits, hit)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sort.SliceStable(hits, func(i, j int) bool {
+		if hits[i].Rank != hits[j].Rank {
+			return hits[i].Rank > hits[j].Rank
+		}
+		return hits[i].Cid < hits[j].Cid
+	})
+	res.Total = len(hits)
+	if q.Offset < len(hits) {
+		end := q.Offset + q.Limit
+		if end > len(hits) {
+			end = len(hits)
+		}
+		res.Hits = hits[q.Offset:end]
+	}
+	return res, nil
+}
+
+// clause is a term or quoted phrase of a query. A document matches a
+// negated clause by not containing it.
+type clause struct {
+	words  []string
+	negate bool
+}
+
+// parseQuery reads text in web search syntax, as websearch_to_tsquery
+// does, into alternatives separated by "or", each a list of clauses that
+// must all match.
+func parseQuery(text string) [][]clause {
+	var groups [][]clause
+	var group []clause
+	for {
+		text = strings.TrimLeftFunc(text, unicode.IsSpace)
+		if text == "" {
+			break
+		}
+		negate := strings.HasPrefix(text, "-")
+		if negate {
+			text = text[1:]
+		}
+		var raw string
+		quoted := strings.HasPrefix(text, `"`)
+		if quoted {
+			text = text[1:]
+			end := strings.IndexByte(text, '"')
+			if end < 0 {
+				end = len(text) - 1
+			}
+			raw, text = text[:end+1], text[end+1:]
+		} else {
+			end := strings.IndexFunc(text, unicode.IsSpace)
+			if end < 0 {
+				end = len(text)
+			}
+			raw, text = text[:end], text[end:]
+		}
+
+		if !quoted && !negate && strings.EqualFold(raw, "or") {
+			if len(group) > 0 {
+				groups = append(groups, group)
+				group = nil
+			}
+			continue
+		}
+		// Words joined by punctuation, as in "laser-ape", are a phrase.
+		if words := tokenize(raw); len(words) > 0 {
+			group = append(group, clause{words: words, negate: negate})
+		}
+	}
+	if len(group) > 0 {
+		groups = append(groups, group)
+	}
+	return groups
+}
+
+// match scores m against the alternatives of a query, returning false
+// unless one of them matches. The best alternative gives the rank.
+func match(m *metadata.Metadata, groups [][]clause) (Hit, bool) {
+	name := tokenize(m.Name)
+	description := tokenize(m.Description)
+	values := m.Attributes.Values()
+	attrs := make([][]string, len(values))
+	for i, v := range values {
+		attrs[i] = tokenize(v)
+	}
+
+	hit := Hit{Metadata: *m}
+	matched := false
+	var terms []string
+	for _, group := range groups {
+		rank, ok := 0.0, true
+		for _, c := range group {
+			n, d, a := count(name, c.words), count(description, c.words), 0
+			for _, words := range attrs {
+				a += count(words, c.words)
+			}
+			if c.negate {
+				ok = ok && n+d+a == 0
+				continue
+			}
+			terms = append(terms, c.words...)
+			ok = ok && n+d+a > 0
+			rank += nameWeight*float64(n) + descriptionWeight*float64(d) + attributeWeight*float64(a)
+		}
+		if ok && (!matched || rank > hit.Rank) {
+			hit.Rank = rank
+			matched = true
+		}
+	}
+	if !matched {
+		return Hit{}, false
+	}
+
+	if h := highlight(m.Name, terms, 0); strings.Contains(h, StartSel) {
+		hit.Highlights.Name = h
+	}
+	if h := highlight(m.Description, terms, snippetWords); strings.Contains(h, StartSel) {
+		hit.Highlights.Description = h
+	}
+	for _, v := range values {
+		if h := highlight(v, terms, 0); strings.Contains(h, StartSel) {
+			hit.Highlights.Attributes = append(hit.Highlights.Attributes, h)
+		}
+	}
+	return hit, true
+}
+
+// tokenize lower-cases s and splits it into words of letters and digits.
+func tokenize(s string) []string {
+	return strings.FieldsFunc(strings.ToLower(s), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+}
+
+// count returns how often phrase appears in words, each of its words
+// being a prefix of the word at the same place.
+func count(words, phrase []string) int {
+	n := 0
+	for i := 0; i+len(phrase) <= len(words); i++ {
+		found := true
+		for j, term := range phrase {
+			if !strings.HasPrefix(words[i+j], term) {
+				found = false
+				break
+			}
+		}
+		if found {
+			n++
+		}
+	}
+	return n
+}
+
+// highlight escapes s for HTML and marks the words that match a term. If
+// maxWords is set, only that many words around the first match are kept.
+func highlight(s string, terms []string, maxWords int) string {
+	words := strings.Fields(s)
+	first := -1
+	for i, w := range words {
+		words[i] = html.EscapeString(w)
+		for _, token := range tokenize(w) {
+			if !slices.ContainsFunc(terms, func(term string) bool { return strings.HasPrefix(token, term) }) {
+				continue
+			}
+			words[i] = StartSel + words[i] + StopSel
+			if first < 0 {
+				first = i
+			}
+			break
+		}
+	}
+	if maxWords <= 0 || len(words) <= maxWords || first < 0 {
+		return strings.Join(words, " ")
+	}
+
+	start := first - maxWords/4
+	if start < 0 {
+		start = 0
+	}
+	end := start + maxWords
+	if end > len(words) {
+		end, start = len(words), len(words)-maxWords
+	}
+	snippet := strings.Join(words[start:end], " ")
+	if start > 0 {
+		snippet = "… " + snippet
+	}
+	if end < len(words) {
+		snippet += " …"
+	}
+	return snippet
+}
@@ -0,0 +1,129 @@
+package search
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"html"
+	"log/slog"
+	"strings"
+
+	"github.com/coffeendude/ipfs-cids-go-scraper/metadata"
+)
+
+const (
+	DefaultLimit = 20
+	MaxLimit     = 100
+
+	// Highlighted terms are wrapped in these tags in snippets.
+	StartSel = "<mark>"
+	StopSel  = "</mark>"
+
+	// startMarker and stopMarker stand in for StartSel and StopSel in
+	// database snippets until the text around them has been escaped.
+	startMarker = "\x02"
+	stopMarker  = "\x03"
+)
+
+var markerReplacer = strings.NewReplacer(startMarker, StartSel, stopMarker, StopSel)
+
+// markup escapes s for HTML and turns its markers into StartSel and
+// StopSel.
+func markup(s string) string {
+	return markerReplacer.Replace(html.EscapeString(s))
+}
+
+// Query is one page of a search.
+type Query struct {
+	Text   string
+	Limit  int
+	Offset int
+}
+
+// normalize clamps the page size to [1, MaxLimit].
+func (q Query) normalize() Query {
+	if q.Limit <= 0 {
+		q.Limit = DefaultLimit
+	}
+	if q.Limit > MaxLimit {
+		q.Limit = MaxLimit
+	}
+	if q.Offset < 0 {
+		q.Offset = 0
+	}
+	return q
+}
+
+// Hit is one matching document.
+type Hit struct {
+	metadata.Metadata
+	Rank       float64    `json:"rank"`
+	Highlights Highlights `json:"highlights"`
+}
+
+// Highlights are HTML snippets of the matching fields: the text is escaped
+// and the matched terms are wrapped in StartSel and StopSel.
+type Highlights struct {
+	Name        string   `json:"name,omitempty"`
+	Description string   `json:"description,omitempty"`
+	Attributes  []string `json:"attributes,omitempty"`
+}
+
+// Results is a page of hits, best first.
+type Results struct {
+	Query  string `json:"query"`
+	Total  int    `json:"total"`
+	Limit  int    `json:"limit"`
+	Offset int    `json:"offset"`
+	Hits   []Hit  `json:"results"`
+}
+
+// Searcher finds metadata matching a free-text query over name,
+// description and attribute values.
+type Searcher interface {
+	Search(ctx context.Context, q Query) (*Results, error)
+}
+
+// New returns the best searcher for db: the full-text index if
+// CreateIndex has added it, or else a scan of the table. It changes
+// nothing in the database.
+func New(ctx context.Context, db *sql.DB) (Searcher, error) {
+	var indexed bool
+	err := db.QueryRowContext(ctx, `
+        SELECT EXISTS (
+            SELECT 1 FROM information_schema.columns
+            WHERE table_schema = current_schema() AND table_name = 'metadata' AND column_name = 'search_vector'
+        )`).Scan(&indexed)
+	if err != nil {
+		return nil, fmt.Errorf("error checking for search index: %w", err)
+	}
+	if !indexed {
+		slog.Warn("Full-text index missing, searching by table scan")
+		return &Scan{Each: func(ctx context.Context, fn func(*metadata.Metadata) error) error {
+			return eachMetadata(ctx, db, fn)
+		}}, nil
+	}
+	return &Postgres{DB: db}, nil
+}
+
+func eachMetadata(ctx context.Context, db *sql.DB, fn func(*metadata.Metadata) error) error {
+	rows, err := db.QueryContext(ctx, "SELECT "+metadata.Columns+" FROM metadata")
+	if err != nil {
+		return fmt.Errorf("error querying metadata: %w", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		m, err := metadata.Scan(rows)
+		if err != nil {
+			return fmt.Errorf("error scanning row: %w", err)
+		}
+		if err := fn(m); err != nil {
+			return err
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("error reading rows: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,133 @@
+package search
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	"github.com/coffeendude/ipfs-cids-go-scraper/metadata"
+)
+
+var docs = []metadata.Metadata{
+	{Cid: "QmA", Name: "Laser Ape #1", Description: "An ape with lasers."},
+	{Cid: "QmB", Name: "Cat #2", Description: "A cat that met an ape once."},
+	{Cid: "QmC", Name: "Dog #3", Attributes: metadata.Attributes{{TraitType: "Friend", Value: "Ape"}}},
+	{Cid: "QmD", Name: "Fish #4", Description: "Nothing to see here."},
+}
+
+func scanner() *Scan {
+	return &Scan{Each: func(ctx context.Context, fn func(*metadata.Metadata) error) error {
+		for i := range docs {
+			if err := fn(&docs[i]); err != nil {
+				return err
+			}
+		}
+		return nil
+	}}
+}
+
+func cids(res *Results) []string {
+	var out []string
+	for _, h := range res.Hits {
+		out = append(out, h.Cid)
+	}
+	return out
+}
+
+func TestScanRanking(t *testing.T) {
+	res, err := scanner().Search(context.Background(), Query{Text: "ape"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"QmA", "QmB", "QmC"}; !reflect.DeepEqual(cids(res), want) {
+		t.Errorf("hits = %v, want %v", cids(res), want)
+	}
+	if res.Total != 3 || res.Limit != DefaultLimit {
+		t.Errorf("total = %d, limit = %d", res.Total, res.Limit)
+	}
+
+	h := res.Hits[0].Highlights
+	if h.Name != "Laser <mark>Ape</mark> #1" || h.Description != "An <mark>ape</mark> with lasers." {
+		t.Errorf("highlights = %+v", h)
+	}
+	if got := res.Hits[2].Highlights.Attributes; !reflect.DeepEqual(got, []string{"<mark>Ape</mark>"}) {
+		t.Errorf("attribute highlights = %v", got)
+	}
+}
+
+func TestScanAllTermsAndPrefixes(t *testing.T) {
+	res, _ := scanner().Search(context.Background(), Query{Text: "las ape"})
+	if want := []string{"QmA"}; !reflect.DeepEqual(cids(res), want) {
+		t.Errorf("hits = %v, want %v", cids(res), want)
+	}
+	res, _ = scanner().Search(context.Background(), Query{Text: "  !! "})
+	if res.Total != 0 || len(res.Hits) != 0 {
+		t.Errorf("empty query matched %v", cids(res))
+	}
+}
+
+func TestScanPagination(t *testing.T) {
+	res, _ := scanner().Search(context.Background(), Query{Text: "ape", Limit: 2, Offset: 1})
+	if want := []string{"QmB", "QmC"}; !reflect.DeepEqual(cids(res), want) || res.Total != 3 {
+		t.Errorf("page = %v (total %d), want %v", cids(res), res.Total, want)
+	}
+	res, _ = scanner().Search(context.Background(), Query{Text: "ape", Offset: 10})
+	if len(res.Hits) != 0 || res.Total != 3 {
+		t.Errorf("past the end: %v (total %d)", cids(res), res.Total)
+	}
+}
+
+func TestHighlightSnippet(t *testing.T) {
+	text := "one two three four five six seven eight nine ten eleven twelve target thirteen fourteen"
+	got := highlight(text, []string{"target"}, 6)
+	if want := "… ten eleven twelve <mark>target</mark> thirteen fourteen"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	got = highlight(text, []string{"four"}, 4)
+	if want := "… three <mark>four</mark> five six …"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	got = highlight(text, []string{"target"}, 4)
+	if want := "… twelve <mark>target</mark> thirteen fourteen"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestScanSyntax(t *testing.T) {
+	for text, want := range map[string][]string{
+		"ape -laser":           {"QmB", "QmC"},
+		`"met an ape"`:         {"QmB"},
+		`"ape met"`:            nil,
+		"laser or fish":        {"QmA", "QmD"},
+		"cat ape or nothing":   {"QmB", "QmD"},
+		"or":                   nil,
+		`-"with lasers" dog`:   {"QmC"},
+		"laser-ape":            {"QmA"},
+		`"unterminated phrase`: nil,
+	} {
+		res, err := scanner().Search(context.Background(), Query{Text: text})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := cids(res); !reflect.DeepEqual(got, want) {
+			t.Errorf("%s: hits = %v, want %v", text, got, want)
+		}
+	}
+}
+
+func TestHighlightEscapes(t *testing.T) {
+	got := highlight(`<img src=x onerror="alert(1)"> ape&co`, []string{"ape"}, 0)
+	if want := "&lt;img src=x onerror=&#34;alert(1)&#34;&gt; <mark>ape&amp;co</mark>"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	if got := marked("<b>" + startMarker + "ape" + stopMarker + "</b>"); got != "&lt;b&gt;<mark>ape</mark>&lt;/b&gt;" {
+		t.Errorf("marked = %q", got)
+	}
+	if got := marked("<b>ape</b>"); got != "" {
+		t.Errorf("marked without a match = %q, want empty", got)
+	}
+	values := markedValues([]byte(`["<i>` + "\\u0002" + `Ape` + "\\u0003" + `</i>", "Dog", 3]`))
+	if want := []string{"&lt;i&gt;<mark>Ape</mark>&lt;/i&gt;"}; !reflect.DeepEqual(values, want) {
+		t.Errorf("markedValues = %v, want %v", values, want)
+	}
+}
@@ -0,0 +1,160 @@
+// Package sniff tells what kind of content a fetched body is, so that
+// metadata documents can be told apart from images, web pages and other
+// things a token URI may point at.
+package sniff
+
+import (
+	"bytes"
+	"encoding/json"
+	"mime"
+	"net/http"
+
+	"github.com/coffeendude/ipfs-cids-go-scraper/ipld"
+)
+
+// Media types Detect returns besides the image and other types recognised
+// by http.DetectContentType.
+const (
+	JSON    = "application/json"
+	DAGJSON = "application/vnd.ipld.dag-json"
+	DAGCBOR = "application/vnd.ipld.dag-cbor"
+	HTML    = "text/html"
+	Text    = "text/plain"
+	SVG     = "image/svg+xml"
+	Binary  = "application/octet-stream"
+)
+
+// Detect returns the media type of body, without parameters.
+func Detect(body []byte) string {
+	trimmed := bytes.TrimLeft(body, " \t\r\n")
+	if len(trimmed) > 0 && (trimmed[0] == '{' || trimmed[0] == '[') && json.Valid(trimmed) {
+		if hasLink(trimmed) {
+			return DAGJSON
+		}
+		return JSON
+	}
+	if isCBORMap(body) {
+		return DAGCBOR
+	}
+	return contentType(body)
+}
+
+// Decode is Detect for callers that go on to parse body. The dag-json or
+// dag-cbor document decoded to tell those types apart is returned, so it
+// isn't decoded twice. Plain JSON is left to the caller and isn't checked
+// to be valid: a body that starts like JSON and has no links is JSON.
+func Decode(body []byte) (mediaType string, doc any) {
+	if LooksLikeJSON(body) {
+		// Only a body with a "/" key can hold links.
+		if bytes.Contains(body, []byte(`"/"`)) {
+			if v, err := ipld.DecodeJSON(body); err == nil && hasIPLD(v) {
+				return DAGJSON, v
+			}
+		}
+		return JSON, nil
+	}
+	if len(body) > 0 && body[0]>>5 == 5 {
+		if v, err := ipld.DecodeCBOR(body); err == nil {
+			if _, ok := v.(map[string]any); ok {
+				return DAGCBOR, v
+			}
+		}
+	}
+	return contentType(body), nil
+}
+
+// contentType returns the media type of a body that isn't a document.
+func contentType(body []byte) string {
+	mediaType, _, _ := mime.ParseMediaType(http.DetectContentType(body))
+	switch {
+	case mediaType == "text/xml" && bytes.Contains(body, []byte("<svg")):
+		return SVG
+	case mediaType == "":
+		return Binary
+	}
+	return mediaType
+}
+
+// IsDocument reports whether content of mediaType can hold token metadata.
+func IsDocument(mediaType string) bool {
+	switch mediaType {
+	case JSON, DAGJSON, DAGCBOR:
+		return true
+	}
+	return false
+}
+
+// LooksLikeJSON reports whether body starts like a JSON object or array,
+// so that a body that fails to parse can be blamed on broken JSON rather
+// than on being something else.
+func LooksLikeJSON(body []byte) bool {
+	trimmed := bytes.TrimLeft(body, " \t\r\n")
+	return len(trimmed) > 0 && (trimmed[0] == '{' || trimmed[0] == '[')
+}
+
+// hasLink reports whether a JSON document contains a dag-json link, an
+// object whose only key is "/".
+func hasLink(body []byte) bool {
+	if !bytes.Contains(body, []byte(`"/"`)) {
+		return false
+	}
+	var v any
+	if err := json.Unmarshal(body, &v); err != nil {
+		return false
+	}
+	return findLink(v)
+}
+
+// hasIPLD reports whether a decoded dag-json document holds a link or
+// bytes, which plain JSON can't.
+func hasIPLD(v any) bool {
+	switch v := v.(type) {
+	case ipld.Link, []byte:
+		return true
+	case map[string]any:
+		for _, e := range v {
+			if hasIPLD(e) {
+				return true
+			}
+		}
+	case []any:
+		for _, e := range v {
+			if hasIPLD(e) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func findLink(v any) bool {
+	switch v := v.(type) {
+	case map[string]any:
+		if _, ok := v["/"]; ok && len(v) == 1 {
+			return true
+		}
+		for _, e := range v {
+			if findLink(e) {
+				return true
+			}
+		}
+	case []any:
+		for _, e := range v {
+			if findLink(e) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// isCBORMap reports whether body is a dag-cbor map, as a metadata block
+// is.
+func isCBORMap(body []byte) bool {
+	if len(body) == 0 || body[0]>>5 != 5 {
+		return false
+	}
+	v, err := ipld.DecodeCBOR(body)
+	_, ok := v.(map[string]any)
+	return err == nil && ok
+}
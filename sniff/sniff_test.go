@@ -0,0 +1,80 @@
+package sniff
+
+import (
+	"bytes"
+	"image"
+	"image/png"
+	"testing"
+)
+
+func TestDetect(t *testing.T) {
+	var img bytes.Buffer
+	if err := png.Encode(&img, image.NewGray(image.Rect(0, 0, 1, 1))); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		body []byte
+		want string
+	}{
+		{"json", []byte(` {"name": "Ape", "attributes": []}`), JSON},
+		{"json array", []byte(`[{"name": "Ape"}]`), JSON},
+		{"dag-json", []byte(`{"name": "Ape", "image": {"/": "bafkqaaa"}}`), DAGJSON},
+		{"slash key with siblings", []byte(`{"/": "x", "y": 1}`), JSON},
+		// {"name": "Ape", "n": 1}
+		{"dag-cbor", []byte{0xa2, 0x64, 'n', 'a', 'm', 'e', 0x63, 'A', 'p', 'e', 0x61, 'n', 0x01}, DAGCBOR},
+		{"html", []byte("<!DOCTYPE html><html><body>Not found</body></html>"), HTML},
+		{"svg", []byte(`<?xml version="1.0"?><svg xmlns="http://www.w3.org/2000/svg"/>`), SVG},
+		{"png", img.Bytes(), "image/png"},
+		{"text", []byte("hello world"), Text},
+		{"broken json", []byte(`{"name": `), Text},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := Detect(tt.body); got != tt.want {
+				t.Errorf("Detect = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDecode(t *testing.T) {
+	if mediaType, doc := Decode([]byte(`{"name": "Ape", "image": {"/": "bafkqaaa"}}`)); mediaType != DAGJSON || doc == nil {
+		t.Errorf("dag-json = %q, %v", mediaType, doc)
+	}
+	if mediaType, doc := Decode([]byte{0xa1, 0x61, 'n', 0x01}); mediaType != DAGCBOR || doc == nil {
+		t.Errorf("dag-cbor = %q, %v", mediaType, doc)
+	}
+	// Plain and broken JSON are left for the caller to parse.
+	for _, body := range []string{`{"name": "Ape", "image": "/"}`, `{"name": `, `{"/": "bafkqaaa"} trailing`} {
+		if mediaType, doc := Decode([]byte(body)); mediaType != JSON || doc != nil {
+			t.Errorf("%s = %q, %v", body, mediaType, doc)
+		}
+	}
+	if mediaType, doc := Decode([]byte("hello world")); mediaType != Text || doc != nil {
+		t.Errorf("text = %q, %v", mediaType, doc)
+	}
+}
+
+func TestMalformedCBOR(t *testing.T) {
+	for _, body := range [][]byte{
+		{0xa2, 0x64, 'n', 'a', 'm', 'e', 0x63, 'A', 'p'},       // truncated
+		{0xbb, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff}, // huge length
+		{0xbf, 0x61, 'a', 0x01, 0xff},                          // indefinite length
+		{0xa1, 0x61, 'a', 0x01, 0x00},                          // trailing bytes
+	} {
+		if Detect(body) == DAGCBOR {
+			t.Errorf("% x detected as dag-cbor", body)
+		}
+	}
+}
+
+func TestLooksLikeJSON(t *testing.T) {
+	if !LooksLikeJSON([]byte("\n {\"name\": ")) {
+		t.Error("broken object should look like JSON")
+	}
+	if LooksLikeJSON([]byte("<html>")) || LooksLikeJSON(nil) {
+		t.Error("html and empty bodies don't look like JSON")
+	}
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"flag"
+	"os"
+	"time"
+
+	"github.com/coffeendude/ipfs-cids-go-scraper/progress"
+	"github.com/coffeendude/ipfs-cids-go-scraper/queue"
+)
+
+// runStatus implements the status subcommand, which prints the progress of
+// a job from the database. Queued jobs are summarised from the queue
+// table; in-process runs from the progress they save to scrape_jobs.
+func runStatus(args []string) error {
+	fs := flag.NewFlagSet("status", flag.ExitOnError)
+	var dbc dbConfig
+	var lc logConfig
+	dbc.register(fs)
+	lc.register(fs)
+	job := fs.String("job", "", "Job ID to report on")
+	watch := fs.Duration("watch", 0, "Keep printing progress at this interval until the job finishes")
+	fs.Parse(args)
+
+	lc.setup()
+	if *job == "" {
+		return fail("Error reading flags", errors.New("-job is required"))
+	}
+
+	db, err := dbc.connect()
+	if err != nil {
+		return fail("Error connecting to database", err)
+	}
+	defer db.Close()
+
+	ctx := context.Background()
+	for {
+		snap, err := jobProgress(ctx, db, *job)
+		if err != nil {
+			return fail("Error reading job progress", err)
+		}
+		if snap == nil {
+			return fail("Error reading job progress", errors.New("no such job: "+*job))
+		}
+		if err := snap.WriteText(os.Stdout); err != nil {
+			return fail("Error printing job progress", err)
+		}
+		if *watch <= 0 || snap.State == progress.StateFinished {
+			return nil
+		}
+		time.Sleep(*watch)
+	}
+}
+
+// jobProgress returns the progress of jobID, or nil if no such job exists.
+// Tables that haven't been created yet hold no jobs.
+func jobProgress(ctx context.Context, db *sql.DB, jobID string) (*progress.Snapshot, error) {
+	var stats queue.Stats
+	queued, err := tableExists(ctx, db, "scrape_queue")
+	if err != nil {
+		return nil, err
+	}
+	if queued {
+		if stats, err = queue.JobStats(ctx, db, jobID); err != nil {
+			return nil, err
+		}
+	}
+	if stats.Total() == 0 {
+		saved, err := tableExists(ctx, db, "scrape_jobs")
+		if err != nil || !saved {
+			return nil, err
+		}
+		return progress.Load(ctx, db, jobID)
+	}
+
+	snap := &progress.Snapshot{
+		JobID:     jobID,
+		State:     progress.StateRunning,
+		Total:     stats.Total(),
+		Completed: stats.Done + stats.Failed,
+		Failed:    stats.Failed,
+		InFlight:  stats.Leased,
+		Rate:      float64(stats.Recent) / 60,
+		Elapsed:   stats.LastSeen.Sub(stats.FirstSeen),
+		UpdatedAt: stats.LastSeen,
+	}
+	if stats.Pending == 0 && stats.Leased == 0 {
+		snap.State = progress.StateFinished
+	}
+	return snap, nil
+}
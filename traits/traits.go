@@ -0,0 +1,144 @@
+package traits
+
+import (
+	"sort"
+
+	"github.com/coffeendude/ipfs-cids-go-scraper/metadata"
+)
+
+// None is the value counted for tokens that lack a trait the rest of the
+// collection has. Rarity tools treat a missing trait as a trait value of
+// its own, so tokens missing a common trait are scored as rarer.
+const None = "(none)"
+
+// Rarity methods.
+const (
+	// Statistical scores a token by the probability of drawing its exact
+	// combination of trait values: the product of each value's frequency.
+	// Lower is rarer.
+	Statistical = "statistical"
+	// Normalized sums 1/frequency over a token's trait values, dividing
+	// each trait's term by the number of values that trait can take so
+	// traits with many values don't dominate. Higher is rarer.
+	Normalized = "normalized"
+)
+
+// Distribution counts how many tokens have each value of each trait.
+type Distribution struct {
+	Total  int                       `json:"total"`
+	Traits map[string]map[string]int `json:"traits"`
+}
+
+// Distribute counts the trait values of tokens, including None for tokens
+// missing a trait.
+func Distribute(tokens []metadata.Metadata) Distribution {
+	d := Distribution{Total: len(tokens), Traits: map[string]map[string]int{}}
+	has := map[string]int{}
+	for _, t := range tokens {
+		for trait, values := range valuesByTrait(t) {
+			if d.Traits[trait] == nil {
+				d.Traits[trait] = map[string]int{}
+			}
+			for _, v := range values {
+				d.Traits[trait][v]++
+			}
+			has[trait]++
+		}
+	}
+	for trait, counts := range d.Traits {
+		if missing := d.Total - has[trait]; missing > 0 {
+			counts[None] = missing
+		}
+	}
+	return d
+}
+
+// valuesByTrait groups t's attribute values by trait type. Attributes
+// without a trait type are ignored.
+func valuesByTrait(t metadata.Metadata) map[string][]string {
+	byTrait := map[string][]string{}
+	for _, a := range t.Attributes {
+		if a.TraitType == "" {
+			continue
+		}
+		byTrait[a.TraitType] = append(byTrait[a.TraitType], a.ValueString())
+	}
+	return byTrait
+}
+
+// Score is a token's rarity under both methods. Ranks start at 1 for the
+// rarest token; tokens with equal scores share a rank.
+type Score struct {
+	Cid             string  `json:"cid"`
+	Statistical     float64 `json:"statistical"`
+	StatisticalRank int     `json:"statistical_rank"`
+	Normalized      float64 `json:"normalized"`
+	NormalizedRank  int     `json:"normalized_rank"`
+}
+
+// Rarity scores every token against the distribution of the whole set. The
+// result is ordered by rank under method, then by CID.
+func Rarity(tokens []metadata.Metadata, method string) []Score {
+	d := Distribute(tokens)
+	// Traits are visited in a fixed order so equal combinations get
+	// bit-for-bit equal scores and tie.
+	names := make([]string, 0, len(d.Traits))
+	for trait := range d.Traits {
+		names = append(names, trait)
+	}
+	sort.Strings(names)
+
+	scores := make([]Score, len(tokens))
+	for i, t := range tokens {
+		s := Score{Cid: t.Cid, Statistical: 1}
+		byTrait := valuesByTrait(t)
+		for _, trait := range names {
+			counts := d.Traits[trait]
+			values, ok := byTrait[trait]
+			if !ok {
+				values = []string{None}
+			}
+			for _, v := range values {
+				p := float64(counts[v]) / float64(d.Total)
+				s.Statistical *= p
+				s.Normalized += 1 / p / float64(len(counts))
+			}
+		}
+		scores[i] = s
+	}
+
+	rank(scores, func(a, b Score) bool { return a.Statistical < b.Statistical },
+		func(s *Score, r int) { s.StatisticalRank = r })
+	rank(scores, func(a, b Score) bool { return a.Normalized > b.Normalized },
+		func(s *Score, r int) { s.NormalizedRank = r })
+
+	sort.SliceStable(scores, func(i, j int) bool {
+		ri, rj := scores[i].NormalizedRank, scores[j].NormalizedRank
+		if method == Statistical {
+			ri, rj = scores[i].StatisticalRank, scores[j].StatisticalRank
+		}
+		if ri != rj {
+			return ri < rj
+		}
+		return scores[i].Cid < scores[j].Cid
+	})
+	return scores
+}
+
+// rank assigns competition ranks ("1, 2, 2, 4") to scores ordered by
+// rarer, without reordering them.
+func rank(scores []Score, rarer func(a, b Score) bool, set func(*Score, int)) {
+	order := make([]int, len(scores))
+	for i := range order {
+		order[i] = i
+	}
+	sort.SliceStable(order, func(i, j int) bool { return rarer(scores[order[i]], scores[order[j]]) })
+
+	r := 0
+	for pos, i := range order {
+		if pos == 0 || rarer(scores[order[pos-1]], scores[i]) {
+			r = pos + 1
+		}
+		set(&scores[i], r)
+	}
+}
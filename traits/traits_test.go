@@ -0,0 +1,70 @@
+package traits
+
+import (
+	"math"
+	"reflect"
+	"testing"
+
+	"github.com/coffeendude/ipfs-cids-go-scraper/metadata"
+)
+
+func token(cid string, kv ...string) metadata.Metadata {
+	m := metadata.Metadata{Cid: cid}
+	for i := 0; i < len(kv); i += 2 {
+		m.Attributes = append(m.Attributes, metadata.Attribute{TraitType: kv[i], Value: kv[i+1]})
+	}
+	return m
+}
+
+var tokens = []metadata.Metadata{
+	token("QmA", "Background", "Blue", "Eyes", "Laser"),
+	token("QmB", "Background", "Blue", "Eyes", "Normal"),
+	token("QmC", "Background", "Blue", "Eyes", "Normal"),
+	token("QmD", "Background", "Red"),
+}
+
+func TestDistribute(t *testing.T) {
+	d := Distribute(tokens)
+	want := map[string]map[string]int{
+		"Background": {"Blue": 3, "Red": 1},
+		"Eyes":       {"Laser": 1, "Normal": 2, None: 1},
+	}
+	if d.Total != 4 || !reflect.DeepEqual(d.Traits, want) {
+		t.Errorf("got %d %v, want 4 %v", d.Total, d.Traits, want)
+	}
+}
+
+func TestRarity(t *testing.T) {
+	scores := Rarity(tokens, Statistical)
+	byCid := map[string]Score{}
+	for _, s := range scores {
+		byCid[s.Cid] = s
+	}
+
+	// QmA: P(Blue) * P(Laser) = 3/4 * 1/4.
+	if got := byCid["QmA"].Statistical; math.Abs(got-3.0/16) > 1e-12 {
+		t.Errorf("QmA statistical = %v, want %v", got, 3.0/16)
+	}
+	// QmD: (1/P(Red)) / 2 values + (1/P(none)) / 3 values = 4/2 + 4/3.
+	if got := byCid["QmD"].Normalized; math.Abs(got-(2+4.0/3)) > 1e-12 {
+		t.Errorf("QmD normalized = %v, want %v", got, 2+4.0/3)
+	}
+
+	// QmD is 1/4 * 1/4; QmB and QmC tie at 3/4 * 2/4.
+	var order []string
+	var ranks []int
+	for _, s := range scores {
+		order = append(order, s.Cid)
+		ranks = append(ranks, s.StatisticalRank)
+	}
+	if want := []string{"QmD", "QmA", "QmB", "QmC"}; !reflect.DeepEqual(order, want) {
+		t.Errorf("statistical order = %v, want %v", order, want)
+	}
+	if want := []int{1, 2, 3, 3}; !reflect.DeepEqual(ranks, want) {
+		t.Errorf("statistical ranks = %v, want %v", ranks, want)
+	}
+
+	if s := Rarity(tokens, Normalized); s[0].Cid != "QmD" || s[0].NormalizedRank != 1 || s[3].NormalizedRank != 3 {
+		t.Errorf("normalized ranking = %+v", s)
+	}
+}
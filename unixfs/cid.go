@@ -0,0 +1,99 @@
+package unixfs
+
+import (
+	"encoding/base32"
+	"errors"
+	"math/big"
+	"strings"
+)
+
+// Multicodecs of the blocks a directory links to.
+const (
+	CodecRaw   = 0x55
+	CodecDagPB = 0x70
+)
+
+const base58Alphabet = "123456789ABCDEFGHJKLMNPQRSTUVWXYZabcdefghijkmnopqrstuvwxyz"
+
+var base32Lower = base32.NewEncoding("abcdefghijklmnopqrstuvwxyz234567").WithPadding(base32.NoPadding)
+
+// CIDString formats a binary CID the way gateways do: CIDv0 in base58 and
+// CIDv1 in base32.
+func CIDString(b []byte) (string, error) {
+	if len(b) == 34 && b[0] == 0x12 && b[1] == 0x20 {
+		return base58Encode(b), nil
+	}
+	if len(b) < 4 || b[0] != 1 {
+		return "", errors.New("invalid CID")
+	}
+	return "b" + base32Lower.EncodeToString(b), nil
+}
+
+// Codec returns the multicodec of a CID string, or -1 if it can't be
+// decoded. CIDv0 is always dag-pb.
+func Codec(cid string) int {
+	if len(cid) == 46 && strings.HasPrefix(cid, "Qm") {
+		return CodecDagPB
+	}
+	if cid == "" {
+		return -1
+	}
+	var b []byte
+	var err error
+	switch cid[0] {
+	case 'b':
+		b, err = base32Lower.DecodeString(strings.ToLower(cid[1:]))
+	case 'z':
+		b, err = base58Decode(cid[1:])
+	default:
+		return -1
+	}
+	if err != nil {
+		return -1
+	}
+	version, n := uvarint(b)
+	if n == 0 || version != 1 {
+		return -1
+	}
+	codec, m := uvarint(b[n:])
+	if m == 0 {
+		return -1
+	}
+	return int(codec)
+}
+
+func base58Encode(b []byte) string {
+	x := new(big.Int).SetBytes(b)
+	base, mod := big.NewInt(58), new(big.Int)
+	var out []byte
+	for x.Sign() > 0 {
+		x.DivMod(x, base, mod)
+		out = append(out, base58Alphabet[mod.Int64()])
+	}
+	for _, c := range b {
+		if c != 0 {
+			break
+		}
+		out = append(out, base58Alphabet[0])
+	}
+	for i, j := 0, len(out)-1; i < j; i, j = i+1, j-1 {
+		out[i], out[j] = out[j], out[i]
+	}
+	return string(out)
+}
+
+func base58Decode(s string) ([]byte, error) {
+	x, base := new(big.Int), big.NewInt(58)
+	zeros := 0
+	for i, c := range s {
+		d := strings.IndexRune(base58Alphabet, c)
+		if d < 0 {
+			return nil, errors.New("invalid base58")
+		}
+		if d == 0 && zeros == i {
+			zeros++
+		}
+		x.Mul(x, base).Add(x, big.NewInt(int64(d)))
+	}
+	return append(make([]byte, zeros), x.Bytes()...), nil
+}
@@ -0,0 +1,141 @@
+package unixfs
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Formats a node can be fetched in.
+const (
+	FormatDAGJSON = "dag-json"
+	FormatRaw     = "raw"
+)
+
+// MediaType is the Accept header that asks a gateway for a node in format.
+func MediaType(format string) string {
+	return "application/vnd.ipld." + format
+}
+
+// Crawler lists the files under a directory.
+type Crawler struct {
+	// Fetch returns the node at an IPFS path in format.
+	Fetch func(ctx context.Context, path, format string) ([]byte, error)
+	// Format is FormatDAGJSON or FormatRaw.
+	Format string
+	// MaxDepth is how many levels of directories are listed; 1 lists only
+	// the root. Entries found at the last level are taken to be files
+	// without fetching them. Below that, every dag-pb entry is fetched to
+	// tell files from subdirectories.
+	MaxDepth int
+	// MaxEntries caps the entries taken from one directory, in name order.
+	// The shards of a HAMT-sharded directory are only fetched until more
+	// than MaxEntries entries are found, so there the entries taken are the
+	// first in shard order, sorted by name. Zero means no limit.
+	MaxEntries int
+}
+
+// Result is the outcome of a crawl.
+type Result struct {
+	// Files are the IPFS paths of the files found, "<root>/<name>".
+	Files []string
+	// Truncated are the directories that had more than MaxEntries entries.
+	Truncated []string
+}
+
+// Crawl lists the files under root, a directory CID or IPFS path.
+func (c *Crawler) Crawl(ctx context.Context, root string) (*Result, error) {
+	root = strings.Trim(root, "/")
+	n, err := c.node(ctx, root)
+	if err != nil {
+		return nil, err
+	}
+	if !n.IsDirectory() {
+		return nil, fmt.Errorf("%s is not a directory", root)
+	}
+	res := &Result{}
+	if err := c.walk(ctx, root, n, 1, res); err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+func (c *Crawler) walk(ctx context.Context, path string, n *Node, depth int, res *Result) error {
+	entries, err := c.entries(ctx, n, nil)
+	if err != nil {
+		return fmt.Errorf("error listing %s: %w", path, err)
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Name < entries[j].Name })
+	if c.MaxEntries > 0 && len(entries) > c.MaxEntries {
+		res.Truncated = append(res.Truncated, path)
+		entries = entries[:c.MaxEntries]
+	}
+
+	for _, e := range entries {
+		child := path + "/" + e.Name
+		if depth >= c.MaxDepth || Codec(e.Cid) == CodecRaw {
+			res.Files = append(res.Files, child)
+			continue
+		}
+		cn, err := c.node(ctx, e.Cid)
+		if err != nil {
+			return err
+		}
+		if !cn.IsDirectory() {
+			res.Files = append(res.Files, child)
+			continue
+		}
+		if err := c.walk(ctx, child, cn, depth+1, res); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// entries appends the entries of a directory to found, following the
+// sub-shards of a HAMT-sharded one. Shards stop being fetched once more
+// than MaxEntries entries are found.
+func (c *Crawler) entries(ctx context.Context, n *Node, found []Link) ([]Link, error) {
+	if n.Type != TypeHAMTShard {
+		return append(found, n.Links...), nil
+	}
+	if n.Fanout == 0 {
+		return nil, fmt.Errorf("HAMT shard without a fanout")
+	}
+	// Link names start with the bucket index in hex; a link that is only
+	// the index is a sub-shard.
+	prefix := len(fmt.Sprintf("%X", n.Fanout-1))
+	for _, l := range n.Links {
+		if c.MaxEntries > 0 && len(found) > c.MaxEntries {
+			break
+		}
+		if len(l.Name) < prefix {
+			return nil, fmt.Errorf("invalid HAMT link name %q", l.Name)
+		}
+		if len(l.Name) > prefix {
+			l.Name = l.Name[prefix:]
+			found = append(found, l)
+			continue
+		}
+		shard, err := c.node(ctx, l.Cid)
+		if err != nil {
+			return nil, err
+		}
+		if found, err = c.entries(ctx, shard, found); err != nil {
+			return nil, err
+		}
+	}
+	return found, nil
+}
+
+func (c *Crawler) node(ctx context.Context, path string) (*Node, error) {
+	b, err := c.Fetch(ctx, path, c.Format)
+	if err != nil {
+		return nil, err
+	}
+	if c.Format == FormatRaw {
+		return DecodePB(b)
+	}
+	return DecodeDAGJSON(b)
+}
@@ -0,0 +1,212 @@
+// Package unixfs lists the files under a UnixFS directory CID, so that a
+// collection pinned as one directory can be scraped without listing every
+// file by hand. Nodes are read either as dag-json, which gateways serve for
+// ?format=dag-json, or as raw dag-pb blocks.
+package unixfs
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// UnixFS node types.
+const (
+	TypeRaw       = 0
+	TypeDirectory = 1
+	TypeFile      = 2
+	TypeMetadata  = 3
+	TypeSymlink   = 4
+	TypeHAMTShard = 5
+)
+
+// Node is a dag-pb node with its UnixFS data decoded.
+type Node struct {
+	Type int
+	// Fanout is the number of buckets of a HAMT shard.
+	Fanout uint64
+	Links  []Link
+}
+
+// Link is a named link from a node.
+type Link struct {
+	Cid  string
+	Name string
+	Size uint64
+}
+
+// IsDirectory reports whether n lists directory entries.
+func (n *Node) IsDirectory() bool {
+	return n.Type == TypeDirectory || n.Type == TypeHAMTShard
+}
+
+// DecodePB decodes a raw dag-pb block.
+func DecodePB(b []byte) (*Node, error) {
+	n := &Node{Type: -1}
+	var data []byte
+	err := eachField(b, func(field int, v uint64, bytes []byte) error {
+		switch field {
+		case 1:
+			data = bytes
+		case 2:
+			link, err := decodePBLink(bytes)
+			if err != nil {
+				return err
+			}
+			n.Links = append(n.Links, link)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error decoding dag-pb node: %w", err)
+	}
+	if err := n.decodeData(data); err != nil {
+		return nil, err
+	}
+	return n, nil
+}
+
+func decodePBLink(b []byte) (Link, error) {
+	var l Link
+	err := eachField(b, func(field int, v uint64, bytes []byte) error {
+		switch field {
+		case 1:
+			c, err := CIDString(bytes)
+			if err != nil {
+				return err
+			}
+			l.Cid = c
+		case 2:
+			l.Name = string(bytes)
+		case 3:
+			l.Size = v
+		}
+		return nil
+	})
+	if err == nil && l.Cid == "" {
+		err = errors.New("link without a hash")
+	}
+	return l, err
+}
+
+// DecodeDAGJSON decodes a dag-pb node in its dag-json form.
+func DecodeDAGJSON(b []byte) (*Node, error) {
+	var raw struct {
+		Data *struct {
+			Slash struct {
+				Bytes string `json:"bytes"`
+			} `json:"/"`
+		}
+		Links []struct {
+			Hash struct {
+				Slash string `json:"/"`
+			}
+			Name  string
+			Tsize uint64
+		}
+	}
+	if err := json.Unmarshal(b, &raw); err != nil {
+		return nil, fmt.Errorf("error decoding dag-json node: %w", err)
+	}
+
+	n := &Node{Type: -1}
+	for _, l := range raw.Links {
+		if l.Hash.Slash == "" {
+			return nil, errors.New("error decoding dag-json node: link without a hash")
+		}
+		n.Links = append(n.Links, Link{Cid: l.Hash.Slash, Name: l.Name, Size: l.Tsize})
+	}
+	if raw.Data != nil {
+		data, err := base64.RawStdEncoding.DecodeString(strings.TrimRight(raw.Data.Slash.Bytes, "="))
+		if err != nil {
+			return nil, fmt.Errorf("error decoding dag-json node data: %w", err)
+		}
+		if err := n.decodeData(data); err != nil {
+			return nil, err
+		}
+	}
+	return n, nil
+}
+
+// decodeData reads the UnixFS Data message of a node.
+func (n *Node) decodeData(data []byte) error {
+	if data == nil {
+		return nil
+	}
+	err := eachField(data, func(field int, v uint64, bytes []byte) error {
+		switch field {
+		case 1:
+			n.Type = int(v)
+		case 6:
+			n.Fanout = v
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("error decoding UnixFS data: %w", err)
+	}
+	return nil
+}
+
+// eachField calls fn for every field of a protobuf message, with the value
+// of varint fields and the bytes of length-delimited ones.
+func eachField(b []byte, fn func(field int, v uint64, bytes []byte) error) error {
+	for len(b) > 0 {
+		key, n := uvarint(b)
+		if n == 0 {
+			return errors.New("truncated field key")
+		}
+		b = b[n:]
+		field, wire := int(key>>3), key&7
+
+		var v uint64
+		var bytes []byte
+		switch wire {
+		case 0:
+			if v, n = uvarint(b); n == 0 {
+				return errors.New("truncated varint")
+			}
+			b = b[n:]
+		case 2:
+			l, n := uvarint(b)
+			if n == 0 || uint64(len(b)-n) < l {
+				return errors.New("truncated bytes")
+			}
+			bytes, b = b[n:n+int(l)], b[n+int(l):]
+		case 1:
+			if len(b) < 8 {
+				return errors.New("truncated fixed64")
+			}
+			b = b[8:]
+		case 5:
+			if len(b) < 4 {
+				return errors.New("truncated fixed32")
+			}
+			b = b[4:]
+		default:
+			return fmt.Errorf("unsupported wire type %d", wire)
+		}
+		if err := fn(field, v, bytes); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// uvarint decodes a varint, returning 0 bytes read if b is truncated or
+// the value overflows.
+func uvarint(b []byte) (uint64, int) {
+	var v uint64
+	for i, c := range b {
+		if i == 10 {
+			return 0, 0
+		}
+		v |= uint64(c&0x7f) << (7 * i)
+		if c < 0x80 {
+			return v, i + 1
+		}
+	}
+	return 0, 0
+}
@@ -0,0 +1,156 @@
+package unixfs
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"reflect"
+	"testing"
+)
+
+func field(num int, b []byte) []byte {
+	out := binary.AppendUvarint(nil, uint64(num<<3|2))
+	out = binary.AppendUvarint(out, uint64(len(b)))
+	return append(out, b...)
+}
+
+func varintField(num int, v uint64) []byte {
+	return binary.AppendUvarint(binary.AppendUvarint(nil, uint64(num<<3)), v)
+}
+
+// cidV0 and cidV1Raw make binary CIDs with a hash of seed.
+func cidV0(seed string) []byte {
+	sum := sha256.Sum256([]byte(seed))
+	return append([]byte{0x12, 0x20}, sum[:]...)
+}
+
+func cidV1Raw(seed string) []byte {
+	return append([]byte{0x01, CodecRaw}, cidV0(seed)...)
+}
+
+type link struct {
+	cid  []byte
+	name string
+}
+
+// pbNode encodes a dag-pb node, links first as the spec requires.
+func pbNode(typ int, fanout uint64, links ...link) []byte {
+	var b []byte
+	for _, l := range links {
+		pl := append(field(1, l.cid), field(2, []byte(l.name))...)
+		pl = append(pl, varintField(3, 10)...)
+		b = append(b, field(2, pl)...)
+	}
+	data := varintField(1, uint64(typ))
+	if fanout > 0 {
+		data = append(data, varintField(6, fanout)...)
+	}
+	return append(b, field(1, data)...)
+}
+
+func str(b []byte) string {
+	s, err := CIDString(b)
+	if err != nil {
+		panic(err)
+	}
+	return s
+}
+
+func TestCIDString(t *testing.T) {
+	v0 := str(cidV0("a"))
+	if len(v0) != 46 || v0[:2] != "Qm" || Codec(v0) != CodecDagPB {
+		t.Errorf("CIDv0 = %q, codec %d", v0, Codec(v0))
+	}
+	if b, err := base58Decode(v0); err != nil || !bytes.Equal(b, cidV0("a")) {
+		t.Errorf("base58 round trip = %x, %v", b, err)
+	}
+	v1 := str(cidV1Raw("a"))
+	if v1[0] != 'b' || Codec(v1) != CodecRaw {
+		t.Errorf("CIDv1 = %q, codec %d", v1, Codec(v1))
+	}
+	if Codec("not a cid") != -1 {
+		t.Error("expected -1 for an invalid CID")
+	}
+}
+
+func TestDecodeDAGJSON(t *testing.T) {
+	n, err := DecodeDAGJSON([]byte(`{"Data":{"/":{"bytes":"CAE"}},"Links":[{"Hash":{"/":"bafkqaaa"},"Name":"1.json","Tsize":12}]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := &Node{Type: TypeDirectory, Links: []Link{{Cid: "bafkqaaa", Name: "1.json", Size: 12}}}
+	if !reflect.DeepEqual(n, want) {
+		t.Errorf("got %+v, want %+v", n, want)
+	}
+}
+
+func TestCrawl(t *testing.T) {
+	// root/
+	//   1.json, 2.json (raw leaves)
+	//   sub/ (HAMT shard with a sub-shard)
+	//     a.json, b.json
+	blocks := map[string][]byte{}
+	put := func(cid []byte, block []byte) string {
+		s := str(cid)
+		blocks[s] = block
+		return s
+	}
+	a := put(cidV0("a"), pbNode(TypeFile, 0))
+	b := put(cidV0("b"), pbNode(TypeFile, 0))
+	put(cidV0("shard"), pbNode(TypeHAMTShard, 256, link{cidV0("b"), "1Fb.json"}))
+	sub := put(cidV0("sub"), pbNode(TypeHAMTShard, 256, link{cidV0("a"), "0Aa.json"}, link{cidV0("shard"), "1F"}))
+	root := put(cidV0("root"), pbNode(TypeDirectory, 0,
+		link{cidV1Raw("1"), "1.json"}, link{cidV1Raw("2"), "2.json"}, link{cidV0("sub"), "sub"}))
+
+	fetched := map[string]int{}
+	c := &Crawler{
+		Format:   FormatRaw,
+		MaxDepth: 2,
+		Fetch: func(ctx context.Context, path, format string) ([]byte, error) {
+			fetched[path]++
+			if block, ok := blocks[path]; ok {
+				return block, nil
+			}
+			return nil, fmt.Errorf("no block %s", path)
+		},
+	}
+	res, err := c.Crawl(context.Background(), root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{root + "/1.json", root + "/2.json", root + "/sub/a.json", root + "/sub/b.json"}
+	if !reflect.DeepEqual(res.Files, want) || len(res.Truncated) != 0 {
+		t.Errorf("files = %v, truncated = %v, want %v", res.Files, res.Truncated, want)
+	}
+	if fetched[a] != 0 || fetched[b] != 0 || fetched[sub] != 1 {
+		t.Errorf("fetched %v: files at the last level shouldn't be fetched", fetched)
+	}
+
+	c.MaxDepth, c.MaxEntries = 1, 2
+	res, err = c.Crawl(context.Background(), root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{root + "/1.json", root + "/2.json"}; !reflect.DeepEqual(res.Files, want) || !reflect.DeepEqual(res.Truncated, []string{root}) {
+		t.Errorf("limited: files = %v, truncated = %v", res.Files, res.Truncated)
+	}
+
+	// A sharded directory's shards are left alone once there are more
+	// entries than MaxEntries; this sub-shard isn't there to fetch.
+	big := put(cidV0("big"), pbNode(TypeHAMTShard, 256,
+		link{cidV0("b"), "0Bb.json"}, link{cidV0("a"), "0Aa.json"}, link{cidV0("missing"), "1F"}))
+	c.MaxEntries = 1
+	res, err = c.Crawl(context.Background(), big)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{big + "/a.json"}; !reflect.DeepEqual(res.Files, want) || !reflect.DeepEqual(res.Truncated, []string{big}) {
+		t.Errorf("limited HAMT: files = %v, truncated = %v", res.Files, res.Truncated)
+	}
+
+	if _, err := c.Crawl(context.Background(), a); err == nil {
+		t.Error("expected an error crawling a file")
+	}
+}
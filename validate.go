@@ -0,0 +1,209 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"flag"
+	"fmt"
+	"strings"
+
+	"github.com/coffeendude/ipfs-cids-go-scraper/collection"
+	"github.com/coffeendude/ipfs-cids-go-scraper/metadata"
+	"github.com/coffeendude/ipfs-cids-go-scraper/schema"
+)
+
+// validator checks documents against the schema of their collection, or
+// the default schema for documents outside any collection with one.
+type validator struct {
+	db           *sql.DB
+	def          *schema.Schema
+	byCollection map[string]*schema.Schema
+}
+
+// newValidator loads the default schema def and the schema of every
+// collection that names one.
+func newValidator(ctx context.Context, db *sql.DB, def string) (*validator, error) {
+	if err := schema.CreateTable(db); err != nil {
+		return nil, err
+	}
+	if err := collection.CreateTables(db); err != nil {
+		return nil, err
+	}
+	collections, err := collection.List(ctx, db)
+	if err != nil {
+		return nil, err
+	}
+	return validatorFor(db, def, collections)
+}
+
+// validatorFor returns a validator for the default schema def and the
+// schemas of collections, for callers that list them themselves.
+func validatorFor(db *sql.DB, def string, collections []collection.Collection) (*validator, error) {
+	v := &validator{db: db, byCollection: map[string]*schema.Schema{}}
+	var err error
+	if v.def, err = schema.Load(def); err != nil {
+		return nil, err
+	}
+	for _, c := range collections {
+		if c.Schema == "" {
+			continue
+		}
+		if v.byCollection[c.ID], err = schema.LoadStored(c.Schema, "collection "+c.ID); err != nil {
+			return nil, fmt.Errorf("error loading schema of collection %s: %w", c.ID, err)
+		}
+	}
+	return v, nil
+}
+
+// schemaFor returns the schema cid is validated against.
+func (v *validator) schemaFor(ctx context.Context, cid string) (*schema.Schema, error) {
+	if len(v.byCollection) == 0 {
+		return v.def, nil
+	}
+	ids, err := collection.Of(ctx, v.db, cid)
+	if err != nil {
+		return nil, err
+	}
+	for _, id := range ids {
+		if s, ok := v.byCollection[id]; ok {
+			return s, nil
+		}
+	}
+	return v.def, nil
+}
+
+// validate checks doc, the document of cid as mapped, and stores the
+// result.
+func (v *validator) validate(ctx context.Context, cid string, doc []byte) (schema.Result, error) {
+	s, r, err := v.check(ctx, cid, doc)
+	if err != nil {
+		return r, err
+	}
+	return r, schema.Save(ctx, v.db, cid, s.Name, r)
+}
+
+// check is validate without storing the result. It also returns the
+// schema doc was checked against.
+func (v *validator) check(ctx context.Context, cid string, doc []byte) (*schema.Schema, schema.Result, error) {
+	s, err := v.schemaFor(ctx, cid)
+	if err != nil {
+		return nil, schema.Result{}, err
+	}
+	return s, s.Validate(doc), nil
+}
+
+// forget deletes the stored validation of cid, whose document is no longer
+// stored, so that an old result isn't left behind.
+func (v *validator) forget(ctx context.Context, cid string) error {
+	return schema.Delete(ctx, v.db, cid)
+}
+
+// runValidate implements the validate subcommand, which validates the
+// stored documents again, e.g. after a collection's schema changed.
+func runValidate(args []string) error {
+	fs := flag.NewFlagSet("validate", flag.ExitOnError)
+	var dbc dbConfig
+	var lc logConfig
+	dbc.register(fs)
+	lc.register(fs)
+	def := fs.String("schema", schema.ERC721, "Schema for documents whose collection has none: erc721, erc1155 or a schema file")
+	coll := fs.String("collection", "", "Only validate the tokens of this collection")
+	cids := fs.String("cids", "", "Only validate these comma-separated CIDs")
+	quiet := fs.Bool("quiet", false, "Only print the summary, not the errors of each invalid document")
+	fs.Parse(args)
+
+	lc.setup()
+	db, err := dbc.connect()
+	if err != nil {
+		return fail("Error connecting to database", err)
+	}
+	defer db.Close()
+	if err := ensureMetadataTable(db); err != nil {
+		return fail("Error creating metadata table", err)
+	}
+
+	ctx := context.Background()
+	v, err := newValidator(ctx, db, *def)
+	if err != nil {
+		return fail("Error loading schemas", err)
+	}
+	mp, err := newMapper(ctx, db)
+	if err != nil {
+		return fail("Error loading mappings", err)
+	}
+
+	q := "SELECT " + metadata.QualifiedColumns("m") + ", m.raw FROM metadata m"
+	var where []string
+	var qargs []any
+	if *coll != "" {
+		qargs = append(qargs, *coll)
+		q += " JOIN collection_tokens t ON t.cid = m.cid AND t.collection_id = $1"
+	}
+	if list := splitList(*cids); len(list) > 0 {
+		var ph []string
+		for _, cid := range list {
+			qargs = append(qargs, cid)
+			ph = append(ph, fmt.Sprintf("$%d", len(qargs)))
+		}
+		where = append(where, "m.cid IN ("+strings.Join(ph, ", ")+")")
+	}
+	where = append(where, documentRows)
+	q += " WHERE " + strings.Join(where, " AND ") + " ORDER BY m.cid"
+
+	rows, err := db.QueryContext(ctx, q, qargs...)
+	if err != nil {
+		return fail("Error querying metadata", err)
+	}
+	defer rows.Close()
+
+	var total, invalid, warned int
+	var noRaw []string
+	for rows.Next() {
+		var raw []byte
+		m, err := metadata.Scan(rows, &raw)
+		if err != nil {
+			return fail("Error scanning row", err)
+		}
+		cid := m.Cid
+		if raw == nil {
+			noRaw = append(noRaw, cid)
+			if err := v.forget(ctx, cid); err != nil {
+				return fail("Error deleting validation", err)
+			}
+			continue
+		}
+		m.Raw = raw
+		mt, err := mp.mappingFor(ctx, cid)
+		if err != nil {
+			return fail("Error loading mapping", err)
+		}
+		doc, err := mappedDocument(m, mt)
+		if err != nil {
+			return fail("Error mapping metadata", err)
+		}
+		r, err := v.validate(ctx, cid, doc)
+		if err != nil {
+			return fail("Error validating metadata", err)
+		}
+		total++
+		if len(r.Warnings) > 0 {
+			warned++
+		}
+		if r.Valid {
+			continue
+		}
+		invalid++
+		if !*quiet {
+			fmt.Println(cid)
+			for _, e := range r.Errors {
+				fmt.Printf("  %s\n", e)
+			}
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return fail("Error reading rows", err)
+	}
+	fmt.Printf("Validated %d documents: %d valid, %d invalid, %d with warnings\n", total, total-invalid, invalid, warned)
+	printNoRaw(noRaw)
+	return nil
+}